@@ -0,0 +1,223 @@
+package api
+
+import "net/http"
+
+// dashboard serves the web dashboard, which shows the session status, the
+// lists the head unit has shown, and a live log of the commands going to
+// and from the car, with commands that weren't handled highlighted.
+func (srv *Server) dashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardHTML))
+}
+
+// The dashboard is kept to one page with no external resources, as there
+// is usually no internet in the car.
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>bmwctrl</title>
+<style>
+body { font: 14px sans-serif; margin: 0; background: #111; color: #ddd; }
+header { padding: 8px 12px; background: #222; display: flex; gap: 16px; align-items: center; flex-wrap: wrap; }
+header b { color: #fff; }
+button { background: #333; color: #ddd; border: 1px solid #555; padding: 6px 12px; font-size: 16px; }
+main { display: flex; flex-wrap: wrap; }
+section { padding: 8px 12px; box-sizing: border-box; }
+#left { flex: 1 1 360px; }
+#right { flex: 2 1 480px; }
+h2 { font-size: 13px; text-transform: uppercase; color: #888; margin: 12px 0 4px; }
+#track { font-size: 18px; color: #fff; }
+progress { width: 100%; }
+.lcd { background: #1b2a3a; color: #ffb000; font-family: monospace; padding: 6px; min-height: 120px; max-height: 240px; overflow-y: auto; }
+.lcd div.gap { color: #665; }
+#tabs button { font-size: 12px; padding: 3px 6px; margin: 0 2px 2px 0; }
+#tabs button.current { border-color: #ffb000; }
+#tabs button.shown { background: #554; }
+table { border-collapse: collapse; width: 100%; font: 12px monospace; }
+td { padding: 1px 6px; vertical-align: top; white-space: nowrap; }
+td.fields { white-space: normal; word-break: break-all; color: #999; }
+tr.in td.dir { color: #6af; }
+tr.out td.dir { color: #6d6; }
+tr.unhandled { background: #611; }
+tr.unhandled td { color: #fcc; }
+#counters td { font: 13px sans-serif; }
+</style>
+</head>
+<body>
+<header>
+  <b>bmwctrl</b>
+  <span id="conn">connecting</span>
+  <span id="identified"></span>
+  <button onclick="post('prev')">&#9198;</button>
+  <button onclick="post('toggle')">&#9199;</button>
+  <button onclick="post('next')">&#9197;</button>
+  <label>shuffle <select id="shuffle" onchange="post('shuffle?mode=' + this.value)">
+    <option>off</option><option>tracks</option><option>albums</option></select></label>
+  <label>repeat <select id="repeat" onchange="post('repeat?mode=' + this.value)">
+    <option>off</option><option>one</option><option>all</option></select></label>
+</header>
+<main>
+<section id="left">
+  <h2>Now playing</h2>
+  <div id="track">-</div>
+  <div id="artist"></div>
+  <progress id="progress" value="0" max="1" onclick="seek(event)"></progress>
+  <div id="time"></div>
+  <h2>CD screens</h2>
+  <div id="tabs"></div>
+  <div class="lcd" id="screen"></div>
+  <h2>Counters</h2>
+  <table id="counters"></table>
+</section>
+<section id="right">
+  <h2>Commands
+    <label><input type="checkbox" id="polling"> show polling</label>
+    <label><input type="checkbox" id="paused"> pause</label>
+    <label><input type="checkbox" id="unhandledOnly"> unhandled only</label>
+  </h2>
+  <table><tbody id="log"></tbody></table>
+</section>
+</main>
+<script>
+var current = null, screens = [], shownScreen = null, rows = {};
+var polling = {GetPlayStatus: 1, ReturnPlayStatus: 1, TrackTimeOffsetChangeNotification: 1};
+var maxRows = 500;
+
+function $(id) { return document.getElementById(id); }
+function text(el, s) { el.textContent = s; }
+function time(ms) {
+  var s = Math.floor(ms / 1000);
+  return Math.floor(s / 60) + ':' + ('0' + s % 60).slice(-2);
+}
+
+function post(path) {
+  fetch('/api/' + path, {method: 'POST'}).then(function(r) { return r.json(); }).then(showStatus);
+}
+
+function seek(e) {
+  if (!current || !current.track) return;
+  var bar = $('progress');
+  var position = Math.floor(current.track.length * e.offsetX / bar.offsetWidth);
+  post('seek?position=' + position);
+}
+
+function showStatus(s) {
+  if (s.error) { alert(s.error); return; }
+  current = s;
+  text($('identified'), s.identified ? 'identified' : 'not identified');
+  $('shuffle').value = s.shuffle;
+  $('repeat').value = s.repeat;
+  if (s.track) {
+    text($('track'), s.track.title + ' (' + s.state + ')');
+    text($('artist'), s.track.artist + ' - ' + s.track.album + ' [' + (s.track.index + 1) + '/' + s.queue_length + ']');
+    $('progress').max = s.track.length || 1;
+    $('progress').value = s.track.position;
+    text($('time'), time(s.track.position) + ' / ' + time(s.track.length));
+  } else {
+    text($('track'), s.state);
+    text($('artist'), '');
+    $('progress').value = 0;
+    text($('time'), '');
+  }
+  var c = $('counters');
+  c.innerHTML = '';
+  Object.keys(s.counters).forEach(function(k) {
+    var tr = c.insertRow();
+    text(tr.insertCell(), k.replace(/_/g, ' '));
+    text(tr.insertCell(), s.counters[k]);
+  });
+}
+
+function showScreens(list) {
+  screens = list;
+  var tabs = $('tabs');
+  tabs.innerHTML = '';
+  var latest = null;
+  list.forEach(function(screen) {
+    if (screen.current) latest = screen.path;
+  });
+  if (!shownScreen || !list.some(function(s) { return s.path == shownScreen; })) shownScreen = latest;
+  list.forEach(function(screen) {
+    var b = document.createElement('button');
+    text(b, screen.path + ' (' + screen.count + ')');
+    if (screen.current) b.className = 'current';
+    if (screen.path == shownScreen) b.className += ' shown';
+    b.onclick = function() { shownScreen = screen.path; showScreens(screens); };
+    tabs.appendChild(b);
+  });
+  var lcd = $('screen');
+  lcd.innerHTML = '';
+  list.forEach(function(screen) {
+    if (screen.path != shownScreen) return;
+    for (var i = 0; i < screen.count; i++) {
+      var div = document.createElement('div');
+      var record = screen.records[i];
+      if (record === undefined || record === '') {
+        div.className = 'gap';
+        record = '(not retrieved)';
+      }
+      text(div, (i + 1) + ' ' + record);
+      lcd.appendChild(div);
+    }
+  });
+}
+
+function addEvent(e) {
+  if (e.kind == 'unhandled') {
+    var row = rows[e.ref];
+    if (row) {
+      row.className += ' unhandled';
+      row.style.display = '';
+    }
+    return;
+  }
+  if ($('paused').checked) return;
+  var log = $('log');
+  var tr = document.createElement('tr');
+  tr.className = e.dir == '>' ? 'in' : 'out';
+  var hidden = (!$('polling').checked && polling[e.command]) || $('unhandledOnly').checked;
+  if (hidden) tr.style.display = 'none';
+  [e.seq, e.time.substr(11, 12), e.dir, e.lingo, e.id, e.command, e.fields].forEach(function(v, i) {
+    var td = tr.insertCell();
+    td.className = ['seq', 'time', 'dir', 'lingo', 'id', 'command', 'fields'][i];
+    text(td, v === undefined ? '' : v);
+  });
+  rows[e.seq] = tr;
+  log.insertBefore(tr, log.firstChild);
+  while (log.childNodes.length > maxRows) {
+    var last = log.lastChild;
+    delete rows[last.firstChild.textContent];
+    log.removeChild(last);
+  }
+}
+
+function refresh() {
+  fetch('/api/status').then(function(r) { return r.json(); }).then(showStatus);
+  fetch('/api/screens').then(function(r) { return r.json(); }).then(showScreens);
+}
+
+function connect() {
+  var source = new EventSource('/api/events');
+  source.onopen = function() {
+    // The backlog is sent again on every connection.
+    $('log').innerHTML = '';
+    rows = {};
+    text($('conn'), 'connected');
+  };
+  source.onerror = function() { text($('conn'), 'disconnected'); };
+  source.onmessage = function(m) { addEvent(JSON.parse(m.data)); };
+}
+
+connect();
+refresh();
+setInterval(refresh, 1000);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// How often a comment is sent on an idle event stream, so proxies and
+// phones don't drop the connection.
+const keepAliveInterval = 15 * time.Second
+
+// events streams the session's events as server-sent events, starting with
+// the recent ones.  Each event is sent as JSON, with its seq as the ID.
+func (srv *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, errorResponse{"streaming not supported"})
+		return
+	}
+	backlog, events, cancel := srv.session.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	logger.Debug("Event stream opened", "remote", r.RemoteAddr)
+
+	send := func(seq uint64, v interface{}) error {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, data)
+		return err
+	}
+	for _, e := range backlog {
+		if err := send(e.Seq, e); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e := <-events:
+			if err := send(e.Seq, e); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			logger.Debug("Event stream closed", "remote", r.RemoteAddr)
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+func (srv *Server) screens(r *http.Request) (interface{}, error) {
+	return srv.session.Screens(), nil
+}
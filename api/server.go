@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"bmwctrl/logging"
+	"bmwctrl/session"
+)
+
+var logger = logging.New("api")
+
+// Server is an HTTP server that reports the state of a session as JSON,
+// and lets the player be controlled, so that a phone on the car's wifi can
+// be used as a second remote.  A dashboard for debugging in the car is
+// served at /.
+//
+//	GET  /api/status                    session, current track and counters
+//	GET  /api/screens                   lists the head unit has shown
+//	GET  /api/events                    live commands, as server-sent events
+//	GET  /api/queue?offset=N&count=N    tracks in the play queue
+//	POST /api/play, /api/pause, /api/toggle, /api/stop
+//	POST /api/next, /api/prev
+//	POST /api/seek?position=POS         POS in ms, or a duration (e.g. 1m30s)
+//	POST /api/track?index=N             jump to a track in the play queue
+//	POST /api/shuffle?mode=off|tracks|albums
+//	POST /api/repeat?mode=off|one|all
+//
+// Control requests answer with the new status.
+type Server struct {
+	session  *session.Session
+	mux      *http.ServeMux
+	listener net.Listener
+	server   *http.Server
+}
+
+// The parameter that holds the argument of each control command.
+var controlParams = map[string]string{
+	"seek":    "position",
+	"track":   "index",
+	"shuffle": "mode",
+	"repeat":  "mode",
+}
+
+// NewServer creates a server for a session.  It doesn't listen until Start
+// is called, so other handlers can be added with Handle first.
+func NewServer(s *session.Session) *Server {
+	srv := &Server{session: s, mux: http.NewServeMux()}
+	srv.mux.HandleFunc("/", srv.dashboard)
+	srv.mux.HandleFunc("/api/events", srv.events)
+	srv.mux.HandleFunc("/api/screens", srv.get(srv.screens))
+	srv.mux.HandleFunc("/api/status", srv.get(srv.status))
+	srv.mux.HandleFunc("/api/queue", srv.get(srv.queue))
+	for _, command := range session.Commands {
+		srv.mux.HandleFunc("/api/"+command, srv.post(srv.control(command)))
+	}
+	return srv
+}
+
+// Handle adds a handler to the server.
+func (srv *Server) Handle(pattern string, handler http.Handler) {
+	srv.mux.Handle(pattern, handler)
+}
+
+// Start listens on addr (e.g. ":8080"), and serves requests in the
+// background.
+func (srv *Server) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv.listener = listener
+	srv.server = &http.Server{Handler: srv.mux, ReadTimeout: 10 * time.Second}
+	logger.Info("Listening", "addr", listener.Addr())
+	go func() {
+		if err := srv.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Server stopped", "err", err)
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the server is listening on.
+func (srv *Server) Addr() net.Addr {
+	return srv.listener.Addr()
+}
+
+// Close stops the server.
+func (srv *Server) Close() error {
+	if srv.server == nil {
+		return nil
+	}
+	return srv.server.Close()
+}
+
+// An apiHandler handles a request, returning the value to send back as
+// JSON, or an error to send back with a 400 status.
+type apiHandler func(r *http.Request) (interface{}, error)
+
+func (srv *Server) get(h apiHandler) http.HandlerFunc {
+	return srv.handle(http.MethodGet, h)
+}
+
+func (srv *Server) post(h apiHandler) http.HandlerFunc {
+	return srv.handle(http.MethodPost, h)
+}
+
+func (srv *Server) handle(method string, h apiHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeJSON(w, http.StatusMethodNotAllowed, errorResponse{"method not allowed"})
+			return
+		}
+		result, err := h(r)
+		if err != nil {
+			logger.Debug("Bad request", "path", r.URL.Path, "err", err)
+			writeJSON(w, http.StatusBadRequest, errorResponse{err.Error()})
+			return
+		}
+		if method == http.MethodPost {
+			logger.Info("Remote control", "path", r.URL.Path, "query", r.URL.RawQuery, "remote", r.RemoteAddr)
+		}
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+func (srv *Server) status(r *http.Request) (interface{}, error) {
+	return srv.session.Status(), nil
+}
+
+func (srv *Server) queue(r *http.Request) (interface{}, error) {
+	offset, err := intParam(r, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	count, err := intParam(r, "count", 100)
+	if err != nil {
+		return nil, err
+	}
+	return srv.session.Queue(offset, count), nil
+}
+
+// control runs a remote control command, taking its argument from the
+// command's parameter.
+func (srv *Server) control(command string) apiHandler {
+	return func(r *http.Request) (interface{}, error) {
+		var arg string
+		if param, ok := controlParams[command]; ok {
+			arg = r.FormValue(param)
+			if arg == "" {
+				return nil, fmt.Errorf("'%s' is required", param)
+			}
+		}
+		if err := srv.session.Control(command, arg); err != nil {
+			return nil, err
+		}
+		return srv.session.Status(), nil
+	}
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return def, fmt.Errorf("'%s' must be a number, got '%s'", name, value)
+	}
+	return n, nil
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"bmwctrl/device/mock"
+	"bmwctrl/session"
+)
+
+func request(t *testing.T, srv *Server, method, url string) (int, map[string]interface{}) {
+	w := httptest.NewRecorder()
+	srv.mux.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s %s: bad JSON: %s", method, url, w.Body)
+	}
+	return w.Code, body
+}
+
+func TestServer(t *testing.T) {
+	player := mock.NewPlayer(nil)
+	defer player.Close()
+	srv := NewServer(session.New(player))
+
+	code, status := request(t, srv, "GET", "/api/status")
+	if code != http.StatusOK || status["state"] != "stopped" || status["shuffle"] != "off" {
+		t.Errorf("status = %d %v", code, status)
+	}
+
+	code, status = request(t, srv, "POST", "/api/shuffle?mode=albums")
+	if code != http.StatusOK || status["shuffle"] != "albums" {
+		t.Errorf("shuffle = %d %v", code, status)
+	}
+
+	code, _ = request(t, srv, "POST", "/api/seek?position=soon")
+	if code != http.StatusBadRequest {
+		t.Errorf("seek with a bad position = %d", code)
+	}
+
+	code, _ = request(t, srv, "GET", "/api/next")
+	if code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /api/next = %d", code)
+	}
+}
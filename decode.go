@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"bmwctrl/protocol"
+
+	"github.com/urfave/cli"
+)
+
+var decodeCommand = cli.Command{
+	Name:      "decode",
+	Usage:     "Decode frames from logs, .script files or hex dumps",
+	ArgsUsage: "[FILE...]",
+	Description: "Prints each packet with its lingo, command and fields, whether its checksum is\n" +
+		"   valid, and for responses, the request they answer and how long that took.\n" +
+		"   Reads from stdin if no files are given.",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "hex, x",
+			Usage: "Include the raw frame bytes",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		var packets []protocol.Packet
+		if len(c.Args()) == 0 {
+			p, err := protocol.ReadCapture(os.Stdin)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			packets = p
+		}
+		for _, name := range c.Args() {
+			f, err := os.Open(name)
+			if err != nil {
+				return cli.NewExitError(err, 1)
+			}
+			p, err := protocol.ReadCapture(f)
+			f.Close()
+			if err != nil {
+				return cli.NewExitError(fmt.Sprintf("%s: %s", name, err), 1)
+			}
+			for i := range p {
+				p[i].Index += len(packets)
+			}
+			packets = append(packets, p...)
+		}
+		printPackets(os.Stdout, packets, c.Bool("hex"))
+		return nil
+	},
+}
+
+// printPackets prints one line per packet, followed by any problems found
+// with it, and a summary at the end.
+func printPackets(w io.Writer, packets []protocol.Packet, withHex bool) {
+	pairer := protocol.NewPairer()
+	var start time.Time
+	var badChecksums, undecodable int
+	var maxLatency time.Duration
+	var slowest *protocol.Packet
+	for i := range packets {
+		p := &packets[i]
+		pairer.Add(p)
+		if start.IsZero() {
+			start = p.Time
+		}
+
+		when := ""
+		if !p.Time.IsZero() {
+			when = fmt.Sprintf("+%.3fs", p.Time.Sub(start).Seconds())
+		}
+		name := p.Name
+		if name == "" {
+			name = fmt.Sprintf("unknown(%04x)", p.CmdID)
+		}
+		line := fmt.Sprintf("%5d %9s %s %-9s %-34s %s", p.Index, when, p.Dir, p.LingoName(), name, p.Fields)
+		if p.Request != nil {
+			line += fmt.Sprintf("  [reply to #%d", p.Request.Index)
+			if p.Latency > 0 {
+				line += fmt.Sprintf(" in %s", p.Latency)
+			}
+			line += "]"
+			if p.Latency > maxLatency {
+				maxLatency = p.Latency
+				slowest = p
+			}
+		}
+		fmt.Fprintln(w, strings.TrimRight(line, " "))
+
+		if withHex {
+			fmt.Fprintf(w, "%16s %s\n", "", hex.EncodeToString(p.Frame))
+		}
+		if !p.ChecksumOK {
+			badChecksums++
+			fmt.Fprintf(w, "%16s BAD CHECKSUM\n", "")
+		}
+		if p.Err != nil {
+			undecodable++
+			fmt.Fprintf(w, "%16s undecodable: %s\n", "", p.Err)
+		}
+		if p.Note != "" {
+			fmt.Fprintf(w, "%16s %s\n", "", p.Note)
+		}
+	}
+
+	unanswered := 0
+	for i := range packets {
+		p := &packets[i]
+		if p.Dir == protocol.DirFromCar && p.Name != "" && !pairer.Answered(p) {
+			unanswered++
+		}
+	}
+	fmt.Fprintf(w, "\n%d packets, %d bad checksums, %d undecodable, %d requests without a reply.\n",
+		len(packets), badChecksums, undecodable, unanswered)
+	if slowest != nil {
+		fmt.Fprintf(w, "Slowest reply: #%d %s, %s after #%d %s.\n",
+			slowest.Index, slowest.Name, maxLatency, slowest.Request.Index, slowest.Request.Name)
+	}
+}
@@ -0,0 +1,10 @@
+// Package all registers all the player backends.  A new backend is added
+// here, and is then available by name to --player.
+package all
+
+import (
+	_ "bmwctrl/device/local"
+	_ "bmwctrl/device/mock"
+	_ "bmwctrl/device/mpd"
+	_ "bmwctrl/device/spotify"
+)
@@ -0,0 +1,36 @@
+package device
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+// CategoryNames are the names of the database categories, as used in
+// options and by the HTTP API.
+var CategoryNames = map[extremote.DBCategoryType]string{
+	extremote.DbCategoryPlaylist:  "playlist",
+	extremote.DbCategoryArtist:    "artist",
+	extremote.DbCategoryAlbum:     "album",
+	extremote.DbCategoryGenre:     "genre",
+	extremote.DbCategoryTrack:     "track",
+	extremote.DbCategoryComposer:  "composer",
+	extremote.DbCategoryAudiobook: "audiobook",
+	extremote.DbCategoryPodcast:   "podcast",
+}
+
+// ParseCategory reads a database category by name, e.g. for a player
+// option that puts a list on one of the car's CDs.
+func ParseCategory(name string) (extremote.DBCategoryType, error) {
+	var names []string
+	for category, n := range CategoryNames {
+		if n == name {
+			return category, nil
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return 0, fmt.Errorf("unknown category '%s' (%s)", name, strings.Join(names, ", "))
+}
@@ -0,0 +1,64 @@
+// Package index keeps players' library indexes on disk, so the library
+// doesn't have to be read from scratch at every start, and keeps the
+// records of each category in a stable order across restarts.
+package index
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+
+	"bmwctrl/statefile"
+)
+
+// Stable orders the current records of a category for listing.  Records
+// that were listed before keep their order, and new ones go after them in
+// the order given, so the head unit's record indices (and the saved
+// selection) still point to the same records after music is added.
+// Records that have gone are dropped.
+func Stable(previous []string, current []string) []string {
+	present := make(map[string]bool, len(current))
+	for _, name := range current {
+		present[name] = true
+	}
+	ordered := make([]string, 0, len(current))
+	listed := make(map[string]bool, len(current))
+	for _, name := range previous {
+		if present[name] && !listed[name] {
+			ordered = append(ordered, name)
+			listed[name] = true
+		}
+	}
+	for _, name := range current {
+		if !listed[name] {
+			ordered = append(ordered, name)
+			listed[name] = true
+		}
+	}
+	return ordered
+}
+
+// Load reads an index saved by Save into v.  It reports false, with no
+// error, if there's no index yet.
+func Load(path string, v interface{}) (bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Save replaces the index at path with v, atomically.
+func Save(path string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	return statefile.WriteFile(path, buf.Bytes(), 0644)
+}
@@ -0,0 +1,38 @@
+package index
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStable(t *testing.T) {
+	got := Stable([]string{"Beta", "Delta", "Alpha"}, []string{"Alpha", "Beta", "Charlie"})
+	want := []string{"Beta", "Alpha", "Charlie"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "library.index")
+
+	var got map[string][]string
+	if ok, err := Load(path, &got); ok || err != nil {
+		t.Fatalf("loaded a missing index: %v, %v", ok, err)
+	}
+	saved := map[string][]string{"artists": {"Beta", "Alpha"}}
+	if err := Save(path, saved); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := Load(path, &got); !ok || err != nil || !reflect.DeepEqual(got, saved) {
+		t.Errorf("loaded %v, %v, %v", got, ok, err)
+	}
+}
@@ -0,0 +1,180 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/statefile"
+)
+
+// audiobookGenres are the genres (in lower case) that make a file part of
+// an audiobook.
+var audiobookGenres = map[string]bool{
+	"audiobook": true, "audiobooks": true, "audio book": true, "hörbuch": true,
+}
+
+// audiobooks finds the audiobooks in the music directory: M4B files, files
+// with an audiobook genre, and the files under dir, if it's set.
+type audiobooks struct {
+	dir string
+}
+
+func (a *audiobooks) contains(path string, tags Tags) bool {
+	if strings.ToLower(filepath.Ext(path)) == ".m4b" || audiobookGenres[strings.ToLower(tags.Genre)] {
+		return true
+	}
+	if a.dir == "" {
+		return false
+	}
+	rel, err := filepath.Rel(a.dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// bookName names the book a file is part of: its album, or for a book in
+// one file, its title, or else the directory it's in.
+func bookName(path string, tags Tags) string {
+	switch {
+	case tags.Album != "":
+		return tags.Album
+	case len(tags.Chapters) > 0 && tags.Title != "":
+		return tags.Title
+	case len(tags.Chapters) > 0:
+		return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	default:
+		return filepath.Base(filepath.Dir(path))
+	}
+}
+
+// buildBooks groups the audiobook files into books, sorted by name, with
+// each book's files in disc, track and path order.  A file with chapters
+// becomes a track for each chapter.
+func buildBooks(files []*track) []group {
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i], files[j]
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.path < b.path
+	})
+	books := groupBy(files, func(t *track) string { return t.book })
+	for i, book := range books {
+		var chapters []*track
+		for _, t := range book.tracks {
+			chapters = append(chapters, t.chapters()...)
+		}
+		books[i].tracks = chapters
+	}
+	return books
+}
+
+// chapters splits a file with chapters into a track for each chapter.
+func (t *track) chapters() []*track {
+	if len(t.Chapters) == 0 {
+		return []*track{t}
+	}
+	tracks := make([]*track, len(t.Chapters))
+	for i, ch := range t.Chapters {
+		c := *t
+		c.Chapters = nil
+		c.chapter = i + 1
+		c.start = ch.Start
+		c.Track = i + 1
+		c.Title = ch.Title
+		if c.Title == "" {
+			c.Title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		end := t.Length
+		if i+1 < len(t.Chapters) {
+			end = t.Chapters[i+1].Start
+		}
+		c.Length = 0
+		if end > ch.Start {
+			c.Length = end - ch.Start
+		}
+		tracks[i] = &c
+	}
+	return tracks
+}
+
+// How often the place in an audiobook is saved while it's playing.  It's
+// saved straight away when it stops.
+const bookmarkInterval = time.Minute
+
+// bookmark is where an audiobook was left.
+type bookmark struct {
+	Track    string `json:"track"`    // The chapter's ID.
+	Position int    `json:"position"` // In milliseconds.
+}
+
+// bookmarks are where each audiobook was left, by book, kept in a JSON
+// file if there is one.
+type bookmarks struct {
+	path  string
+	mutex sync.Mutex
+	marks map[string]bookmark
+	dirty bool // Changed since it was saved.
+	saved time.Time
+}
+
+// loadBookmarks reads the bookmarks file, if it exists.  Without a path,
+// bookmarks are only kept until bmwctrl stops.
+func loadBookmarks(path string) (*bookmarks, error) {
+	b := &bookmarks{path: path, marks: map[string]bookmark{}}
+	if path == "" {
+		return b, nil
+	}
+	if err := statefile.ReadJSON(path, &b.marks); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *bookmarks) get(book string) (bookmark, bool) {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+	mark, ok := b.marks[book]
+	return mark, ok
+}
+
+func (b *bookmarks) set(book string, mark bookmark) {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+	if b.marks[book] != mark {
+		b.marks[book] = mark
+		b.dirty = true
+	}
+}
+
+// remove forgets a book's place, when it's been played to the end.
+func (b *bookmarks) remove(book string) {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+	if _, ok := b.marks[book]; ok {
+		delete(b.marks, book)
+		b.dirty = true
+	}
+}
+
+// save writes the bookmarks if they've changed, and weren't saved within
+// the last interval.
+func (b *bookmarks) save(interval time.Duration) {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+	if b.path == "" || !b.dirty || time.Since(b.saved) < interval {
+		return
+	}
+	if err := statefile.WriteJSON(b.path, b.marks); err != nil {
+		logger.Warn("Can't save the audiobook bookmarks", "path", b.path, "err", err)
+		return
+	}
+	b.dirty = false
+	b.saved = time.Now()
+}
@@ -0,0 +1,256 @@
+package local
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// Chapter is a chapter within a file, e.g. of an M4B audiobook.
+type Chapter struct {
+	Title string
+	Start time.Duration
+}
+
+// More chapters than this means the file is broken.
+const maxChapters = 2000
+
+// M4A files have chapters in one of two ways: a QuickTime chapter track, a
+// text track referred to by the audio track's tref/chap, which iTunes and
+// most tools write; or Nero's moov/udta/chpl, which some tools write as
+// well or instead.  The chapter track is preferred, as it's the one players
+// show.
+
+// readChpl reads Nero chapters: a version and flags, four more bytes in
+// version 1, the number of chapters, and then each one's start (in 100ns
+// units) and title (with a one byte length.)
+func readChpl(body []byte) []Chapter {
+	if len(body) < 5 {
+		return nil
+	}
+	data := body[4:]
+	if body[0] == 1 {
+		if len(data) < 4 {
+			return nil
+		}
+		data = data[4:]
+	}
+	if len(data) < 1 {
+		return nil
+	}
+	count := int(data[0])
+	data = data[1:]
+	var chapters []Chapter
+	for i := 0; i < count && len(data) >= 9; i++ {
+		start := binary.BigEndian.Uint64(data)
+		size := int(data[8])
+		if len(data) < 9+size {
+			break
+		}
+		chapters = append(chapters, Chapter{string(data[9 : 9+size]), time.Duration(start) * 100})
+		data = data[9+size:]
+	}
+	return chapters
+}
+
+// mp4Track is what's needed of a trak to read its samples.
+type mp4Track struct {
+	id        uint32
+	chapters  []uint32 // The tracks in tref/chap.
+	timescale uint32
+	deltas    []uint32 // Each sample's duration, from stts.
+	sizes     []uint32 // Each sample's size, from stsz.
+	chunks    []int64  // Each chunk's offset in the file, from stco or co64.
+	stsc      []stscEntry
+}
+
+type stscEntry struct {
+	firstChunk      uint32 // Counting from 1.
+	samplesPerChunk uint32
+}
+
+// readChapterTrack reads the chapters from the chapter track an audio track
+// refers to, if there is one.  Each sample of the chapter track is a
+// chapter: its title, with a two byte length, starting when the sample
+// does.
+func readChapterTrack(f *os.File, moov []byte) []Chapter {
+	tracks := map[uint32]*mp4Track{}
+	var chapterID uint32
+	atoms(moov, func(kind string, body []byte) {
+		if kind != "trak" {
+			return
+		}
+		t := readTrak(body)
+		tracks[t.id] = t
+		if len(t.chapters) > 0 {
+			chapterID = t.chapters[0]
+		}
+	})
+	t := tracks[chapterID]
+	if chapterID == 0 || t == nil || t.timescale == 0 {
+		return nil
+	}
+	offsets := t.sampleOffsets()
+	var chapters []Chapter
+	var start uint64
+	for i, offset := range offsets {
+		if i >= len(t.sizes) || i >= len(t.deltas) {
+			break
+		}
+		title := ""
+		if size := t.sizes[i]; size >= 2 && size < 1024 {
+			sample := make([]byte, size)
+			if _, err := f.ReadAt(sample, offset); err != nil && err != io.EOF {
+				return nil
+			}
+			if n := int(binary.BigEndian.Uint16(sample)); n <= len(sample)-2 {
+				title = string(sample[2 : 2+n])
+			}
+		}
+		chapters = append(chapters, Chapter{title, time.Duration(start) * time.Second / time.Duration(t.timescale)})
+		start += uint64(t.deltas[i])
+	}
+	return chapters
+}
+
+func readTrak(trak []byte) *mp4Track {
+	t := &mp4Track{}
+	atoms(trak, func(kind string, body []byte) {
+		switch kind {
+		case "tkhd":
+			switch {
+			case len(body) >= 16 && body[0] == 0:
+				t.id = binary.BigEndian.Uint32(body[12:])
+			case len(body) >= 24 && body[0] == 1:
+				t.id = binary.BigEndian.Uint32(body[20:])
+			}
+		case "tref":
+			atoms(body, func(kind string, body []byte) {
+				for kind == "chap" && len(body) >= 4 {
+					t.chapters = append(t.chapters, binary.BigEndian.Uint32(body))
+					body = body[4:]
+				}
+			})
+		case "mdia":
+			atoms(body, func(kind string, body []byte) {
+				switch kind {
+				case "mdhd":
+					switch {
+					case len(body) >= 16 && body[0] == 0:
+						t.timescale = binary.BigEndian.Uint32(body[12:])
+					case len(body) >= 24 && body[0] == 1:
+						t.timescale = binary.BigEndian.Uint32(body[20:])
+					}
+				case "minf":
+					atoms(body, func(kind string, body []byte) {
+						if kind == "stbl" {
+							atoms(body, t.readSampleTable)
+						}
+					})
+				}
+			})
+		}
+	})
+	return t
+}
+
+// readSampleTable reads one of the stbl atoms.  Each starts with a version
+// and flags.
+func (t *mp4Track) readSampleTable(kind string, body []byte) {
+	if len(body) < 8 {
+		return
+	}
+	count := int(binary.BigEndian.Uint32(body[4:]))
+	if count > maxChapters {
+		count = maxChapters
+	}
+	table := body[8:]
+	switch kind {
+	case "stts":
+		for i := 0; i < count && len(table) >= 8; i++ {
+			n := binary.BigEndian.Uint32(table)
+			delta := binary.BigEndian.Uint32(table[4:])
+			for ; n > 0 && len(t.deltas) < maxChapters; n-- {
+				t.deltas = append(t.deltas, delta)
+			}
+			table = table[8:]
+		}
+	case "stsc":
+		for i := 0; i < count && len(table) >= 12; i++ {
+			t.stsc = append(t.stsc, stscEntry{binary.BigEndian.Uint32(table), binary.BigEndian.Uint32(table[4:])})
+			table = table[12:]
+		}
+	case "stsz":
+		// The sample size, if they're all the same, then the count.
+		if len(body) < 12 {
+			return
+		}
+		size := binary.BigEndian.Uint32(body[4:])
+		count = int(binary.BigEndian.Uint32(body[8:]))
+		if count > maxChapters {
+			count = maxChapters
+		}
+		table = body[12:]
+		for i := 0; i < count; i++ {
+			if size == 0 {
+				if len(table) < 4 {
+					return
+				}
+				t.sizes = append(t.sizes, binary.BigEndian.Uint32(table))
+				table = table[4:]
+			} else {
+				t.sizes = append(t.sizes, size)
+			}
+		}
+	case "stco":
+		for i := 0; i < count && len(table) >= 4; i++ {
+			t.chunks = append(t.chunks, int64(binary.BigEndian.Uint32(table)))
+			table = table[4:]
+		}
+	case "co64":
+		for i := 0; i < count && len(table) >= 8; i++ {
+			t.chunks = append(t.chunks, int64(binary.BigEndian.Uint64(table)))
+			table = table[8:]
+		}
+	}
+}
+
+// sampleOffsets works out where each sample is in the file: the samples
+// are stored in chunks, the number in each chunk given by stsc.
+func (t *mp4Track) sampleOffsets() []int64 {
+	var offsets []int64
+	sample := 0
+	for chunk, offset := range t.chunks {
+		perChunk := uint32(0)
+		for _, entry := range t.stsc {
+			if entry.firstChunk > uint32(chunk+1) {
+				break
+			}
+			perChunk = entry.samplesPerChunk
+		}
+		for i := uint32(0); i < perChunk && sample < len(t.sizes); i++ {
+			offsets = append(offsets, offset)
+			offset += int64(t.sizes[sample])
+			sample++
+		}
+	}
+	return offsets
+}
+
+// cleanChapters drops chapters that start past the end of the file, and
+// sorts the rest.  Files with only one chapter have none.
+func cleanChapters(chapters []Chapter, length time.Duration) []Chapter {
+	var clean []Chapter
+	for _, ch := range chapters {
+		if length == 0 || ch.Start < length {
+			clean = append(clean, ch)
+		}
+	}
+	sort.SliceStable(clean, func(i, j int) bool { return clean[i].Start < clean[j].Start })
+	if len(clean) < 2 {
+		return nil
+	}
+	return clean
+}
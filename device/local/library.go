@@ -0,0 +1,368 @@
+package local
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"bmwctrl/device"
+	"bmwctrl/device/index"
+	"bmwctrl/device/playlist"
+	"bmwctrl/device/smart"
+)
+
+// track is a music file in the library, or a chapter of one.
+type track struct {
+	path    string
+	added   time.Time     // When the file was first seen.
+	book    string        // The audiobook the file is part of, if it is.
+	chapter int           // The chapter of the file, counting from 1, or 0 for all of it.
+	start   time.Duration // Where the chapter starts in the file.
+	Tags
+}
+
+// id identifies the track, e.g. in the saved play queue: by path, and by
+// chapter if it's one of a file's chapters.
+func (t *track) id() string {
+	if t.chapter == 0 {
+		return t.path
+	}
+	return fmt.Sprintf("%s#%d", t.path, t.chapter)
+}
+
+// group is a named list of tracks, e.g. an album.
+type group struct {
+	name   string
+	tracks []*track
+}
+
+// library is the database built from the music directory: all the tracks,
+// sorted by artist, album and track number, and grouped into the iPod's
+// categories.
+type library struct {
+	tracks    []*track
+	playlists []group // "All Songs", then the playlist files.
+	artists   []group
+	albums    []group
+	genres    []group
+	titles    []group // One track each, sorted by title.
+	books     []group // Audiobooks, which aren't in the other categories.
+}
+
+// musicExtensions are the file types ReadTags understands.
+var musicExtensions = map[string]bool{
+	".mp3": true, ".flac": true, ".m4a": true, ".m4b": true, ".mp4": true, ".aac": true,
+}
+
+// libraryIndex is what's kept on disk between starts: the tags of each file,
+// so only new and changed files are read again, and the order each
+// category was listed in.
+type libraryIndex struct {
+	Version int
+	Dir     string
+	Files   map[string]indexedFile
+	Order   map[string][]string // By category; tracks are listed by path.
+}
+
+// indexVersion changes when Tags does, so that files are read again for the
+// new tags.
+const indexVersion = 2
+
+type indexedFile struct {
+	ModTime int64
+	Size    int64
+	Added   int64 // The modification time when the file was first seen.
+	Tags    Tags
+}
+
+// scanLibrary reads the tags of every music file under dir, and builds the
+// categories.  Files whose tags can't be read are logged, and listed by
+// their file names.  Playlist files under dir, and under playlistDir if
+// it's set, become playlists.  If indexPath is set, tags are kept there,
+// and only files that are new or have changed since the last scan are
+// read, unless parts of dir can't be read.  If books is set, the audiobooks it finds are listed as books
+// rather than with the music.
+func scanLibrary(dir string, playlistDir string, indexPath string, books *audiobooks) (*library, error) {
+	idx := libraryIndex{}
+	if indexPath != "" {
+		if _, err := index.Load(indexPath, &idx); err != nil {
+			logger.Warn("Can't read the library index, reading all files", "path", indexPath, "err", err)
+		}
+		if idx.Dir != dir {
+			idx = libraryIndex{}
+		} else if idx.Version != indexVersion {
+			// Keep the order, and when files were added.
+			for path, file := range idx.Files {
+				idx.Files[path] = indexedFile{Added: file.Added}
+			}
+		}
+	}
+	files := make(map[string]indexedFile)
+	var tracks, bookFiles []*track
+	var playlists []playlist.Playlist
+	read, unreadable := 0, 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil && path == dir {
+			return fmt.Errorf("can't read the music directory: %v", err)
+		}
+		if err != nil {
+			logger.Warn("Can't read from the music directory", "path", path, "err", err)
+			unreadable++
+			return nil
+		}
+		if path == dir && !info.IsDir() {
+			return fmt.Errorf("the music directory %s isn't a directory", dir)
+		}
+		if info.IsDir() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if playlist.Extensions[ext] {
+			list, err := playlist.Load(path)
+			if err != nil {
+				logger.Warn("Can't read playlist", "err", err)
+			}
+			playlists = append(playlists, list)
+			return nil
+		}
+		if !musicExtensions[ext] {
+			return nil
+		}
+		file, ok := idx.Files[path]
+		if !ok || file.ModTime != info.ModTime().UnixNano() || file.Size != info.Size() {
+			tags, err := ReadTags(path)
+			if err != nil {
+				logger.Warn("Can't read tags", "err", err)
+			}
+			added := file.Added
+			if added == 0 {
+				added = info.ModTime().UnixNano()
+			}
+			file = indexedFile{info.ModTime().UnixNano(), info.Size(), added, tags}
+			read++
+		}
+		files[path] = file
+		t := newTrack(path, file.Tags)
+		t.added = time.Unix(0, file.Added)
+		if books != nil && books.contains(path, file.Tags) {
+			t.book = bookName(path, file.Tags)
+			bookFiles = append(bookFiles, t)
+			return nil
+		}
+		tracks = append(tracks, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if playlistDir != "" {
+		lists, err := playlist.LoadDir(playlistDir)
+		if err != nil {
+			logger.Warn("Can't read the playlist directory", "dir", playlistDir, "err", err)
+		}
+		playlists = append(playlists, lists...)
+	}
+	lib := buildLibrary(tracks, playlists)
+	lib.books = buildBooks(bookFiles)
+	if indexPath == "" {
+		return lib, nil
+	}
+	lib.keepOrder(idx.Order)
+	if unreadable > 0 {
+		// Saving would forget the files that couldn't be read, and the
+		// order of the records they're in.
+		logger.Warn("Not updating the library index, as parts of the music directory couldn't be read", "path", indexPath)
+		return lib, nil
+	}
+	logger.Info("Library index updated", "read", read, "unchanged", len(files)-read)
+	idx = libraryIndex{Version: indexVersion, Dir: dir, Files: files, Order: lib.order()}
+	if err := index.Save(indexPath, idx); err != nil {
+		logger.Warn("Can't save the library index", "path", indexPath, "err", err)
+	}
+	return lib, nil
+}
+
+// newTrack fills in the tags a file doesn't have.
+func newTrack(path string, tags Tags) *track {
+	if tags.Title == "" {
+		tags.Title = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	if tags.Artist == "" {
+		tags.Artist = "Unknown Artist"
+	}
+	if tags.AlbumArtist == "" {
+		tags.AlbumArtist = tags.Artist
+	}
+	if tags.Album == "" {
+		tags.Album = "Unknown Album"
+	}
+	if tags.Genre == "" {
+		tags.Genre = "Unknown Genre"
+	}
+	return &track{path: path, Tags: tags}
+}
+
+func buildLibrary(tracks []*track, playlists []playlist.Playlist) *library {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		a, b := tracks[i], tracks[j]
+		if c := compareNames(a.AlbumArtist, b.AlbumArtist); c != 0 {
+			return c < 0
+		}
+		if c := compareNames(a.Album, b.Album); c != 0 {
+			return c < 0
+		}
+		if a.Disc != b.Disc {
+			return a.Disc < b.Disc
+		}
+		if a.Track != b.Track {
+			return a.Track < b.Track
+		}
+		return a.path < b.path
+	})
+	l := &library{
+		tracks:    tracks,
+		playlists: []group{{"All Songs", tracks}},
+		artists:   groupBy(tracks, func(t *track) string { return t.AlbumArtist }),
+		albums:    groupBy(tracks, func(t *track) string { return t.Album }),
+		genres:    groupBy(tracks, func(t *track) string { return t.Genre }),
+	}
+	l.titles = make([]group, len(tracks))
+	for i, t := range tracks {
+		l.titles[i] = group{t.Title, []*track{t}}
+	}
+	sort.SliceStable(l.titles, func(i, j int) bool {
+		return compareNames(l.titles[i].name, l.titles[j].name) < 0
+	})
+	byPath := make(map[string]*track, len(tracks))
+	for _, t := range tracks {
+		byPath[filepath.Clean(t.path)] = t
+	}
+	sort.SliceStable(playlists, func(i, j int) bool {
+		return compareNames(playlists[i].Name, playlists[j].Name) < 0
+	})
+	for _, list := range playlists {
+		g := group{name: list.Name}
+		for _, entry := range list.Entries {
+			if t, ok := byPath[entry.Path]; ok {
+				g.tracks = append(g.tracks, t)
+			}
+		}
+		if len(g.tracks) > 0 {
+			l.playlists = append(l.playlists, g)
+		}
+	}
+	return l
+}
+
+// keepOrder lists the records of each category in the order they were
+// listed before (see index.Stable), with new ones at the end.  "All Songs"
+// stays first.
+func (l *library) keepOrder(order map[string][]string) {
+	if order == nil {
+		return
+	}
+	l.playlists = append(l.playlists[:1], stableGroups(l.playlists[1:], order["playlists"], groupName)...)
+	l.artists = stableGroups(l.artists, order["artists"], groupName)
+	l.albums = stableGroups(l.albums, order["albums"], groupName)
+	l.genres = stableGroups(l.genres, order["genres"], groupName)
+	l.titles = stableGroups(l.titles, order["tracks"], groupPath)
+	l.books = stableGroups(l.books, order["books"], groupName)
+}
+
+// order returns the order the records of each category are listed in.
+func (l *library) order() map[string][]string {
+	keys := func(groups []group, key func(g group) string) []string {
+		list := make([]string, len(groups))
+		for i, g := range groups {
+			list[i] = key(g)
+		}
+		return list
+	}
+	return map[string][]string{
+		"playlists": keys(l.playlists[1:], groupName),
+		"artists":   keys(l.artists, groupName),
+		"albums":    keys(l.albums, groupName),
+		"genres":    keys(l.genres, groupName),
+		"tracks":    keys(l.titles, groupPath),
+		"books":     keys(l.books, groupName),
+	}
+}
+
+// smartTracks returns the tracks a smart playlist holds now.  history, if
+// it's set, gives each track's plays.
+func (l *library) smartTracks(list smart.Playlist, history func(id string) device.TrackHistory) []*track {
+	tracks := make([]smart.Track, len(l.tracks))
+	for i, t := range l.tracks {
+		tracks[i] = smart.Track{
+			Path:        t.path,
+			Title:       t.Title,
+			Artist:      t.Artist,
+			AlbumArtist: t.AlbumArtist,
+			Album:       t.Album,
+			Genre:       t.Genre,
+			Year:        t.Year,
+			Track:       t.Track,
+			Disc:        t.Disc,
+			Length:      t.Length,
+			Added:       t.added,
+		}
+		if history != nil {
+			h := history(t.path)
+			tracks[i].Plays, tracks[i].LastPlayed = h.Plays, h.LastPlayed
+		}
+	}
+	selected := []*track{}
+	for _, i := range list.Select(tracks, time.Now()) {
+		selected = append(selected, l.tracks[i])
+	}
+	return selected
+}
+
+func groupName(g group) string { return g.name }
+
+// groupPath identifies a group of one track (in the track category) by the
+// track's path, as titles aren't unique.
+func groupPath(g group) string { return g.tracks[0].path }
+
+func stableGroups(groups []group, previous []string, key func(g group) string) []group {
+	byKey := make(map[string]group, len(groups))
+	current := make([]string, len(groups))
+	for i, g := range groups {
+		current[i] = key(g)
+		byKey[current[i]] = g
+	}
+	ordered := make([]group, 0, len(groups))
+	for _, k := range index.Stable(previous, current) {
+		ordered = append(ordered, byKey[k])
+	}
+	return ordered
+}
+
+// groupBy groups the tracks by a tag, keeping their order within each
+// group, with the groups sorted by name.
+func groupBy(tracks []*track, tag func(t *track) string) []group {
+	positions := map[string]int{}
+	var groups []group
+	for _, t := range tracks {
+		name := tag(t)
+		key := strings.ToLower(name)
+		i, ok := positions[key]
+		if !ok {
+			i = len(groups)
+			positions[key] = i
+			groups = append(groups, group{name: name})
+		}
+		groups[i].tracks = append(groups[i].tracks, t)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return compareNames(groups[i].name, groups[j].name) < 0
+	})
+	return groups
+}
+
+func compareNames(a, b string) int {
+	return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+}
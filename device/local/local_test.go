@@ -0,0 +1,445 @@
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"bmwctrl/device/smart"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// mp3File builds an ID3v2.3 tag followed by a CBR 128kbps 44.1kHz MPEG 1
+// layer 3 frame header, padded to size bytes of audio.
+func mp3File(frames map[string]string, audioBytes int) []byte {
+	var body bytes.Buffer
+	for id, value := range frames {
+		body.WriteString(id)
+		binary.Write(&body, binary.BigEndian, uint32(len(value)+1))
+		body.Write([]byte{0, 0, 3})
+		body.WriteString(value)
+	}
+	size := body.Len()
+	var f bytes.Buffer
+	f.WriteString("ID3\x03\x00\x00")
+	f.Write([]byte{byte(size >> 21 & 0x7f), byte(size >> 14 & 0x7f), byte(size >> 7 & 0x7f), byte(size & 0x7f)})
+	f.Write(body.Bytes())
+	audio := make([]byte, audioBytes)
+	copy(audio, []byte{0xff, 0xfb, 0x90, 0x00})
+	f.Write(audio)
+	return f.Bytes()
+}
+
+func flacFile(comments []string, sampleRate int, samples uint64) []byte {
+	var f bytes.Buffer
+	f.WriteString("fLaC")
+	info := make([]byte, 34)
+	info[10] = byte(sampleRate >> 12)
+	info[11] = byte(sampleRate >> 4)
+	info[12] = byte(sampleRate<<4) | 0x02
+	info[13] = byte(samples >> 32 & 0x0f)
+	binary.BigEndian.PutUint32(info[14:], uint32(samples))
+	f.Write([]byte{0, 0, 0, 34})
+	f.Write(info)
+	var vc bytes.Buffer
+	binary.Write(&vc, binary.LittleEndian, uint32(4))
+	vc.WriteString("test")
+	binary.Write(&vc, binary.LittleEndian, uint32(len(comments)))
+	for _, c := range comments {
+		binary.Write(&vc, binary.LittleEndian, uint32(len(c)))
+		vc.WriteString(c)
+	}
+	f.Write([]byte{0x84, 0, byte(vc.Len() >> 8), byte(vc.Len())})
+	f.Write(vc.Bytes())
+	return f.Bytes()
+}
+
+func atom(kind string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], kind)
+	return append(b, body...)
+}
+
+func m4aItem(kind string, value []byte) []byte {
+	return atom(kind, atom("data", make([]byte, 8), value))
+}
+
+func m4aFile() []byte {
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)   // Timescale
+	binary.BigEndian.PutUint32(mvhd[16:], 185500) // Duration
+	ilst := atom("ilst",
+		m4aItem("\xa9nam", []byte("Tune")),
+		m4aItem("\xa9ART", []byte("Band")),
+		m4aItem("\xa9alb", []byte("Record")),
+		m4aItem("gnre", []byte{0, 18}),
+		m4aItem("trkn", []byte{0, 0, 0, 7, 0, 10, 0, 0}))
+	moov := atom("moov", atom("mvhd", mvhd), atom("udta", atom("meta", make([]byte, 4), ilst)))
+	return bytes.Join([][]byte{atom("ftyp", []byte("M4A ")), atom("mdat", make([]byte, 1000)), moov}, nil)
+}
+
+func TestReadTags(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "a.mp3"), mp3File(map[string]string{
+		"TIT2": "Song", "TPE1": "Singer", "TALB": "LP", "TCON": "(17)", "TRCK": "3/12", "TYER": "1971",
+	}, 160000))
+	writeFile(t, filepath.Join(dir, "b.flac"), flacFile([]string{
+		"TITLE=Piece", "ARTIST=Orchestra", "album=Symphonies", "TRACKNUMBER=2", "DISCNUMBER=1/2", "DATE=1808-12-22",
+	}, 44100, 44100*90))
+	writeFile(t, filepath.Join(dir, "c.m4a"), m4aFile())
+
+	for file, want := range map[string]Tags{
+		"a.mp3":  {Title: "Song", Artist: "Singer", Album: "LP", Genre: "Rock", Year: 1971, Track: 3, Length: 10 * time.Second},
+		"b.flac": {Title: "Piece", Artist: "Orchestra", Album: "Symphonies", Year: 1808, Track: 2, Disc: 1, Length: 90 * time.Second},
+		"c.m4a":  {Title: "Tune", Artist: "Band", Album: "Record", Genre: "Rock", Track: 7, Length: 185500 * time.Millisecond},
+	} {
+		got, err := ReadTags(filepath.Join(dir, file))
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, %v; want %+v", file, got, err, want)
+		}
+	}
+
+	// A moov atom bigger than the file is an error, not an allocation.
+	broken := atom("moov")
+	binary.BigEndian.PutUint32(broken, 0xfffffff0)
+	writeFile(t, filepath.Join(dir, "d.m4a"), append(atom("ftyp", []byte("M4A ")), broken...))
+	if _, err := ReadTags(filepath.Join(dir, "d.m4a")); err == nil {
+		t.Error("d.m4a: no error for a bad atom size")
+	}
+
+	// So is an ID3 tag bigger than the file, e.g. one cut short.
+	truncated := mp3File(map[string]string{"TIT2": "Song"}, 1000)[:20]
+	truncated[6], truncated[7], truncated[8], truncated[9] = 0x7f, 0x7f, 0x7f, 0x7f
+	writeFile(t, filepath.Join(dir, "e.mp3"), truncated)
+	if _, err := ReadTags(filepath.Join(dir, "e.mp3")); err == nil {
+		t.Error("e.mp3: no error for a bad ID3 tag size")
+	}
+}
+
+func TestScanLibrary(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	song := func(title, artist, album, track string) []byte {
+		return mp3File(map[string]string{"TIT2": title, "TPE1": artist, "TALB": album, "TRCK": track}, 1000)
+	}
+	writeFile(t, filepath.Join(dir, "b/2.mp3"), song("Two", "Beta", "Second", "2"))
+	writeFile(t, filepath.Join(dir, "b/1.mp3"), song("One", "Beta", "Second", "1"))
+	writeFile(t, filepath.Join(dir, "a/1.mp3"), song("Zed", "alpha", "First", "1"))
+	writeFile(t, filepath.Join(dir, "untagged.flac"), []byte("fLaC\x80\x00\x00\x00"))
+	writeFile(t, filepath.Join(dir, "mix.m3u"), []byte("#EXTM3U\nb/2.mp3\nmissing.mp3\na/1.mp3\n"))
+
+	lib, err := scanLibrary(dir, "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := func(groups []group) (list []string) {
+		for _, g := range groups {
+			list = append(list, g.name)
+		}
+		return list
+	}
+	titles := func(tracks []*track) (list []string) {
+		for _, t := range tracks {
+			list = append(list, t.Title)
+		}
+		return list
+	}
+	check := func(what string, got, want []string) {
+		if len(got) != len(want) {
+			t.Errorf("%s = %q, want %q", what, got, want)
+			return
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s = %q, want %q", what, got, want)
+				return
+			}
+		}
+	}
+	check("playlists", names(lib.playlists), []string{"All Songs", "mix"})
+	check("all songs", titles(lib.tracks), []string{"Zed", "One", "Two", "untagged"})
+	check("mix", titles(lib.playlists[1].tracks), []string{"Two", "Zed"})
+	check("artists", names(lib.artists), []string{"alpha", "Beta", "Unknown Artist"})
+	check("albums", names(lib.albums), []string{"First", "Second", "Unknown Album"})
+	check("titles", names(lib.titles), []string{"One", "Two", "untagged", "Zed"})
+
+	list, err := smart.Parse("Beta", "artist = beta | sort track desc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("smart playlist", titles(lib.smartTracks(list, nil)), []string{"Two", "One"})
+}
+
+func TestPlayer(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"1", "2"} {
+		writeFile(t, filepath.Join(dir, name+".mp3"),
+			mp3File(map[string]string{"TIT2": "Song " + name, "TRCK": name}, 16000))
+	}
+
+	// tail -f plays forever, so the track doesn't end by itself.
+	player, err := NewPlayer(nil, Config{Dir: dir, Decoder: "tail -f {file}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	p := player.(*localPlayer)
+	p.PlayCurrentSelection(1)
+	if _, _, state := p.GetPlayStatus(); state != extremote.PlayerStatePlaying || p.GetIndexedPlayingTrackTitle(p.GetCurrentPlayingTrackIndex()) != "Song 2" {
+		t.Fatalf("state %v, playing %q", state, p.GetIndexedPlayingTrackTitle(p.GetCurrentPlayingTrackIndex()))
+	}
+	p.Seek(500)
+	p.PlayControl(extremote.PlayControlPause)
+	if _, position, state := p.GetPlayStatus(); state != extremote.PlayerStatePaused || position < 500 || position > 1000 {
+		t.Errorf("paused: state %v, position %d", state, position)
+	}
+	saved := p.SaveQueue()
+
+	// true ends straight away, so the player moves on to the next track,
+	// and then stops at the end of the queue.
+	p.decoder = "true {file}"
+	p.SetCurrentPlayingTrack(0)
+	p.mutex.Lock()
+	for p.playback != nil {
+		<-p.playback.done
+		p.advance()
+	}
+	p.mutex.Unlock()
+	if _, _, state := p.GetPlayStatus(); state != extremote.PlayerStateStopped || p.GetNumPlayingTracks() != 0 {
+		t.Errorf("at the end: state %v, %d tracks", state, p.GetNumPlayingTracks())
+	}
+
+	p.RestoreQueue(saved)
+	if _, position, state := p.GetPlayStatus(); state != extremote.PlayerStatePaused || p.GetCurrentPlayingTrackIndex() != 1 || position != saved.Position {
+		t.Errorf("restored: state %v, index %d, position %d", state, p.GetCurrentPlayingTrackIndex(), position)
+	}
+}
+
+func TestLibraryIndex(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	music := filepath.Join(dir, "music")
+	indexPath := filepath.Join(dir, "library.index")
+	song := func(artist string) []byte {
+		return mp3File(map[string]string{"TIT2": "Song", "TPE1": artist}, 1000)
+	}
+	writeFile(t, filepath.Join(music, "m.mp3"), song("Mmm"))
+	writeFile(t, filepath.Join(music, "z.mp3"), song("Zzz"))
+	if _, err := scanLibrary(music, "", indexPath, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file that hasn't changed (going by its size and modification time)
+	// isn't read again, and new records go after the ones listed before.
+	info, _ := os.Stat(filepath.Join(music, "m.mp3"))
+	writeFile(t, filepath.Join(music, "m.mp3"), song("Nnn"))
+	os.Chtimes(filepath.Join(music, "m.mp3"), info.ModTime(), info.ModTime())
+	writeFile(t, filepath.Join(music, "a.mp3"), song("Aaa"))
+	lib, err := scanLibrary(music, "", indexPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var artists []string
+	for _, g := range lib.artists {
+		artists = append(artists, g.name)
+	}
+	if len(artists) != 3 || artists[0] != "Mmm" || artists[1] != "Zzz" || artists[2] != "Aaa" {
+		t.Errorf("artists = %q", artists)
+	}
+}
+
+func TestLibraryMissingDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	music := filepath.Join(dir, "music")
+	indexPath := filepath.Join(dir, "library.index")
+	writeFile(t, filepath.Join(music, "a.mp3"), mp3File(map[string]string{"TIT2": "Song"}, 1000))
+	if _, err := scanLibrary(music, "", indexPath, nil); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := ioutil.ReadFile(indexPath)
+
+	// A music directory that isn't there (e.g. not mounted) fails, rather
+	// than starting with an empty library and an empty index.
+	if _, err := scanLibrary(filepath.Join(dir, "missing"), "", indexPath, nil); err == nil {
+		t.Error("scanned a missing directory")
+	}
+	if _, err := NewPlayer(nil, Config{Dir: filepath.Join(dir, "missing"), Decoder: "tail -f {file}"}); err == nil {
+		t.Error("created a player for a missing directory")
+	}
+	if after, _ := ioutil.ReadFile(indexPath); string(after) != string(before) {
+		t.Error("the index changed")
+	}
+}
+
+func uint32s(values ...uint32) []byte {
+	b := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+// m4bFile is a five minute audiobook with three chapters, in a QuickTime
+// chapter track (track 2, which the audio track refers to.)
+func m4bFile() []byte {
+	var samples, sizes []byte
+	for _, title := range []string{"Opening", "Middle", "End"} {
+		sample := append([]byte{0, byte(len(title))}, title...)
+		samples = append(samples, sample...)
+		sizes = append(sizes, uint32s(uint32(len(sample)))...)
+	}
+	ftyp := atom("ftyp", []byte("M4B "))
+	mdat := atom("mdat", samples)
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 300000)
+	tkhd := func(id uint32) []byte { return atom("tkhd", make([]byte, 12), uint32s(id), make([]byte, 64)) }
+	audio := atom("trak", tkhd(1), atom("tref", atom("chap", uint32s(2))))
+	text := atom("trak", tkhd(2), atom("mdia",
+		atom("mdhd", make([]byte, 12), uint32s(1000, 300000)),
+		atom("minf", atom("stbl",
+			atom("stts", uint32s(0, 1, 3, 100000)),
+			atom("stsc", uint32s(0, 1, 1, 3, 1)),
+			atom("stsz", uint32s(0, 0, 3), sizes),
+			atom("stco", uint32s(0, 1, uint32(len(ftyp)+8)))))))
+	ilst := atom("ilst", m4aItem("\xa9nam", []byte("The Book")))
+	moov := atom("moov", atom("mvhd", mvhd), audio, text, atom("udta", atom("meta", make([]byte, 4), ilst)))
+	return bytes.Join([][]byte{ftyp, mdat, moov}, nil)
+}
+
+func TestChapters(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	writeFile(t, filepath.Join(dir, "track.m4b"), m4bFile())
+	// Nero chapters: a version and flags, the count, then each start (in
+	// 100ns units) and title.
+	chpl := []byte{0, 0, 0, 0, 2}
+	for i, title := range []string{"One", "Two"} {
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, uint64(i)*60*1e7)
+		chpl = append(append(append(chpl, start...), byte(len(title))), title...)
+	}
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 120000)
+	writeFile(t, filepath.Join(dir, "nero.m4b"), atom("moov", atom("mvhd", mvhd), atom("udta", atom("chpl", chpl))))
+
+	for file, want := range map[string][]Chapter{
+		"track.m4b": {{"Opening", 0}, {"Middle", 100 * time.Second}, {"End", 200 * time.Second}},
+		"nero.m4b":  {{"One", 0}, {"Two", time.Minute}},
+	} {
+		tags, err := ReadTags(filepath.Join(dir, file))
+		if err != nil || !reflect.DeepEqual(tags.Chapters, want) {
+			t.Errorf("%s: got %+v, %v; want %+v", file, tags.Chapters, err, want)
+		}
+	}
+}
+
+func TestAudiobooks(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	music := filepath.Join(dir, "music")
+	writeFile(t, filepath.Join(music, "book.m4b"), m4bFile())
+	for _, n := range []string{"1", "2"} {
+		writeFile(t, filepath.Join(music, "other", n+".mp3"), mp3File(map[string]string{
+			"TIT2": "Part " + n, "TALB": "Other Book", "TCON": "Audiobook", "TRCK": n,
+		}, 16000))
+	}
+	writeFile(t, filepath.Join(music, "song.mp3"), mp3File(map[string]string{"TIT2": "Song"}, 16000))
+	config := Config{
+		Dir:         music,
+		Decoder:     "tail -f {file}",
+		Audiobooks:  true,
+		AudiobookCD: extremote.DbCategoryPodcast,
+		Bookmarks:   filepath.Join(dir, "bookmarks.json"),
+	}
+	player, err := NewPlayer(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := player.(*localPlayer)
+	if len(p.lib.tracks) != 1 {
+		t.Errorf("%d music tracks", len(p.lib.tracks))
+	}
+	if books := p.RetrieveCategorizedDatabaseRecords(extremote.DbCategoryPodcast, 0, -1); !reflect.DeepEqual(books, []string{"Other Book", "The Book"}) {
+		t.Fatalf("books = %q", books)
+	}
+	p.SelectDBRecord(extremote.DbCategoryPodcast, 1)
+	if chapters := p.RetrieveCategorizedDatabaseRecords(extremote.DbCategoryTrack, 0, -1); !reflect.DeepEqual(chapters, []string{"Opening", "Middle", "End"}) {
+		t.Fatalf("chapters = %q", chapters)
+	}
+
+	// Fast forward jumps 30 seconds, into the next chapter after 100.
+	p.PlayCurrentSelection(0)
+	p.PlayControl(extremote.PlayControlPause)
+	for i := 0; i < 4; i++ {
+		p.PlayControl(extremote.PlayControlStartFF)
+		p.PlayControl(extremote.PlayControlEndFFRew)
+	}
+	if length, position, _ := p.GetPlayStatus(); p.GetCurrentPlayingTrackIndex() != 1 || length != 100000 || position < 20000 || position > 21000 {
+		t.Errorf("after fast forward: chapter %d, length %d, position %d", p.GetCurrentPlayingTrackIndex(), length, position)
+	}
+
+	// The decoder carries on from one chapter into the next.
+	p.PlayControl(extremote.PlayControlPlay)
+	p.mutex.Lock()
+	playback := p.playback
+	p.position = 100 * time.Second
+	p.advance()
+	if p.index != 2 || p.playback != playback || p.currentPosition() > time.Second {
+		t.Errorf("at the end of the chapter: chapter %d, position %v", p.index, p.currentPosition())
+	}
+	p.mutex.Unlock()
+	if saved := p.SaveQueue(); saved.Tracks[2] != filepath.Join(music, "book.m4b")+"#3" {
+		t.Errorf("saved %q", saved.Tracks)
+	}
+
+	// The place in the book is kept, and it's played from there next time,
+	// after a restart.
+	p.Seek(5000)
+	p.PlayControl(extremote.PlayControlPause)
+	p.mutex.Lock()
+	p.markBook()
+	p.mutex.Unlock()
+	p.Close()
+	player, err = NewPlayer(nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer player.Close()
+	p = player.(*localPlayer)
+	p.SelectDBRecord(extremote.DbCategoryPodcast, 1)
+	p.PlayCurrentSelection(0)
+	p.PlayControl(extremote.PlayControlPause)
+	if _, position, _ := p.GetPlayStatus(); p.GetCurrentPlayingTrackIndex() != 2 || position < 5000 || position > 6000 {
+		t.Errorf("resumed at chapter %d, position %d", p.GetCurrentPlayingTrackIndex(), position)
+	}
+}
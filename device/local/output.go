@@ -0,0 +1,104 @@
+package local
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+
+	"bmwctrl/device/radio"
+)
+
+// playback is a track being played by the external decoder, optionally
+// piped into an output program (e.g. aplay.)  Pausing stops the processes,
+// and resuming starts them again from where they were, which works with
+// any decoder that can start part way through a file.  A stream is read by
+// bmwctrl, for its ICY metadata, and piped into the decoder as file "-".
+type playback struct {
+	decoder *exec.Cmd
+	output  *exec.Cmd
+	stream  *radio.Stream
+	done    chan struct{} // Closed when the decoder exits.
+	err     error         // Why the decoder exited, once done is closed.
+}
+
+// command builds a command from a template, split on spaces, replacing
+// {file} with the file and {start} with the start position in seconds.
+func command(template string, file string, start time.Duration) *exec.Cmd {
+	fields := strings.Fields(template)
+	for i, field := range fields {
+		field = strings.Replace(field, "{file}", file, -1)
+		field = strings.Replace(field, "{start}", fmt.Sprintf("%.3f", start.Seconds()), -1)
+		fields[i] = field
+	}
+	return exec.Command(fields[0], fields[1:]...)
+}
+
+// startPlayback starts playing file from start.
+func startPlayback(decoder string, output string, file string, start time.Duration) (*playback, error) {
+	p := &playback{done: make(chan struct{})}
+	url := file
+	var stdin io.WriteCloser
+	if radio.IsStream(url) {
+		p.stream = radio.Open(url)
+		file, start = "-", 0
+	}
+	p.decoder = command(decoder, file, start)
+	if p.stream != nil {
+		var err error
+		if stdin, err = p.decoder.StdinPipe(); err != nil {
+			return nil, err
+		}
+	}
+	if output != "" {
+		p.output = command(output, file, start)
+		pipe, err := p.decoder.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		p.output.Stdin = pipe
+		if err := p.output.Start(); err != nil {
+			return nil, fmt.Errorf("starting output: %s", err)
+		}
+	}
+	if err := p.decoder.Start(); err != nil {
+		if p.output != nil {
+			p.output.Process.Kill()
+			p.output.Wait()
+		}
+		return nil, fmt.Errorf("starting decoder: %s", err)
+	}
+	if p.stream != nil {
+		// If the stream fails, the decoder comes to the end of its input.
+		go func() {
+			if _, err := io.Copy(stdin, p.stream); err != nil && !p.stream.Closed() {
+				logger.Warn("Stream failed", "url", url, "err", err)
+			}
+			stdin.Close()
+		}()
+	}
+	go func() {
+		p.err = p.decoder.Wait()
+		if p.output != nil {
+			p.output.Wait()
+		}
+		if p.stream != nil {
+			p.stream.Close()
+		}
+		close(p.done)
+	}()
+	return p, nil
+}
+
+// stop kills the processes, and waits for them to exit.
+func (p *playback) stop() {
+	if p.stream != nil {
+		p.stream.Close()
+	}
+	p.decoder.Process.Kill()
+	if p.output != nil {
+		p.output.Process.Kill()
+	}
+	<-p.done
+}
@@ -0,0 +1,758 @@
+package local
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/device"
+	"bmwctrl/device/radio"
+	"bmwctrl/device/smart"
+	"bmwctrl/logging"
+	"bmwctrl/options"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+var logger = logging.New("player/local")
+
+func init() {
+	device.Register(device.Backend{
+		Name:        "local",
+		Description: "Music files in a directory, played by an external decoder (no MPD needed.)",
+		Options: []device.Option{
+			{Name: "dir", Usage: "The music directory (required)"},
+			{Name: "decoder", Default: defaultDecoder, Usage: "The command that plays {file} from {start} seconds"},
+			{Name: "output", Usage: "A command the decoder's output is piped into, e.g. \"aplay -q -t raw -f cd\""},
+			{Name: "playlists", Usage: "A directory of playlist files (M3U, M3U8, PLS or XSPF), as well as those with the music"},
+			{Name: "index", Usage: "A file to keep the library index in, so only new and changed files are read at startup"},
+			{Name: "smart", Usage: "A file of smart playlists, one \"name = rule\" per line"},
+			{Name: "radio", Usage: "A playlist file (M3U, PLS or XSPF) of internet radio stations"},
+			{Name: "radio-cd", Default: "podcast", Usage: "The category the radio stations are listed in"},
+			{Name: "audiobooks", Usage: "true to list audiobooks (M4B files, and the Audiobook genre) by book, apart from the music"},
+			{Name: "audiobook-dir", Usage: "A directory of audiobooks (under dir, or absolute); turns audiobooks on"},
+			{Name: "audiobook-cd", Default: "podcast", Usage: "The category audiobooks are listed in"},
+			{Name: "bookmarks", Usage: "A file to keep the place in each audiobook in"},
+		},
+		New: func(notifications *device.PlayerNotifications, opts options.Options) (device.Player, error) {
+			dir := opts.String("dir", "")
+			if dir == "" {
+				return nil, errors.New("option 'dir' is required")
+			}
+			radioCategory, err := device.ParseCategory(opts.String("radio-cd", ""))
+			if err != nil {
+				return nil, err
+			}
+			audiobooks, err := opts.Bool("audiobooks", false)
+			if err != nil {
+				return nil, err
+			}
+			bookCategory, err := device.ParseCategory(opts.String("audiobook-cd", ""))
+			if err != nil {
+				return nil, err
+			}
+			return NewPlayer(notifications, Config{
+				Dir:       dir,
+				Playlists: opts.String("playlists", ""),
+				Decoder:   opts.String("decoder", ""),
+				Output:    opts.String("output", ""),
+				Index:     opts.String("index", ""),
+				Smart:     opts.String("smart", ""),
+				Radio:     opts.String("radio", ""),
+				RadioCD:   radioCategory,
+
+				Audiobooks:   audiobooks,
+				AudiobookDir: opts.String("audiobook-dir", ""),
+				AudiobookCD:  bookCategory,
+				Bookmarks:    opts.String("bookmarks", ""),
+			})
+		},
+	})
+}
+
+// The decoder used by default, which plays straight to ALSA.
+const defaultDecoder = "ffmpeg -nostdin -loglevel error -ss {start} -i {file} -f alsa default"
+
+// localPlayer implements the device.Player interface by playing the music
+// files in a directory itself, so that a minimal Pi image can run bmwctrl
+// without MPD.  The directory is scanned once at startup, and the tags read
+// to build the playlist, artist, album, genre and track categories.  Each
+// track is played by starting the decoder on it.
+type localPlayer struct {
+	lib       *library
+	smart     []smart.Playlist
+	playlists []group // The library's, then the smart playlists (with no tracks.)
+	history   func(id string) device.TrackHistory
+	stations  []group // One track each.
+	radioCD   extremote.DBCategoryType
+	booksCD   extremote.DBCategoryType
+	marks     *bookmarks // Nil without audiobooks.
+	decoder   string
+	output    string
+	selected  []*track
+
+	mutex    sync.Mutex
+	queue    []*track
+	index    int
+	state    extremote.PlayerState
+	position time.Duration // Where playback was last started, or paused.
+	started  time.Time     // When playback was last started.
+	playback *playback
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// Config configures a local player.
+type Config struct {
+	Dir       string                   // The music directory.
+	Playlists string                   // A directory of playlist files, as well as those in Dir.
+	Decoder   string                   // The command that plays each track.
+	Output    string                   // A command the decoder's output is piped into.
+	Index     string                   // The file the library index is kept in.
+	Smart     string                   // A file of smart playlists (see smart.LoadFile.)
+	Radio     string                   // A playlist file of radio stations.
+	RadioCD   extremote.DBCategoryType // The category the stations are listed in.
+
+	Audiobooks   bool                     // Whether to list audiobooks by book.
+	AudiobookDir string                   // A directory of audiobooks, which turns them on.
+	AudiobookCD  extremote.DBCategoryType // The category the books are listed in.
+	Bookmarks    string                   // The file the place in each book is kept in.
+}
+
+// NewPlayer creates a player for the music in a directory.
+func NewPlayer(notifications *device.PlayerNotifications, config Config) (device.Player, error) {
+	if config.Dir == "" {
+		return nil, errors.New("no music directory")
+	}
+	if len(strings.Fields(config.Decoder)) == 0 {
+		return nil, errors.New("no decoder command")
+	}
+	if config.Output != "" && len(strings.Fields(config.Output)) == 0 {
+		return nil, errors.New("the output command is empty")
+	}
+	var lists []smart.Playlist
+	if config.Smart != "" {
+		var err error
+		if lists, err = smart.LoadFile(config.Smart); err != nil {
+			return nil, err
+		}
+	}
+	var stations []radio.Station
+	if config.Radio != "" {
+		var err error
+		if stations, err = radio.LoadStations(config.Radio); err != nil {
+			return nil, err
+		}
+	}
+	var books *audiobooks
+	var marks *bookmarks
+	if config.Audiobooks || config.AudiobookDir != "" {
+		if config.Radio != "" && config.RadioCD == config.AudiobookCD {
+			return nil, fmt.Errorf("radio stations and audiobooks can't both be listed as %ss", device.CategoryNames[config.RadioCD])
+		}
+		books = &audiobooks{dir: config.AudiobookDir}
+		if books.dir != "" && !filepath.IsAbs(books.dir) {
+			books.dir = filepath.Join(config.Dir, books.dir)
+		}
+		var err error
+		if marks, err = loadBookmarks(config.Bookmarks); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	lib, err := scanLibrary(config.Dir, config.Playlists, config.Index, books)
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Music directory scanned", "dir", config.Dir, "tracks", len(lib.tracks),
+		"playlists", len(lib.playlists), "artists", len(lib.artists), "albums", len(lib.albums),
+		"genres", len(lib.genres), "books", len(lib.books), "took", time.Since(start).Round(time.Millisecond))
+	p := &localPlayer{
+		lib:       lib,
+		smart:     lists,
+		playlists: lib.playlists[:len(lib.playlists):len(lib.playlists)],
+		radioCD:   config.RadioCD,
+		booksCD:   config.AudiobookCD,
+		marks:     marks,
+		decoder:   config.Decoder,
+		output:    config.Output,
+		state:     extremote.PlayerStateStopped,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, list := range lists {
+		p.playlists = append(p.playlists, group{name: list.Name})
+	}
+	for _, station := range stations {
+		t := &track{path: station.URL, Tags: Tags{Title: station.Name, Artist: station.Name, AlbumArtist: station.Name, Album: "Radio"}}
+		p.stations = append(p.stations, group{station.Name, []*track{t}})
+	}
+	go p.run(notifications)
+	return p, nil
+}
+
+// groups returns the records of a category.  The radio stations and the
+// audiobooks, if there are any, take the place of their categories.
+func (p *localPlayer) groups(categoryType extremote.DBCategoryType) []group {
+	if p.isRadio(categoryType) {
+		return p.stations
+	}
+	if p.isBooks(categoryType) {
+		return p.lib.books
+	}
+	switch categoryType {
+	case extremote.DbCategoryPlaylist:
+		return p.playlists
+	case extremote.DbCategoryArtist:
+		return p.lib.artists
+	case extremote.DbCategoryAlbum:
+		return p.lib.albums
+	case extremote.DbCategoryGenre:
+		return p.lib.genres
+	case extremote.DbCategoryTrack:
+		return p.lib.titles
+	default:
+		logger.Warn("Category not supported", "category", categoryType)
+		return nil
+	}
+}
+
+func (p *localPlayer) isRadio(categoryType extremote.DBCategoryType) bool {
+	return p.stations != nil && categoryType == p.radioCD
+}
+
+func (p *localPlayer) isBooks(categoryType extremote.DBCategoryType) bool {
+	return p.lib.books != nil && categoryType == p.booksCD
+}
+
+func (p *localPlayer) ResetDBSelection() {
+	p.selected = nil
+}
+
+func (p *localPlayer) SelectDBRecord(categoryType extremote.DBCategoryType, recordIndex int) {
+	if recordIndex < 0 {
+		p.selected = nil
+		return
+	}
+	groups := p.groups(categoryType)
+	if recordIndex >= len(groups) {
+		logger.Warn("Selected record doesn't exist", "category", categoryType, "index", recordIndex)
+		return
+	}
+	if categoryType == extremote.DbCategoryPlaylist && !p.isRadio(categoryType) && !p.isBooks(categoryType) && recordIndex >= len(p.lib.playlists) {
+		// Smart playlists are worked out when they're selected.
+		p.selected = p.lib.smartTracks(p.smart[recordIndex-len(p.lib.playlists)], p.history)
+		return
+	}
+	p.selected = groups[recordIndex].tracks
+}
+
+func (p *localPlayer) GetNumberCategorizedDBRecords(categoryType extremote.DBCategoryType) int {
+	if p.selected != nil {
+		if categoryType != extremote.DbCategoryTrack {
+			logger.Warn("Only tracks are supported at the second level", "category", categoryType)
+			return 0
+		}
+		return len(p.selected)
+	}
+	return len(p.groups(categoryType))
+}
+
+func (p *localPlayer) RetrieveCategorizedDatabaseRecords(categoryType extremote.DBCategoryType, offset int, count int) []string {
+	var names []string
+	if p.selected != nil {
+		if categoryType != extremote.DbCategoryTrack {
+			logger.Warn("Only tracks are supported at the second level", "category", categoryType)
+			return []string{}
+		}
+		for _, t := range p.selected {
+			names = append(names, t.Title)
+		}
+	} else {
+		for _, g := range p.groups(categoryType) {
+			names = append(names, g.name)
+		}
+	}
+	if offset > len(names) {
+		offset = len(names)
+	}
+	if count < 0 || offset+count > len(names) {
+		count = len(names) - offset
+	}
+	return names[offset : offset+count]
+}
+
+func (p *localPlayer) GetPlayStatus() (trackLength int, trackPosition int, state extremote.PlayerState) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	if t := p.current(); t != nil && radio.IsStream(t.path) {
+		trackLength = int(radio.Length / time.Millisecond)
+	} else if t != nil {
+		trackLength = int(t.Length / time.Millisecond)
+	}
+	return trackLength, int(p.currentPosition() / time.Millisecond), p.state
+}
+
+// SetPlayStatusChangeNotification does nothing, as the notifications the
+// car doesn't want are dropped by device.PlayerNotifications.
+func (p *localPlayer) SetPlayStatusChangeNotification(notificationMask extremote.Notifications) {
+}
+
+func (p *localPlayer) PlayControl(cmd extremote.PlayControlCmd) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	switch cmd {
+	case extremote.PlayControlToggle:
+		switch p.state {
+		case extremote.PlayerStatePlaying:
+			p.pause()
+		default:
+			p.play()
+		}
+
+	case extremote.PlayControlStop:
+		p.halt()
+		p.position = 0
+
+	case extremote.PlayControlNextTrack, extremote.PlayControlNext:
+		p.nextTrack()
+
+	case extremote.PlayControlPrevTrack, extremote.PlayControlPrev:
+		p.prevTrack()
+
+	case extremote.PlayControlStartFF:
+		if t := p.current(); t != nil && t.book != "" {
+			p.jump(bookJump)
+		}
+
+	case extremote.PlayControlStartRew:
+		if t := p.current(); t != nil && t.book != "" {
+			p.jump(-bookJump)
+		}
+
+	case extremote.PlayControlEndFFRew:
+
+	case extremote.PlayControlPlay:
+		p.play()
+
+	case extremote.PlayControlPause:
+		p.pause()
+	}
+}
+
+func (p *localPlayer) PlayCurrentSelection(index int) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	if p.selected != nil {
+		p.queue = p.selected
+	} else if p.queue == nil {
+		p.queue = p.lib.tracks
+	}
+	if !p.resumeBook(index) {
+		p.playTrack(index)
+	}
+}
+
+func (p *localPlayer) GetNumPlayingTracks() int {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	return len(p.queue)
+}
+
+func (p *localPlayer) GetCurrentPlayingTrackIndex() int {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	return p.index
+}
+
+// GetIndexedPlayingTrackTitle returns a track's title, or for the stream
+// being played, the stream title if the station sends one.
+func (p *localPlayer) GetIndexedPlayingTrackTitle(index int) string {
+	if title := p.streamTitle(index); title != "" {
+		return title
+	}
+	if t := p.queued(index); t != nil {
+		return t.Title
+	}
+	return ""
+}
+
+func (p *localPlayer) GetIndexedPlayingTrackArtistName(index int) string {
+	if t := p.queued(index); t != nil {
+		return t.Artist
+	}
+	return ""
+}
+
+func (p *localPlayer) GetIndexedPlayingTrackAlbumName(index int) string {
+	if t := p.queued(index); t != nil {
+		return t.Album
+	}
+	return ""
+}
+
+// GetIndexedPlayingTrackID implements device.TrackIdentifier.  Tracks are
+// identified by path, and chapter.
+func (p *localPlayer) GetIndexedPlayingTrackID(index int) string {
+	if t := p.queued(index); t != nil {
+		return t.id()
+	}
+	return ""
+}
+
+// UseHistory implements device.HistoryUser, for the plays and played fields
+// of smart playlists.
+func (p *localPlayer) UseHistory(lookup func(id string) device.TrackHistory) {
+	p.history = lookup
+}
+
+func (p *localPlayer) SetCurrentPlayingTrack(index int) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	p.playTrack(index)
+}
+
+func (p *localPlayer) Seek(position int) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	t := p.current()
+	if t == nil || radio.IsStream(t.path) {
+		return
+	}
+	to := time.Duration(position) * time.Millisecond
+	if t.Length > 0 && to > t.Length {
+		to = t.Length
+	}
+	p.seekTo(p.index, to)
+}
+
+// SaveQueue implements device.Resumer.  Tracks are saved by ID.
+func (p *localPlayer) SaveQueue() device.QueueState {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	queue := device.QueueState{
+		Tracks:   make([]string, len(p.queue)),
+		Index:    p.index,
+		Position: int(p.currentPosition() / time.Millisecond),
+		Playing:  p.state == extremote.PlayerStatePlaying,
+	}
+	for i, t := range p.queue {
+		queue.Tracks[i] = t.id()
+	}
+	return queue
+}
+
+// RestoreQueue implements device.Resumer.  Tracks that are no longer in the
+// music directory are left out.
+func (p *localPlayer) RestoreQueue(queue device.QueueState) {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	byID := make(map[string]*track, len(p.lib.tracks)+len(p.stations))
+	for _, t := range p.lib.tracks {
+		byID[t.id()] = t
+	}
+	for _, g := range p.stations {
+		byID[g.tracks[0].id()] = g.tracks[0]
+	}
+	for _, g := range p.lib.books {
+		for _, t := range g.tracks {
+			byID[t.id()] = t
+		}
+	}
+	p.halt()
+	p.queue, p.index, p.position = nil, 0, 0
+	for i, id := range queue.Tracks {
+		t, ok := byID[id]
+		if !ok {
+			logger.Warn("Track not found, not restoring it", "track", id)
+			continue
+		}
+		if i == queue.Index {
+			p.index = len(p.queue)
+			p.position = time.Duration(queue.Position) * time.Millisecond
+		}
+		p.queue = append(p.queue, t)
+	}
+	if p.queue == nil {
+		return
+	}
+	p.state = extremote.PlayerStatePaused
+	if queue.Playing {
+		p.play()
+	}
+}
+
+// Close stops playing, and stops watching the decoder.
+func (p *localPlayer) Close() error {
+	close(p.stop)
+	<-p.done
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	p.halt()
+	if p.marks != nil {
+		p.marks.save(0)
+	}
+	return nil
+}
+
+// queued returns a track in the play queue, or nil.
+func (p *localPlayer) queued(index int) *track {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	if index < 0 || index >= len(p.queue) {
+		return nil
+	}
+	return p.queue[index]
+}
+
+// streamTitle returns the stream title, if the track is the stream being
+// played.
+func (p *localPlayer) streamTitle(index int) string {
+	defer p.mutex.Unlock()
+	p.mutex.Lock()
+	if index != p.index || p.playback == nil || p.playback.stream == nil {
+		return ""
+	}
+	return p.playback.stream.Title()
+}
+
+// current returns the playing track, or nil.  The mutex must be held.
+func (p *localPlayer) current() *track {
+	if p.index < 0 || p.index >= len(p.queue) {
+		return nil
+	}
+	return p.queue[p.index]
+}
+
+// currentPosition returns the position in the playing track.  The mutex
+// must be held.
+func (p *localPlayer) currentPosition() time.Duration {
+	if p.state != extremote.PlayerStatePlaying {
+		return p.position
+	}
+	return p.position + time.Since(p.started)
+}
+
+// The following change what's playing, and must be called with the mutex
+// held.
+
+// play starts the decoder on the current track, from the current position.
+func (p *localPlayer) play() {
+	t := p.current()
+	if t == nil || p.playback != nil {
+		return
+	}
+	if radio.IsStream(t.path) {
+		// Streams start from wherever they are now.
+		p.position = 0
+	}
+	playback, err := startPlayback(p.decoder, p.output, t.path, t.start+p.position)
+	if err != nil {
+		logger.Error("Can't play track", "path", t.path, "err", err)
+		device.CountError("local", "decoder")
+		p.state = extremote.PlayerStateStopped
+		return
+	}
+	p.playback = playback
+	p.started = time.Now()
+	p.state = extremote.PlayerStatePlaying
+}
+
+// halt stops the decoder, and keeps the position.
+func (p *localPlayer) halt() {
+	if p.playback != nil {
+		p.position = p.currentPosition()
+		p.playback.stop()
+		p.playback = nil
+	}
+	p.state = extremote.PlayerStateStopped
+}
+
+func (p *localPlayer) pause() {
+	if p.state == extremote.PlayerStatePlaying {
+		p.halt()
+		p.state = extremote.PlayerStatePaused
+	}
+}
+
+// playTrack plays a track in the play queue from the start.
+func (p *localPlayer) playTrack(index int) {
+	p.halt()
+	if index < 0 || index >= len(p.queue) {
+		return
+	}
+	p.index = index
+	p.position = 0
+	p.play()
+}
+
+// seekTo moves to a position in a track in the play queue, playing it if
+// the player was playing.
+func (p *localPlayer) seekTo(index int, to time.Duration) {
+	if p.state == extremote.PlayerStatePlaying {
+		p.halt()
+		p.index, p.position = index, to
+		p.play()
+	} else {
+		p.index, p.position = index, to
+	}
+}
+
+func (p *localPlayer) prevTrack() {
+	if p.currentPosition() < 2*time.Second && p.index > 0 {
+		p.playTrack(p.index - 1)
+	} else {
+		p.playTrack(p.index)
+	}
+}
+
+func (p *localPlayer) nextTrack() {
+	if p.index+1 < len(p.queue) {
+		p.playTrack(p.index + 1)
+	} else {
+		if t := p.current(); t != nil && t.book != "" {
+			// The book has been finished, so it starts again next time.
+			p.marks.remove(t.book)
+		}
+		p.halt()
+		p.queue, p.index, p.position = nil, 0, 0
+	}
+}
+
+func (p *localPlayer) run(notifications *device.PlayerNotifications) {
+	defer close(p.done)
+	const interval = 500
+	ticker := time.NewTicker(interval * time.Millisecond)
+	defer ticker.Stop()
+
+	var index, offset int
+	var state extremote.PlayerState
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+		p.mutex.Lock()
+		p.advance()
+		p.markBook()
+		newIndex, newState := p.index, p.state
+		newOffset := int(p.currentPosition() / time.Millisecond)
+		p.mutex.Unlock()
+
+		if p.marks != nil && newState == extremote.PlayerStatePlaying {
+			p.marks.save(bookmarkInterval)
+		} else if p.marks != nil {
+			p.marks.save(0)
+		}
+
+		if newIndex != index {
+			notifications.TrackIndexChanged(newIndex)
+		}
+		if newOffset != offset {
+			notifications.TrackTimeOffset(newOffset)
+		}
+		if newState != state && newState != extremote.PlayerStatePlaying {
+			notifications.PlaybackStopped()
+		}
+		index, offset, state = newIndex, newOffset, newState
+	}
+}
+
+// advance moves on to the next track when the decoder has finished the
+// current one.  The mutex must be held.
+func (p *localPlayer) advance() {
+	if p.playback == nil {
+		return
+	}
+	select {
+	case <-p.playback.done:
+	default:
+		p.nextChapter()
+		return
+	}
+	if err := p.playback.err; err != nil {
+		logger.Warn("Decoder failed", "path", p.current().path, "err", err)
+		device.CountError("local", "decoder")
+	}
+	p.playback = nil
+	p.nextTrack()
+}
+
+// nextChapter moves on when the decoder comes to the end of a chapter
+// within a file.  If the next chapter is next in the play queue, the
+// decoder carries on with it.  The mutex must be held.
+func (p *localPlayer) nextChapter() {
+	t := p.current()
+	if t == nil || t.chapter == 0 || t.Length <= 0 || p.currentPosition() < t.Length {
+		return
+	}
+	if p.index+1 < len(p.queue) {
+		next := p.queue[p.index+1]
+		if next.path == t.path && next.start == t.start+t.Length {
+			p.position -= t.Length
+			p.index++
+			return
+		}
+	}
+	p.halt()
+	p.nextTrack()
+}
+
+// How far fast forward and rewind jump in an audiobook.
+const bookJump = 30 * time.Second
+
+// jump moves through an audiobook, into the next or previous chapter if
+// it goes past either end of this one.  The mutex must be held.
+func (p *localPlayer) jump(d time.Duration) {
+	index, to := p.index, p.currentPosition()+d
+	if t := p.queue[index]; t.Length > 0 && to >= t.Length && index+1 < len(p.queue) {
+		to -= t.Length
+		index++
+	} else if to < 0 && index > 0 {
+		index--
+		to += p.queue[index].Length
+	}
+	if to < 0 {
+		to = 0
+	}
+	if length := p.queue[index].Length; length > 0 && to > length {
+		to = length
+	}
+	p.seekTo(index, to)
+}
+
+// markBook keeps the place in the audiobook being played.  The mutex must
+// be held.
+func (p *localPlayer) markBook() {
+	t := p.current()
+	if t == nil || t.book == "" || p.state == extremote.PlayerStateStopped {
+		return
+	}
+	p.marks.set(t.book, bookmark{t.id(), int(p.currentPosition() / time.Millisecond)})
+}
+
+// resumeBook plays an audiobook from where it was left, if it's started
+// from the beginning or from the chapter it was left in, and reports
+// whether it did.  The mutex must be held.
+func (p *localPlayer) resumeBook(index int) bool {
+	if index < 0 || index >= len(p.queue) || p.queue[index].book == "" {
+		return false
+	}
+	mark, ok := p.marks.get(p.queue[index].book)
+	if !ok {
+		return false
+	}
+	for i, t := range p.queue {
+		if t.id() == mark.Track && (index == 0 || index == i) {
+			p.halt()
+			p.index, p.position = i, time.Duration(mark.Position)*time.Millisecond
+			p.play()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,580 @@
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// Tags are the details of a music file used to build the database.
+type Tags struct {
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genre       string
+	Year        int
+	Track       int
+	Disc        int
+	Length      time.Duration
+	Chapters    []Chapter // Chapters within the file (M4B), if there's more than one.
+}
+
+var errUnknownFormat = errors.New("unknown file format")
+
+// ReadTags reads the tags and length of an MP3 (ID3v2 or ID3v1), FLAC
+// (Vorbis comments) or M4A file, and an M4A file's chapters.
+func ReadTags(path string) (Tags, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Tags{}, err
+	}
+	defer f.Close()
+	var tags Tags
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3":
+		err = readMP3(f, &tags)
+	case ".flac":
+		err = readFLAC(f, &tags)
+	case ".m4a", ".m4b", ".mp4", ".aac":
+		err = readM4A(f, &tags)
+	default:
+		err = errUnknownFormat
+	}
+	if err != nil {
+		return tags, fmt.Errorf("%s: %s", path, err)
+	}
+	return tags, nil
+}
+
+// setNumber sets a track or disc number from a tag such as "3/12".
+func setNumber(n *int, value string) {
+	if i := strings.IndexByte(value, '/'); i >= 0 {
+		value = value[:i]
+	}
+	*n, _ = strconv.Atoi(strings.TrimSpace(value))
+}
+
+// setYear sets a year from a date, e.g. "1969" or "1969-05-12".
+func setYear(n *int, value string) {
+	value = strings.TrimSpace(value)
+	if len(value) > 4 {
+		value = value[:4]
+	}
+	*n, _ = strconv.Atoi(value)
+}
+
+// MP3: ID3v2 at the start, or ID3v1 at the end, with the length worked
+// out from the first frame header (and its Xing header, for VBR files.)
+
+func readMP3(f *os.File, tags *Tags) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return err
+	}
+	audioStart := int64(0)
+	if string(header[:3]) == "ID3" {
+		size := syncsafe(header[6:10])
+		// As with M4A atoms, a broken file can't ask for more than it holds.
+		if int64(size) > info.Size()-10 {
+			return errors.New("bad ID3 tag size")
+		}
+		audioStart = 10 + int64(size)
+		body := make([]byte, size)
+		if _, err := io.ReadFull(f, body); err != nil {
+			return err
+		}
+		readID3v2(header[3], header[5], body, tags)
+	} else if err := readID3v1(f, tags); err != nil {
+		return err
+	}
+	frame := make([]byte, 4096)
+	n, _ := f.ReadAt(frame, audioStart)
+	tags.Length = mp3Length(frame[:n], info.Size()-audioStart)
+	return nil
+}
+
+func syncsafe(b []byte) int {
+	return int(b[0]&0x7f)<<21 | int(b[1]&0x7f)<<14 | int(b[2]&0x7f)<<7 | int(b[3]&0x7f)
+}
+
+func readID3v2(version byte, flags byte, body []byte, tags *Tags) {
+	idLen, sizeLen := 4, 4
+	if version == 2 {
+		idLen, sizeLen = 3, 3
+	}
+	if flags&0x40 != 0 && version >= 3 && len(body) >= 4 {
+		// Skip the extended header.
+		size := int(binary.BigEndian.Uint32(body))
+		if version == 4 {
+			size = syncsafe(body)
+		} else {
+			size += 4
+		}
+		if size > len(body) {
+			return
+		}
+		body = body[size:]
+	}
+	for len(body) >= idLen+sizeLen {
+		id := string(body[:idLen])
+		if body[0] == 0 {
+			break
+		}
+		var size int
+		switch {
+		case version == 2:
+			size = int(body[3])<<16 | int(body[4])<<8 | int(body[5])
+		case version == 4:
+			size = syncsafe(body[4:8])
+		default:
+			size = int(binary.BigEndian.Uint32(body[4:8]))
+		}
+		headerLen := idLen + sizeLen
+		if version > 2 {
+			headerLen += 2 // Flags
+		}
+		if size < 0 || headerLen+size > len(body) {
+			break
+		}
+		value := id3Text(body[headerLen : headerLen+size])
+		body = body[headerLen+size:]
+		switch id {
+		case "TIT2", "TT2":
+			tags.Title = value
+		case "TPE1", "TP1":
+			tags.Artist = value
+		case "TPE2", "TP2":
+			tags.AlbumArtist = value
+		case "TALB", "TAL":
+			tags.Album = value
+		case "TCON", "TCO":
+			tags.Genre = id3Genre(value)
+		case "TRCK", "TRK":
+			setNumber(&tags.Track, value)
+		case "TPOS", "TPA":
+			setNumber(&tags.Disc, value)
+		case "TYER", "TYE", "TDRC":
+			setYear(&tags.Year, value)
+		}
+	}
+}
+
+// id3Text decodes a text frame, which starts with its encoding.  Only the
+// first of several values is used.
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	encoding, data := data[0], data[1:]
+	var s string
+	switch encoding {
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			order, data = binary.LittleEndian, data[2:]
+		} else if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			data = data[2:]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s = string(data)
+	default:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		s = string(runes)
+	}
+	if i := strings.IndexByte(s, 0); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+// id3Genre resolves a genre given by number, e.g. "(17)" or "17".
+func id3Genre(value string) string {
+	number := value
+	if strings.HasPrefix(value, "(") {
+		if i := strings.IndexByte(value, ')'); i > 0 {
+			number = value[1:i]
+			if rest := value[i+1:]; rest != "" {
+				return rest
+			}
+		}
+	}
+	if n, err := strconv.Atoi(number); err == nil {
+		return id3v1Genre(n)
+	}
+	return value
+}
+
+var id3v1Genres = strings.Split("Blues,Classic Rock,Country,Dance,Disco,Funk,Grunge,Hip-Hop,"+
+	"Jazz,Metal,New Age,Oldies,Other,Pop,R&B,Rap,Reggae,Rock,Techno,Industrial,Alternative,"+
+	"Ska,Death Metal,Pranks,Soundtrack,Euro-Techno,Ambient,Trip-Hop,Vocal,Jazz+Funk,Fusion,"+
+	"Trance,Classical,Instrumental,Acid,House,Game,Sound Clip,Gospel,Noise,AlternRock,Bass,"+
+	"Soul,Punk,Space,Meditative,Instrumental Pop,Instrumental Rock,Ethnic,Gothic,Darkwave,"+
+	"Techno-Industrial,Electronic,Pop-Folk,Eurodance,Dream,Southern Rock,Comedy,Cult,Gangsta,"+
+	"Top 40,Christian Rap,Pop/Funk,Jungle,Native American,Cabaret,New Wave,Psychadelic,Rave,"+
+	"Showtunes,Trailer,Lo-Fi,Tribal,Acid Punk,Acid Jazz,Polka,Retro,Musical,Rock & Roll,Hard Rock", ",")
+
+func id3v1Genre(n int) string {
+	if n < 0 || n >= len(id3v1Genres) {
+		return ""
+	}
+	return id3v1Genres[n]
+}
+
+func readID3v1(f *os.File, tags *Tags) error {
+	info, err := f.Stat()
+	if err != nil || info.Size() < 128 {
+		return err
+	}
+	tag := make([]byte, 128)
+	if _, err := f.ReadAt(tag, info.Size()-128); err != nil {
+		return err
+	}
+	if string(tag[:3]) != "TAG" {
+		return nil
+	}
+	field := func(b []byte) string {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+		return strings.TrimSpace(string(b))
+	}
+	tags.Title = field(tag[3:33])
+	tags.Artist = field(tag[33:63])
+	tags.Album = field(tag[63:93])
+	setYear(&tags.Year, field(tag[93:97]))
+	if tag[125] == 0 {
+		tags.Track = int(tag[126])
+	}
+	tags.Genre = id3v1Genre(int(tag[127]))
+	return nil
+}
+
+var (
+	mp3Bitrates = [2][3][16]int{
+		{ // MPEG 1, layers 1 to 3
+			{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448},
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384},
+			{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		},
+		{ // MPEG 2 and 2.5
+			{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+			{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+		},
+	}
+	mp3SampleRates = [3]int{44100, 48000, 32000}
+)
+
+// mp3Length works out the length of the audio from its first frame: from
+// the frame count in a Xing (or Info) header if there is one, and from the
+// bitrate otherwise.
+func mp3Length(data []byte, audioBytes int64) time.Duration {
+	for i := 0; i+4 <= len(data); i++ {
+		if data[i] != 0xff || data[i+1]&0xe0 != 0xe0 {
+			continue
+		}
+		version := (data[i+1] >> 3) & 3 // 0 is 2.5, 2 is 2, 3 is 1
+		layer := 4 - int((data[i+1]>>1)&3)
+		bitrateIndex := data[i+2] >> 4
+		rateIndex := (data[i+2] >> 2) & 3
+		if version == 1 || layer == 4 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+			continue
+		}
+		mpeg2 := 0
+		sampleRate := mp3SampleRates[rateIndex]
+		if version != 3 {
+			mpeg2 = 1
+			sampleRate /= 2
+			if version == 0 {
+				sampleRate /= 2
+			}
+		}
+		samples := 1152
+		if layer == 1 {
+			samples = 384
+		} else if layer == 3 && mpeg2 == 1 {
+			samples = 576
+		}
+		mono := data[i+3]>>6 == 3
+		sideInfo := 32
+		if mpeg2 == 1 && mono {
+			sideInfo = 9
+		} else if mpeg2 == 1 || mono {
+			sideInfo = 17
+		}
+		if xing := i + 4 + sideInfo; xing+12 <= len(data) {
+			id := string(data[xing : xing+4])
+			if (id == "Xing" || id == "Info") && data[xing+7]&1 != 0 {
+				frames := binary.BigEndian.Uint32(data[xing+8:])
+				return time.Duration(frames) * time.Duration(samples) * time.Second / time.Duration(sampleRate)
+			}
+		}
+		bitrate := mp3Bitrates[mpeg2][layer-1][bitrateIndex] * 1000
+		return time.Duration(audioBytes-int64(i)) * 8 * time.Second / time.Duration(bitrate)
+	}
+	return 0
+}
+
+// FLAC: the length from STREAMINFO, and tags from the Vorbis comments.
+
+func readFLAC(f *os.File, tags *Tags) error {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return err
+	}
+	if string(magic) != "fLaC" {
+		return errors.New("not a FLAC file")
+	}
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			return err
+		}
+		last, kind := header[0]&0x80 != 0, header[0]&0x7f
+		size := int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+		if kind != 0 && kind != 4 {
+			if _, err := f.Seek(int64(size), io.SeekCurrent); err != nil {
+				return err
+			}
+		} else {
+			block := make([]byte, size)
+			if _, err := io.ReadFull(f, block); err != nil {
+				return err
+			}
+			if kind == 0 && size >= 18 {
+				sampleRate := int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+				samples := uint64(block[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(block[14:]))
+				if sampleRate > 0 {
+					tags.Length = time.Duration(samples) * time.Second / time.Duration(sampleRate)
+				}
+			} else if kind == 4 {
+				readVorbisComments(block, tags)
+			}
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func readVorbisComments(block []byte, tags *Tags) {
+	next := func() ([]byte, bool) {
+		if len(block) < 4 {
+			return nil, false
+		}
+		n := int(binary.LittleEndian.Uint32(block))
+		if n < 0 || 4+n > len(block) {
+			return nil, false
+		}
+		value := block[4 : 4+n]
+		block = block[4+n:]
+		return value, true
+	}
+	if _, ok := next(); !ok { // Vendor
+		return
+	}
+	if len(block) < 4 {
+		return
+	}
+	count := int(binary.LittleEndian.Uint32(block))
+	block = block[4:]
+	for i := 0; i < count; i++ {
+		comment, ok := next()
+		if !ok {
+			return
+		}
+		eq := bytes.IndexByte(comment, '=')
+		if eq < 0 {
+			continue
+		}
+		value := strings.TrimSpace(string(comment[eq+1:]))
+		switch strings.ToUpper(string(comment[:eq])) {
+		case "TITLE":
+			tags.Title = value
+		case "ARTIST":
+			tags.Artist = value
+		case "ALBUMARTIST", "ALBUM ARTIST":
+			tags.AlbumArtist = value
+		case "ALBUM":
+			tags.Album = value
+		case "GENRE":
+			tags.Genre = value
+		case "TRACKNUMBER":
+			setNumber(&tags.Track, value)
+		case "DISCNUMBER":
+			setNumber(&tags.Disc, value)
+		case "DATE", "YEAR":
+			setYear(&tags.Year, value)
+		}
+	}
+}
+
+// M4A: the length from moov/mvhd, tags from moov/udta/meta/ilst, and
+// chapters (see chapters.go.)
+
+func readM4A(f *os.File, tags *Tags) error {
+	// Find the moov atom, skipping over the rest (mdat can be most of the
+	// file.)
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(f, header); err != nil {
+			if err == io.EOF {
+				return errors.New("no moov atom")
+			}
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header))
+		if size == 1 {
+			large := make([]byte, 8)
+			if _, err := io.ReadFull(f, large); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(large)) - 8
+		}
+		if size < 8 {
+			return errors.New("bad atom size")
+		}
+		if string(header[4:]) == "moov" {
+			// The size is read before it's allocated, so a broken file
+			// can't ask for more than the file holds.
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			if size-8 > info.Size()-offset {
+				return errors.New("bad atom size")
+			}
+			moov := make([]byte, size-8)
+			if _, err := io.ReadFull(f, moov); err != nil {
+				return err
+			}
+			readMoov(moov, tags)
+			if chapters := readChapterTrack(f, moov); len(chapters) > 0 {
+				tags.Chapters = chapters
+			}
+			tags.Chapters = cleanChapters(tags.Chapters, tags.Length)
+			return nil
+		}
+		if _, err := f.Seek(size-8, io.SeekCurrent); err != nil {
+			return err
+		}
+	}
+}
+
+// atoms calls fn for each atom in data.
+func atoms(data []byte, fn func(kind string, body []byte)) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return
+		}
+		fn(string(data[4:8]), data[8:size])
+		data = data[size:]
+	}
+}
+
+func readMoov(moov []byte, tags *Tags) {
+	atoms(moov, func(kind string, body []byte) {
+		switch kind {
+		case "mvhd":
+			readMvhd(body, tags)
+		case "udta":
+			atoms(body, func(kind string, body []byte) {
+				if kind == "chpl" {
+					tags.Chapters = readChpl(body)
+					return
+				}
+				if kind != "meta" || len(body) < 4 {
+					return
+				}
+				// meta has a version and flags before its children.
+				atoms(body[4:], func(kind string, body []byte) {
+					if kind == "ilst" {
+						atoms(body, func(kind string, body []byte) {
+							readIlstItem(kind, body, tags)
+						})
+					}
+				})
+			})
+		}
+	})
+}
+
+func readMvhd(body []byte, tags *Tags) {
+	var timescale, duration uint64
+	switch {
+	case len(body) >= 20 && body[0] == 0:
+		timescale = uint64(binary.BigEndian.Uint32(body[12:]))
+		duration = uint64(binary.BigEndian.Uint32(body[16:]))
+	case len(body) >= 32 && body[0] == 1:
+		timescale = uint64(binary.BigEndian.Uint32(body[20:]))
+		duration = binary.BigEndian.Uint64(body[24:])
+	}
+	if timescale > 0 {
+		tags.Length = time.Duration(duration) * time.Second / time.Duration(timescale)
+	}
+}
+
+func readIlstItem(kind string, body []byte, tags *Tags) {
+	var data []byte
+	atoms(body, func(k string, b []byte) {
+		// data has a type and a locale before the value.
+		if k == "data" && len(b) >= 8 {
+			data = b[8:]
+		}
+	})
+	if data == nil {
+		return
+	}
+	switch kind {
+	case "\xa9nam":
+		tags.Title = string(data)
+	case "\xa9ART":
+		tags.Artist = string(data)
+	case "aART":
+		tags.AlbumArtist = string(data)
+	case "\xa9alb":
+		tags.Album = string(data)
+	case "\xa9gen":
+		tags.Genre = string(data)
+	case "\xa9day":
+		setYear(&tags.Year, string(data))
+	case "gnre":
+		if len(data) >= 2 {
+			tags.Genre = id3v1Genre(int(binary.BigEndian.Uint16(data)) - 1)
+		}
+	case "trkn":
+		if len(data) >= 4 {
+			tags.Track = int(binary.BigEndian.Uint16(data[2:]))
+		}
+	case "disk":
+		if len(data) >= 4 {
+			tags.Disc = int(binary.BigEndian.Uint16(data[2:]))
+		}
+	}
+}
@@ -2,13 +2,19 @@ package mock
 
 import (
 	"bmwctrl/device"
-	"log"
+	"bmwctrl/device/playlist"
+	"bmwctrl/logging"
+	"bmwctrl/options"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/oandrew/ipod/lingo-extremote"
 )
 
+var logger = logging.New("player/mock")
+
 type track struct {
 	artist string
 	album  string
@@ -23,14 +29,16 @@ type list struct {
 }
 
 type mockPlayer struct {
-	selectedList     *list
-	tracks           []track
-	trackIndex       int
-	trackOffset      int
-	state            extremote.PlayerState
-	speed            int
-	notificationMask extremote.Notifications
-	mutex            sync.Mutex
+	playlists    []list
+	selectedList *list
+	tracks       []track
+	trackIndex   int
+	trackOffset  int
+	state        extremote.PlayerState
+	speed        int
+	mutex        sync.Mutex
+	stop         chan struct{}
+	done         chan struct{}
 }
 
 const (
@@ -97,12 +105,63 @@ var categoryListsMap = map[extremote.DBCategoryType]([]list){
 	extremote.DbCategoryPodcast:  podcasts,
 }
 
+func init() {
+	device.Register(device.Backend{
+		Name:        "mock",
+		Description: "A small built in test database, played by a timer (no audio.)",
+		Options: []device.Option{
+			{Name: "playlists", Usage: "A directory of playlist files to add, matched to the test tracks by title"},
+		},
+		New: func(notifications *device.PlayerNotifications, opts options.Options) (device.Player, error) {
+			t := NewPlayer(notifications).(*mockPlayer)
+			if dir := opts.String("playlists", ""); dir != "" {
+				lists, err := playlist.LoadDir(dir)
+				if err != nil {
+					return nil, err
+				}
+				t.addPlaylists(lists)
+			}
+			return t, nil
+		},
+	})
+}
+
 func NewPlayer(notifications *device.PlayerNotifications) device.Player {
-	t := &mockPlayer{}
+	t := &mockPlayer{playlists: playlists, stop: make(chan struct{}), done: make(chan struct{})}
 	go t.runPlayer(notifications)
 	return t
 }
 
+// lists returns the records of a category.
+func (t *mockPlayer) lists(categoryType extremote.DBCategoryType) []list {
+	if categoryType == extremote.DbCategoryPlaylist {
+		return t.playlists
+	}
+	return categoryListsMap[categoryType]
+}
+
+// addPlaylists adds playlists read from files, after the built in ones.
+// Entries are matched to the test tracks by their title in the playlist,
+// or their file name.
+func (t *mockPlayer) addPlaylists(lists []playlist.Playlist) {
+	t.playlists = append([]list(nil), t.playlists...)
+	for _, pl := range lists {
+		l := list{name: pl.Name}
+		for _, entry := range pl.Entries {
+			title := entry.Title
+			if title == "" {
+				title = strings.TrimSuffix(filepath.Base(entry.Path), filepath.Ext(entry.Path))
+			}
+			if track, ok := findTrack(title); ok {
+				l.tracks = append(l.tracks, track)
+			}
+		}
+		if len(l.tracks) > 0 {
+			t.playlists = append(t.playlists, l)
+		}
+	}
+}
+
 func (t *mockPlayer) ResetDBSelection() {
 	t.selectedList = nil
 }
@@ -111,25 +170,25 @@ func (t *mockPlayer) SelectDBRecord(categoryType extremote.DBCategoryType, recor
 	if recordIndex < 0 {
 		t.selectedList = nil
 	} else {
-		t.selectedList = &categoryListsMap[categoryType][recordIndex]
+		t.selectedList = &t.lists(categoryType)[recordIndex]
 	}
 }
 
 func (t *mockPlayer) GetNumberCategorizedDBRecords(categoryType extremote.DBCategoryType) int {
 	if t.selectedList != nil {
 		if categoryType != extremote.DbCategoryTrack {
-			log.Printf("[WARN] Test database engine only supports tracks at the second level, category '%d' was requested.", categoryType)
+			logger.Warn("Test database engine only supports tracks at the second level", "category", categoryType)
 			return 0
 		}
 		return len(t.selectedList.tracks)
 	}
-	return len(categoryListsMap[categoryType])
+	return len(t.lists(categoryType))
 }
 
 func (t *mockPlayer) RetrieveCategorizedDatabaseRecords(categoryType extremote.DBCategoryType, offset int, count int) []string {
 	if t.selectedList != nil {
 		if categoryType != extremote.DbCategoryTrack {
-			log.Printf("[WARN] Test database engine only supports tracks at the second level, category '%d' was requested.", categoryType)
+			logger.Warn("Test database engine only supports tracks at the second level", "category", categoryType)
 			return []string{}
 		}
 		if count < 0 {
@@ -142,7 +201,7 @@ func (t *mockPlayer) RetrieveCategorizedDatabaseRecords(categoryType extremote.D
 		return names
 	}
 
-	list := categoryListsMap[categoryType]
+	list := t.lists(categoryType)
 	if count < 0 {
 		count = len(list)
 	}
@@ -163,10 +222,9 @@ func (t *mockPlayer) GetPlayStatus() (trackLength int, trackOffset int, state ex
 	return trackLength, t.trackOffset, t.state
 }
 
+// SetPlayStatusChangeNotification does nothing, as the notifications the
+// car doesn't want are dropped by device.PlayerNotifications.
 func (t *mockPlayer) SetPlayStatusChangeNotification(notificationMask extremote.Notifications) {
-	defer t.mutex.Unlock()
-	t.mutex.Lock()
-	t.notificationMask = notificationMask
 }
 
 func (t *mockPlayer) PlayControl(cmd extremote.PlayControlCmd) {
@@ -262,9 +320,35 @@ func (t *mockPlayer) SetCurrentPlayingTrack(index int) {
 	t.trackOffset = 0
 }
 
+func (t *mockPlayer) Seek(position int) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+	if t.tracks == nil {
+		return
+	}
+	if length := t.tracks[t.trackIndex].length; position > length {
+		position = length
+	}
+	t.trackOffset = position
+}
+
+func (t *mockPlayer) Close() error {
+	close(t.stop)
+	<-t.done
+	return nil
+}
+
 func (t *mockPlayer) runPlayer(notifications *device.PlayerNotifications) {
+	defer close(t.done)
 	const interval = 500
-	for range time.Tick(interval * time.Millisecond) {
+	ticker := time.NewTicker(interval * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			return
+		}
 		t.mutex.Lock()
 		if t.state == extremote.PlayerStatePlaying {
 			t.trackOffset += (interval * t.speed)
@@ -303,3 +387,67 @@ func (t *mockPlayer) nextTrack() {
 		t.state = extremote.PlayerStateStopped
 	}
 }
+
+// SaveQueue implements device.Resumer.  Tracks are saved by title, which is
+// unique in the test database.
+func (t *mockPlayer) SaveQueue() device.QueueState {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+	queue := device.QueueState{
+		Tracks:   make([]string, len(t.tracks)),
+		Index:    t.trackIndex,
+		Position: t.trackOffset,
+		Playing:  t.state == extremote.PlayerStatePlaying,
+	}
+	for i, track := range t.tracks {
+		queue.Tracks[i] = track.title
+	}
+	return queue
+}
+
+// RestoreQueue implements device.Resumer.  Tracks that are no longer in the
+// test database are left out.
+func (t *mockPlayer) RestoreQueue(queue device.QueueState) {
+	defer t.mutex.Unlock()
+	t.mutex.Lock()
+	t.tracks = nil
+	t.trackIndex = 0
+	t.trackOffset = 0
+	t.state = extremote.PlayerStateStopped
+	t.speed = playSpeedNormal
+	for i, title := range queue.Tracks {
+		track, ok := findTrack(title)
+		if !ok {
+			logger.Warn("Track not found, not restoring it", "title", title)
+			continue
+		}
+		if i == queue.Index {
+			t.trackIndex = len(t.tracks)
+			t.trackOffset = queue.Position
+		}
+		t.tracks = append(t.tracks, track)
+	}
+	if t.tracks == nil {
+		return
+	}
+	if t.trackOffset > t.tracks[t.trackIndex].length {
+		t.trackOffset = 0
+	}
+	t.state = extremote.PlayerStatePaused
+	if queue.Playing {
+		t.state = extremote.PlayerStatePlaying
+	}
+}
+
+func findTrack(title string) (track, bool) {
+	for _, lists := range [][]list{playlists[:1], podcasts} {
+		for _, list := range lists {
+			for _, track := range list.tracks {
+				if track.title == title {
+					return track, true
+				}
+			}
+		}
+	}
+	return track{}, false
+}
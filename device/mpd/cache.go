@@ -0,0 +1,73 @@
+package mpd
+
+import (
+	"bmwctrl/device/index"
+)
+
+// listCache is what's kept on disk between starts: MPD's lists, and the
+// time its database was last updated when they were read.
+type listCache struct {
+	Addr      string
+	ArtistTag string
+	DBUpdate  string
+	Playlists []string
+	Artists   []string
+	Albums    []string
+	Genres    []string
+	Tracks    []string
+}
+
+// loadLists reads the lists of artists, albums, genres and tracks from MPD,
+// or from the cache if MPD's database hasn't been updated since they were
+// cached.  Records keep the order they were cached in (see index.Stable),
+// so the head unit's record indices stay the same after music is added.
+// Playlists are always read, as they change without a database update.
+func (p *mpdPlayer) loadLists(cachePath string) {
+	var cache listCache
+	if cachePath != "" {
+		if _, err := index.Load(cachePath, &cache); err != nil {
+			logger.Warn("Can't read the list cache", "path", cachePath, "err", err)
+		}
+		if cache.Addr != p.addr || cache.ArtistTag != p.artistTag {
+			cache = listCache{}
+		}
+	}
+	stats, err := p.mpc.Stats()
+	check("stats", err)
+	dbUpdate := stats["db_update"]
+	p.playlists = index.Stable(cache.Playlists, p.playlists)
+
+	if dbUpdate != "" && dbUpdate == cache.DBUpdate {
+		logger.Info("MPD database unchanged, using the cached lists", "db_update", dbUpdate)
+		p.artists, p.albums, p.genres, p.tracks = cache.Artists, cache.Albums, cache.Genres, cache.Tracks
+	} else {
+		p.artists, err = p.mpc.List(p.artistTag)
+		check("list", err)
+		p.albums, err = p.mpc.List("album")
+		check("list", err)
+		p.genres, err = p.mpc.List("genre")
+		check("list", err)
+		p.tracks, err = p.mpc.List("title")
+		check("list", err)
+		p.artists = index.Stable(cache.Artists, p.artists)
+		p.albums = index.Stable(cache.Albums, p.albums)
+		p.genres = index.Stable(cache.Genres, p.genres)
+		p.tracks = index.Stable(cache.Tracks, p.tracks)
+	}
+	if cachePath == "" {
+		return
+	}
+	cache = listCache{
+		Addr:      p.addr,
+		ArtistTag: p.artistTag,
+		DBUpdate:  dbUpdate,
+		Playlists: p.playlists,
+		Artists:   p.artists,
+		Albums:    p.albums,
+		Genres:    p.genres,
+		Tracks:    p.tracks,
+	}
+	if err := index.Save(cachePath, cache); err != nil {
+		logger.Warn("Can't save the list cache", "path", cachePath, "err", err)
+	}
+}
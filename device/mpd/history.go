@@ -0,0 +1,42 @@
+package mpd
+
+import (
+	"strconv"
+	"strings"
+
+	"bmwctrl/device"
+)
+
+// GetIndexedPlayingTrackID implements device.TrackIdentifier.  Tracks are
+// identified by their URI in MPD's database.
+func (p *mpdPlayer) GetIndexedPlayingTrackID(index int) string {
+	return p.playingTrackTag(index, "file")
+}
+
+// UseHistory implements device.HistoryUser, for the plays and played fields
+// of smart playlists.
+func (p *mpdPlayer) UseHistory(lookup func(id string) device.TrackHistory) {
+	p.history = lookup
+}
+
+// WriteHistory implements device.HistoryWriter, keeping the history in
+// MPD's stickers too, where other clients can use it.  The sticker names
+// are those myMPD uses: playCount, skipCount and lastPlayed (in Unix
+// time.)  Streams can't have stickers.
+func (p *mpdPlayer) WriteHistory(id string, history device.TrackHistory) {
+	if strings.Contains(id, "://") {
+		return
+	}
+	stickers := map[string]string{
+		"playCount": strconv.Itoa(history.Plays),
+		"skipCount": strconv.Itoa(history.Skips),
+	}
+	if !history.LastPlayed.IsZero() {
+		stickers["lastPlayed"] = strconv.FormatInt(history.LastPlayed.Unix(), 10)
+	}
+	for name, value := range stickers {
+		if check("sticker set", p.mpc.StickerSet(id, name, value)) {
+			return
+		}
+	}
+}
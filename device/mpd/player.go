@@ -2,61 +2,151 @@ package mpd
 
 import (
 	"bmwctrl/device"
-	"log"
+	"bmwctrl/device/playlist"
+	"bmwctrl/device/radio"
+	"bmwctrl/device/smart"
+	"bmwctrl/logging"
+	"bmwctrl/options"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/fhs/gompd/mpd"
 	"github.com/oandrew/ipod/lingo-extremote"
 )
 
-// Set the artist tag to the tag you wish to use for listing artists. Users
-// of Musicbrainz will probably want "AlbumArtist", while others will use the
-// default, if messy, "Artist".
-const artistTag = "AlbumArtist"
+var logger = logging.New("player/mpd")
+
+func init() {
+	device.Register(device.Backend{
+		Name:        "mpd",
+		Description: "Music Player Daemon, playing its library and stored playlists.",
+		Options: []device.Option{
+			{Name: "addr", Default: "127.0.0.1:6600", Usage: "MPD's address, host:port"},
+			// Users of Musicbrainz will probably want "AlbumArtist", while
+			// others will use the default, if messy, "Artist".
+			{Name: "artist-tag", Default: "AlbumArtist", Usage: "The tag artists are listed by"},
+			{Name: "cache", Usage: "A file to cache MPD's lists in, read again only when its database changes"},
+			{Name: "playlists", Usage: "A directory of playlist files (M3U, M3U8, PLS or XSPF) to list after MPD's own"},
+			{Name: "music-dir", Default: "/var/lib/mpd/music", Usage: "MPD's music_directory, to find playlist entries in its database"},
+			{Name: "smart", Usage: "A file of smart playlists, one \"name = rule\" per line"},
+			{Name: "radio", Usage: "A playlist file (M3U, PLS or XSPF) of internet radio stations"},
+			{Name: "radio-playlist", Usage: "A stored playlist of internet radio stations, if there's no file"},
+			{Name: "radio-cd", Default: "podcast", Usage: "The category the radio stations are listed in"},
+		},
+		New: func(notifications *device.PlayerNotifications, opts options.Options) (device.Player, error) {
+			radioCategory, err := device.ParseCategory(opts.String("radio-cd", ""))
+			if err != nil {
+				return nil, err
+			}
+			return NewPlayer(notifications, Config{
+				Addr:      opts.String("addr", ""),
+				ArtistTag: opts.String("artist-tag", ""),
+				Cache:     opts.String("cache", ""),
+				Playlists: opts.String("playlists", ""),
+				MusicDir:  opts.String("music-dir", ""),
+				Smart:     opts.String("smart", ""),
+				Radio:     opts.String("radio", ""),
+				RadioList: opts.String("radio-playlist", ""),
+				RadioCD:   radioCategory,
+			})
+		},
+	})
+}
 
 // mpdPlayer implements the device.Player interface to allow bmwctrl to use
 // a MPD (Music Player Daemon) as a player. Almost all state and data is
 // obtained from the MPD in realtime, with the exception of the "selected
 // db records" (an iPod concept), and the list of playlists, artists, albums,
-// and genres.  The latter are obtained once from the MPD at startup.  This
+// and genres.  The latter are obtained once from the MPD at startup (or
+// from the cache, if MPD's database hasn't changed.)  This
 // doesn't introduce any additional restrictions, as the BMW head unit does
 // not deal with these lists changing very well (i.e. at all.) Note that CD5
-// will always be nil because MPD doesn't have a concept of podcasts (although
-// a custom extension could be constructed using tags.)
+// will be empty unless it lists radio stations, because MPD doesn't have a
+// concept of podcasts (although a custom extension could be constructed
+// using tags.)
 type mpdPlayer struct {
 	mpc       *mpd.Client
-	selected  []mpd.Attrs
-	notifCh   chan extremote.Notifications
-	notifMask extremote.Notifications
+	addr      string
+	artistTag string
+	musicDir  string
+	// Playlists read from files, by name.  They're listed with MPD's own.
+	playlistFiles map[string][]playlist.Entry
+	// Smart playlists, by name.  They're listed last.
+	smartLists map[string]smart.Playlist
+	history    func(id string) device.TrackHistory
+	// Radio stations, listed in place of the radioCD category.
+	stations []radio.Station
+	radioCD  extremote.DBCategoryType
+	selected []mpd.Attrs
+	// Whether run holds back notifications, while a command changes what's
+	// playing.
+	quiet     chan bool
+	scanCh    chan extremote.PlayControlCmd // Fast forward and rewind, for run.
 	artists   []string
 	albums    []string
 	genres    []string
 	tracks    []string
 	playlists []string
+	// The files in the play queue, as last saved, and the MPD playlist
+	// version they were read at.
+	queueFiles   []string
+	queueVersion string
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// Config configures an MPD player.
+type Config struct {
+	Addr      string // MPD's address, host:port.
+	ArtistTag string // The tag artists are listed by.
+	Cache     string // The file MPD's lists are cached in.
+	Playlists string // A directory of playlist files.
+	MusicDir  string // MPD's music_directory.
+	Smart     string // A file of smart playlists (see smart.LoadFile.)
+	Radio     string // A playlist file of radio stations.
+	RadioList string // A stored playlist of radio stations, if there's no file.
+	// The category the radio stations are listed in.
+	RadioCD extremote.DBCategoryType
 }
 
 // NewPlayer creates a new MPD device player.
-func NewPlayer(notifications *device.PlayerNotifications) device.Player {
-	mpc, err := mpd.Dial("tcp", "127.0.0.1:6600")
+func NewPlayer(notifications *device.PlayerNotifications, config Config) (device.Player, error) {
+	mpc, err := mpd.Dial("tcp", config.Addr)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
 	}
-	p := &mpdPlayer{mpc: mpc}
-	playlists, _ := mpc.ListPlaylists()
+	p := &mpdPlayer{mpc: mpc, addr: config.Addr, artistTag: config.ArtistTag, musicDir: config.MusicDir, radioCD: config.RadioCD}
+	playlists, err := mpc.ListPlaylists()
+	check("listplaylists", err)
 	p.playlists = make([]string, len(playlists))
 	for i, playlist := range playlists {
 		p.playlists[i] = playlist["playlist"]
 	}
-	p.artists, _ = mpc.List(artistTag)
-	p.albums, _ = mpc.List("album")
-	p.genres, _ = mpc.List("genre")
-	p.tracks, _ = mpc.List("title")
-	p.notifCh = make(chan extremote.Notifications)
-	log.Printf("[INFO] MPD Player has %d playlists, %d artists, %d albums, %d genres, and %d tracks.",
-		len(p.playlists), len(p.artists), len(p.albums), len(p.genres), len(p.tracks))
+	if config.Playlists != "" {
+		p.loadPlaylistFiles(config.Playlists)
+	}
+	if config.Smart != "" {
+		if err := p.loadSmartPlaylists(config.Smart); err != nil {
+			mpc.Close()
+			return nil, err
+		}
+	}
+	if config.Radio != "" || config.RadioList != "" {
+		if err := p.loadStations(config.Radio, config.RadioList); err != nil {
+			mpc.Close()
+			return nil, err
+		}
+	}
+	p.loadLists(config.Cache)
+	p.quiet = make(chan bool)
+	p.scanCh = make(chan extremote.PlayControlCmd)
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	logger.Info("MPD player ready", "playlists", len(p.playlists), "artists", len(p.artists),
+		"albums", len(p.albums), "genres", len(p.genres), "tracks", len(p.tracks), "stations", len(p.stations))
 	go p.run(notifications)
-	return p
+	return p, nil
 }
 
 func (p *mpdPlayer) ResetDBSelection() {
@@ -66,22 +156,34 @@ func (p *mpdPlayer) ResetDBSelection() {
 func (p *mpdPlayer) SelectDBRecord(categoryType extremote.DBCategoryType, recordIndex int) {
 	if recordIndex < 0 {
 		p.selected = nil
+	} else if p.isRadio(categoryType) {
+		p.selectStation(recordIndex)
 	} else {
+		var err error
 		switch categoryType {
 		case extremote.DbCategoryPlaylist:
-			if recordIndex > 0 {
-				p.selected, _ = p.mpc.PlaylistContents(p.playlists[recordIndex-1])
+			if recordIndex == 0 {
+				p.selected, err = p.mpc.ListAllInfo("/")
+				check("listallinfo", err)
+			} else if list, ok := p.smartLists[p.playlists[recordIndex-1]]; ok {
+				p.selected = p.smartTracks(list)
+			} else if entries, ok := p.playlistFiles[p.playlists[recordIndex-1]]; ok {
+				p.selected = p.playlistFileTracks(entries)
 			} else {
-				p.selected, _ = p.mpc.ListAllInfo("/")
+				p.selected, err = p.mpc.PlaylistContents(p.playlists[recordIndex-1])
+				check("listplaylistinfo", err)
 			}
 		case extremote.DbCategoryArtist:
-			p.selected, _ = p.mpc.Find(artistTag, p.artists[recordIndex])
+			p.selected, err = p.mpc.Find(p.artistTag, p.artists[recordIndex])
+			check("find", err)
 		case extremote.DbCategoryAlbum:
-			p.selected, _ = p.mpc.Find("album", p.albums[recordIndex])
+			p.selected, err = p.mpc.Find("album", p.albums[recordIndex])
+			check("find", err)
 		case extremote.DbCategoryGenre:
-			p.selected, _ = p.mpc.Find("genre", p.genres[recordIndex])
+			p.selected, err = p.mpc.Find("genre", p.genres[recordIndex])
+			check("find", err)
 		default:
-			log.Printf("[WARN] MPD player does not support a category selection of: %d.", categoryType)
+			logger.Warn("Category selection not supported", "category", categoryType)
 		}
 	}
 }
@@ -89,11 +191,14 @@ func (p *mpdPlayer) SelectDBRecord(categoryType extremote.DBCategoryType, record
 func (p *mpdPlayer) GetNumberCategorizedDBRecords(categoryType extremote.DBCategoryType) int {
 	if p.selected != nil {
 		if categoryType != extremote.DbCategoryTrack {
-			log.Printf("[WARN] MPD player only supports tracks at the second level, category '%d' was requested.", categoryType)
+			logger.Warn("Only tracks are supported at the second level", "category", categoryType)
 			return 0
 		}
 		return len(p.selected)
 	}
+	if p.isRadio(categoryType) {
+		return len(p.stations)
+	}
 	switch categoryType {
 	case extremote.DbCategoryPlaylist:
 		return len(p.playlists) + 1
@@ -106,7 +211,7 @@ func (p *mpdPlayer) GetNumberCategorizedDBRecords(categoryType extremote.DBCateg
 	case extremote.DbCategoryTrack:
 		return len(p.tracks)
 	default:
-		log.Printf("[WARN] MPD player does not support counting category: %d.", categoryType)
+		logger.Warn("Counting category not supported", "category", categoryType)
 		return 0
 	}
 }
@@ -114,7 +219,7 @@ func (p *mpdPlayer) GetNumberCategorizedDBRecords(categoryType extremote.DBCateg
 func (p *mpdPlayer) RetrieveCategorizedDatabaseRecords(categoryType extremote.DBCategoryType, offset int, count int) []string {
 	if p.selected != nil {
 		if categoryType != extremote.DbCategoryTrack {
-			log.Printf("[WARN] MPD player only supports tracks at the second level, category '%d' was requested.", categoryType)
+			logger.Warn("Only tracks are supported at the second level", "category", categoryType)
 			return []string{}
 		}
 		if count < 0 {
@@ -126,6 +231,13 @@ func (p *mpdPlayer) RetrieveCategorizedDatabaseRecords(categoryType extremote.DB
 		}
 		return names
 	}
+	if p.isRadio(categoryType) {
+		names := p.stationNames()
+		if count < 0 {
+			count = len(names)
+		}
+		return names[offset : offset+count]
+	}
 	switch categoryType {
 	case extremote.DbCategoryPlaylist:
 		if count < 0 {
@@ -162,7 +274,7 @@ func (p *mpdPlayer) RetrieveCategorizedDatabaseRecords(categoryType extremote.DB
 		}
 		return p.tracks[offset : offset+count]
 	default:
-		log.Printf("[WARN] MPD player does not support retrieving category: %d.", categoryType)
+		logger.Warn("Retrieving category not supported", "category", categoryType)
 		return []string{}
 	}
 }
@@ -172,28 +284,34 @@ func (p *mpdPlayer) GetPlayStatus() (length int, offset int, state extremote.Pla
 	return length, offset, state
 }
 
+// SetPlayStatusChangeNotification does nothing, as the notifications the
+// car doesn't want are dropped by device.PlayerNotifications.
 func (p *mpdPlayer) SetPlayStatusChangeNotification(notificationMask extremote.Notifications) {
-	p.notifMask = notificationMask
-	p.notifCh <- notificationMask
 }
 
 func (p *mpdPlayer) PlayControl(cmd extremote.PlayControlCmd) {
-	var notifOff extremote.Notifications
-	p.notifCh <- notifOff
+	switch cmd {
+	case extremote.PlayControlStartFF, extremote.PlayControlStartRew, extremote.PlayControlEndFFRew:
+		// run scans through the track, and says when it's stopped.
+		p.scanCh <- cmd
+		return
+	}
+	p.quiet <- true
 	switch cmd {
 	case extremote.PlayControlToggle:
-		status, _ := p.mpc.Status()
+		status, err := p.mpc.Status()
+		check("status", err)
 		switch status["state"] {
 		case "play":
-			p.mpc.Pause(true)
+			check("pause", p.mpc.Pause(true))
 		case "pause":
-			p.mpc.Pause(false)
+			check("pause", p.mpc.Pause(false))
 		case "stop":
-			p.mpc.Play(-1)
+			check("play", p.mpc.Play(-1))
 		}
 
 	case extremote.PlayControlStop:
-		p.mpc.Stop()
+		check("stop", p.mpc.Stop())
 
 	case extremote.PlayControlNextTrack:
 		p.nextTrack()
@@ -201,10 +319,6 @@ func (p *mpdPlayer) PlayControl(cmd extremote.PlayControlCmd) {
 	case extremote.PlayControlPrevTrack:
 		p.prevTrack()
 
-	case extremote.PlayControlStartFF:
-	case extremote.PlayControlStartRew:
-	case extremote.PlayControlEndFFRew:
-
 	case extremote.PlayControlNext:
 		p.nextTrack()
 
@@ -212,79 +326,187 @@ func (p *mpdPlayer) PlayControl(cmd extremote.PlayControlCmd) {
 		p.prevTrack()
 
 	case extremote.PlayControlPlay:
-		p.mpc.Play(-1)
+		check("play", p.mpc.Play(-1))
 
 	case extremote.PlayControlPause:
-		p.mpc.Pause(true)
+		check("pause", p.mpc.Pause(true))
 	}
-	p.notifCh <- p.notifMask
+	p.quiet <- false
 }
 
 func (p *mpdPlayer) PlayCurrentSelection(index int) {
-	var notifOff extremote.Notifications
-	p.notifCh <- notifOff
+	p.quiet <- true
 	if p.selected != nil {
-		p.mpc.Clear()
+		check("clear", p.mpc.Clear())
 		for _, track := range p.selected {
-			p.mpc.Add(track["file"])
+			check("add", p.mpc.Add(track["file"]))
 		}
 	}
-	p.mpc.Play(index)
-	p.notifCh <- p.notifMask
+	check("play", p.mpc.Play(index))
+	p.quiet <- false
 }
 
 func (p *mpdPlayer) GetNumPlayingTracks() int {
-	status, _ := p.mpc.Status()
+	status, err := p.mpc.Status()
+	check("status", err)
 	length, _ := strconv.ParseUint(status["playlistlength"], 10, 8)
 	return int(length)
 }
 
 func (p *mpdPlayer) GetCurrentPlayingTrackIndex() int {
-	status, _ := p.mpc.Status()
+	status, err := p.mpc.Status()
+	check("status", err)
 	song, _ := strconv.ParseUint(status["song"], 10, 8)
 	return int(song)
 }
 
+// GetIndexedPlayingTrackTitle returns a track's title.  For a stream, MPD
+// gives the ICY stream title as the title, and the station as the name; the
+// URL is the last resort.
 func (p *mpdPlayer) GetIndexedPlayingTrackTitle(index int) string {
-	info, _ := p.mpc.PlaylistInfo(index, -1)
-	return info[0]["Title"]
+	info, err := p.mpc.PlaylistInfo(index, -1)
+	if check("playlistinfo", err) || len(info) == 0 {
+		return ""
+	}
+	for _, tag := range []string{"Title", "Name", "file"} {
+		if info[0][tag] != "" {
+			return info[0][tag]
+		}
+	}
+	return ""
 }
 
 func (p *mpdPlayer) GetIndexedPlayingTrackArtistName(index int) string {
-	info, _ := p.mpc.PlaylistInfo(index, -1)
-	return info[0][artistTag]
+	return p.playingTrackTag(index, p.artistTag)
 }
 
 func (p *mpdPlayer) GetIndexedPlayingTrackAlbumName(index int) string {
-	info, _ := p.mpc.PlaylistInfo(index, -1)
-	return info[0]["Album"]
+	return p.playingTrackTag(index, "Album")
 }
 
 func (p *mpdPlayer) SetCurrentPlayingTrack(index int) {
-	p.mpc.Play(index)
+	check("play", p.mpc.Play(index))
+}
+
+func (p *mpdPlayer) Seek(position int) {
+	check("seekcur", p.mpc.SeekCur(time.Duration(position)*time.Millisecond, false))
+}
+
+// playingTrackTag returns a tag of a track in the play queue, or "" if the
+// track can't be read.
+func (p *mpdPlayer) playingTrackTag(index int, tag string) string {
+	info, err := p.mpc.PlaylistInfo(index, -1)
+	if check("playlistinfo", err) || len(info) == 0 {
+		return ""
+	}
+	return info[0][tag]
+}
+
+// SaveQueue implements device.Resumer.  Tracks are saved by file, and the
+// files are only read again when MPD's play queue has changed.
+func (p *mpdPlayer) SaveQueue() device.QueueState {
+	status, err := p.mpc.Status()
+	if check("status", err) {
+		return device.QueueState{Tracks: p.queueFiles}
+	}
+	if version := status["playlist"]; version != p.queueVersion {
+		info, err := p.mpc.PlaylistInfo(-1, -1)
+		if !check("playlistinfo", err) {
+			p.queueFiles = make([]string, len(info))
+			for i, track := range info {
+				p.queueFiles[i] = track["file"]
+			}
+			p.queueVersion = version
+		}
+	}
+	song, _ := strconv.Atoi(status["song"])
+	elapsed, _ := strconv.ParseFloat(status["elapsed"], 64)
+	return device.QueueState{
+		Tracks:   p.queueFiles,
+		Index:    song,
+		Position: int(elapsed * 1000),
+		Playing:  status["state"] == "play",
+	}
+}
+
+// RestoreQueue implements device.Resumer.  MPD may have kept its own state
+// across the restart, so the play queue is only replaced if it differs.  If
+// MPD is already playing it is left alone.
+func (p *mpdPlayer) RestoreQueue(queue device.QueueState) {
+	current := p.SaveQueue()
+	if current.Playing {
+		logger.Info("MPD is already playing, not restoring the play queue")
+		return
+	}
+	p.quiet <- true
+	defer func() { p.quiet <- false }()
+	if !sameFiles(current.Tracks, queue.Tracks) {
+		check("clear", p.mpc.Clear())
+		for _, file := range queue.Tracks {
+			check("add", p.mpc.Add(file))
+		}
+	}
+	if len(queue.Tracks) == 0 {
+		return
+	}
+	position := time.Duration(queue.Position) * time.Millisecond
+	check("seek", p.mpc.Seek(queue.Index, int(position.Seconds())))
+	if !queue.Playing {
+		check("pause", p.mpc.Pause(true))
+	}
+}
+
+func sameFiles(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Close stops watching MPD for changes, and disconnects from it.  MPD
+// carries on playing, or not, as it was.
+func (p *mpdPlayer) Close() error {
+	close(p.stop)
+	<-p.done
+	return p.mpc.Close()
 }
 
 func (p *mpdPlayer) run(notifications *device.PlayerNotifications) {
+	defer close(p.done)
 	const interval = 500
 	ticker := time.NewTicker(interval * time.Millisecond)
-	watcher, _ := mpd.NewWatcher("tcp", "127.0.0.1:6600", "", "player")
+	defer ticker.Stop()
+	watcher, _ := mpd.NewWatcher("tcp", p.addr, "", "player")
 	defer watcher.Close()
 
 	var song int
 	var offset int
 	var state extremote.PlayerState
-	var notif extremote.Notifications
+	var quiet bool
+	scan := &scanner{
+		notifications: notifications,
+		seek:          func(to time.Duration) error { return p.mpc.SeekCur(to, false) },
+		next:          p.nextTrack,
+	}
 	update := func() {
+		if quiet {
+			return
+		}
 		newSong, _, newOffset, newState := p.getPlayStatus()
-		if notif.TrackIndex && newSong != song {
+		if newSong != song {
 			notifications.TrackIndexChanged(newSong)
 			song = newSong
 		}
-		if notif.TrackTimeOffset && newOffset != offset {
+		if newOffset != offset {
 			notifications.TrackTimeOffset(newOffset)
 			offset = newOffset
 		}
-		if notif.PlaybackStopped && newState != state {
+		if newState != state {
 			if newState != extremote.PlayerStatePlaying {
 				notifications.PlaybackStopped()
 			}
@@ -293,23 +515,45 @@ func (p *mpdPlayer) run(notifications *device.PlayerNotifications) {
 	}
 	for {
 		select {
-		case notif = <-p.notifCh:
+		case quiet = <-p.quiet:
+		case cmd := <-p.scanCh:
+			if cmd == extremote.PlayControlEndFFRew {
+				scan.end()
+			} else {
+				scan.start(cmd, time.Now())
+				_, length, position, _ := p.getPlayStatus()
+				scan.step(time.Now(), length, position)
+			}
 		case <-watcher.Event:
 			update()
 		case <-ticker.C:
+			if scan.cmd != 0 {
+				_, length, position, _ := p.getPlayStatus()
+				scan.step(time.Now(), length, position)
+			}
 			update()
+		case <-p.stop:
+			return
 		}
 	}
 }
 
 func (p *mpdPlayer) getPlayStatus() (track int, length int, offset int, state extremote.PlayerState) {
-	status, _ := p.mpc.Status()
+	status, err := p.mpc.Status()
+	check("status", err)
 
 	mpdSong, _ := strconv.ParseUint(status["song"], 10, 8)
 	track = int(mpdSong)
 
-	mpdLength, _ := strconv.ParseUint(status["length"], 10, 8)
-	length = int(mpdLength) * 1000
+	// MPD gives no duration for a stream, which doesn't end.
+	duration, err := strconv.ParseFloat(status["duration"], 64)
+	if err != nil {
+		// Before MPD 0.20 there's only "time", "elapsed:duration" in seconds.
+		if i := strings.IndexByte(status["time"], ':'); i >= 0 {
+			duration, _ = strconv.ParseFloat(status["time"][i+1:], 64)
+		}
+	}
+	length = int(duration * 1000)
 
 	mpdElapsed, _ := strconv.ParseFloat(status["elapsed"], 8)
 	offset = int(mpdElapsed * 1000)
@@ -322,18 +566,94 @@ func (p *mpdPlayer) getPlayStatus() (track int, length int, offset int, state ex
 	case "stop":
 		state = extremote.PlayerStateStopped
 	}
+	if length == 0 && state != extremote.PlayerStateStopped {
+		length = int(radio.Length / time.Millisecond)
+	}
 	return track, length, offset, state
 }
 
+// scanner moves on (or back) through the track while fast forward or rewind
+// is held, and says when it's stopped.
+type scanner struct {
+	cmd           extremote.PlayControlCmd // StartFF or StartRew while scanning.
+	started       time.Time
+	notifications *device.PlayerNotifications
+	seek          func(to time.Duration) error // Within the current track.
+	next          func()                       // Skips to the next track.
+}
+
+// start starts scanning, ending a scan in the other direction first.
+func (s *scanner) start(cmd extremote.PlayControlCmd, now time.Time) {
+	s.end()
+	s.cmd, s.started = cmd, now
+}
+
+// end stops scanning, if it was.
+func (s *scanner) end() {
+	if s.cmd == extremote.PlayControlStartFF {
+		s.notifications.PlaybackFFWSeekStopped()
+	} else if s.cmd == extremote.PlayControlStartRew {
+		s.notifications.PlaybackREWSeekStopped()
+	}
+	s.cmd = 0
+}
+
+// step moves through the track from position (in milliseconds), ending at
+// either end of it.
+func (s *scanner) step(now time.Time, length int, position int) {
+	to := scanStep(now.Sub(s.started))
+	if s.cmd == extremote.PlayControlStartRew {
+		to = -to
+	}
+	to += time.Duration(position) * time.Millisecond
+	switch {
+	case to <= 0:
+		check("seekcur", s.seek(0))
+		s.end()
+	case length > 0 && to >= time.Duration(length)*time.Millisecond:
+		s.next()
+		s.end()
+	default:
+		if check("seekcur", s.seek(to)) {
+			// e.g. a stream, which can't be sought.
+			s.end()
+		}
+	}
+}
+
+// scanStep is how far fast forward and rewind move every half second: the
+// longer they're held, the further.
+func scanStep(held time.Duration) time.Duration {
+	switch {
+	case held < 2*time.Second:
+		return 2 * time.Second
+	case held < 6*time.Second:
+		return 5 * time.Second
+	default:
+		return 15 * time.Second
+	}
+}
+
 func (p *mpdPlayer) prevTrack() {
 	track, _, offset, _ := p.getPlayStatus()
 	if offset < 2000 && track > 0 {
-		p.mpc.Previous()
+		check("previous", p.mpc.Previous())
 	} else {
-		p.mpc.SeekCur(0, false)
+		check("seekcur", p.mpc.SeekCur(0, false))
 	}
 }
 
 func (p *mpdPlayer) nextTrack() {
-	p.mpc.Next()
+	check("next", p.mpc.Next())
+}
+
+// check logs and counts an error from MPD, and reports whether there was
+// one.
+func check(op string, err error) bool {
+	if err == nil {
+		return false
+	}
+	logger.Warn("MPD request failed", "op", op, "err", err)
+	device.CountError("mpd", op)
+	return true
 }
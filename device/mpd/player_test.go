@@ -1,24 +1,131 @@
 package mpd
 
 import (
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
+	"bmwctrl/device"
+
+	"github.com/oandrew/ipod"
 	"github.com/oandrew/ipod/lingo-extremote"
 )
 
+func newPlayer(t *testing.T) device.Player {
+	p, err := NewPlayer(nil, Config{Addr: "127.0.0.1:6600", ArtistTag: "AlbumArtist"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
 func TestPlayer(t *testing.T) {
 
 }
 
 func TestRetrieveCategorizedDatabaseRecords(t *testing.T) {
-	p := NewPlayer(nil)
+	p := newPlayer(t)
 	a := p.RetrieveCategorizedDatabaseRecords(extremote.DbCategoryArtist, 1, 2)
 	fmt.Print(a)
 }
 
 func TestSelectDBRecord(t *testing.T) {
-	p := NewPlayer(nil)
+	p := newPlayer(t)
 	p.SelectDBRecord(extremote.DbCategoryArtist, 4)
 	p.PlayCurrentSelection(0)
 }
+
+func TestScanStep(t *testing.T) {
+	var last time.Duration
+	for _, held := range []time.Duration{0, time.Second, 3 * time.Second, 10 * time.Second, time.Minute} {
+		step := scanStep(held)
+		if step < last {
+			t.Errorf("held for %v, step %v is less than %v", held, step, last)
+		}
+		last = step
+	}
+}
+
+type recordingWriter struct {
+	sent []interface{}
+}
+
+func (w *recordingWriter) WriteCommand(cmd *ipod.Command) error {
+	w.sent = append(w.sent, cmd.Payload)
+	return nil
+}
+
+func TestScanner(t *testing.T) {
+	w := &recordingWriter{}
+	notifications := device.NewPlayerNotifications(w)
+	notifications.SetMask(extremote.Notifications{PlaybackFFWSeekStop: true, PlaybackREWSeekStop: true})
+	var seeks []time.Duration
+	var seekErr error
+	nexts := 0
+	s := &scanner{
+		notifications: notifications,
+		seek:          func(to time.Duration) error { seeks = append(seeks, to); return seekErr },
+		next:          func() { nexts++ },
+	}
+	stopped := func() byte {
+		if len(w.sent) != 1 {
+			t.Fatalf("sent %v", w.sent)
+		}
+		n, ok := w.sent[0].(*extremote.PlayStatusChangeNotification)
+		if !ok {
+			t.Fatalf("sent %#v", w.sent[0])
+		}
+		w.sent = nil
+		return n.Status
+	}
+	now := time.Now()
+
+	// Fast forward from a minute in, further the longer it's held.
+	s.start(extremote.PlayControlStartFF, now)
+	s.step(now, 180000, 60000)
+	s.step(now.Add(10*time.Second), 180000, 62000)
+	if len(seeks) != 2 || seeks[0] != 62*time.Second || seeks[1] != 77*time.Second || len(w.sent) != 0 {
+		t.Errorf("seeks %v, sent %v", seeks, w.sent)
+	}
+
+	// Rewinding instead ends fast forward.
+	s.start(extremote.PlayControlStartRew, now)
+	if status := stopped(); status != 0x02 {
+		t.Errorf("status %#x, want fast forward stopped", status)
+	}
+	// Rewind stops at the start of the track.
+	seeks = nil
+	s.step(now, 180000, 1000)
+	if len(seeks) != 1 || seeks[0] != 0 || s.cmd != 0 {
+		t.Errorf("seeks %v, scanning %v", seeks, s.cmd)
+	}
+	if status := stopped(); status != 0x03 {
+		t.Errorf("status %#x, want rewind stopped", status)
+	}
+
+	// Fast forward past the end goes on to the next track.
+	seeks = nil
+	s.start(extremote.PlayControlStartFF, now)
+	s.step(now, 180000, 179000)
+	if len(seeks) != 0 || nexts != 1 || s.cmd != 0 {
+		t.Errorf("seeks %v, %d nexts, scanning %v", seeks, nexts, s.cmd)
+	}
+	if status := stopped(); status != 0x02 {
+		t.Errorf("status %#x, want fast forward stopped", status)
+	}
+
+	// A stream can't be sought, which ends the scan.
+	seekErr = errors.New("not seekable")
+	s.start(extremote.PlayControlStartFF, now)
+	s.step(now, 0, 5000)
+	if status := stopped(); status != 0x02 || s.cmd != 0 {
+		t.Errorf("status %#x, scanning %v", status, s.cmd)
+	}
+
+	// Ending when not scanning sends nothing.
+	s.end()
+	if len(w.sent) != 0 {
+		t.Errorf("sent %v", w.sent)
+	}
+}
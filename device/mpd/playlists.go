@@ -0,0 +1,74 @@
+package mpd
+
+import (
+	"path/filepath"
+	"strings"
+
+	"bmwctrl/device/playlist"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// loadPlaylistFiles reads the playlist files in dir, to be listed after
+// MPD's stored playlists.  A file with the same name as a stored playlist
+// is left out.
+func (p *mpdPlayer) loadPlaylistFiles(dir string) {
+	lists, err := playlist.LoadDir(dir)
+	if err != nil {
+		logger.Warn("Can't read the playlist directory", "dir", dir, "err", err)
+	}
+	stored := make(map[string]bool, len(p.playlists))
+	for _, name := range p.playlists {
+		stored[name] = true
+	}
+	p.playlistFiles = make(map[string][]playlist.Entry)
+	for _, list := range lists {
+		if stored[list.Name] || p.playlistFiles[list.Name] != nil {
+			logger.Warn("Playlist name already used, leaving it out", "playlist", list.Path)
+			continue
+		}
+		if len(list.Entries) == 0 {
+			continue
+		}
+		p.playlistFiles[list.Name] = list.Entries
+		p.playlists = append(p.playlists, list.Name)
+	}
+}
+
+// uri returns the MPD URI of a playlist entry: a URL as it is, or a path
+// relative to MPD's music directory.  Files outside the music directory are
+// given by absolute path, which MPD only accepts over a local socket.
+func (p *mpdPlayer) uri(entry playlist.Entry) string {
+	if entry.IsURL() {
+		return entry.Path
+	}
+	if rel, err := filepath.Rel(p.musicDir, entry.Path); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return filepath.ToSlash(rel)
+	}
+	return entry.Path
+}
+
+// playlistFileTracks looks up a playlist file's entries in MPD's database,
+// leaving out those it doesn't have.  URLs (e.g. streams) are kept, with
+// the playlist's title.
+func (p *mpdPlayer) playlistFileTracks(entries []playlist.Entry) []mpd.Attrs {
+	var tracks []mpd.Attrs
+	for _, entry := range entries {
+		uri := p.uri(entry)
+		if entry.IsURL() {
+			title := entry.Title
+			if title == "" {
+				title = uri
+			}
+			tracks = append(tracks, mpd.Attrs{"file": uri, "Title": title})
+			continue
+		}
+		info, err := p.mpc.ListAllInfo(uri)
+		if check("listallinfo", err) || len(info) == 0 {
+			logger.Debug("Playlist entry not in MPD's database", "uri", uri)
+			continue
+		}
+		tracks = append(tracks, info[0])
+	}
+	return tracks
+}
@@ -0,0 +1,66 @@
+package mpd
+
+import (
+	"bmwctrl/device/radio"
+
+	"github.com/fhs/gompd/mpd"
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+// loadStations reads the radio stations from a playlist file, or failing
+// that from one of MPD's stored playlists.  MPD plays the streams itself,
+// and takes the stream title from their ICY metadata.
+func (p *mpdPlayer) loadStations(file string, stored string) error {
+	if file != "" {
+		stations, err := radio.LoadStations(file)
+		if err != nil {
+			return err
+		}
+		p.stations = stations
+		return nil
+	}
+	contents, err := p.mpc.PlaylistContents(stored)
+	if err != nil {
+		return err
+	}
+	for _, entry := range contents {
+		if !radio.IsStream(entry["file"]) {
+			logger.Warn("Not a stream, leaving it out", "playlist", stored, "entry", entry["file"])
+			continue
+		}
+		name := entry["Name"]
+		if name == "" {
+			name = entry["Title"]
+		}
+		if name == "" {
+			name = entry["file"]
+		}
+		p.stations = append(p.stations, radio.Station{Name: name, URL: entry["file"]})
+	}
+	return nil
+}
+
+// isRadio reports whether a category lists the radio stations, in place of
+// its own records.
+func (p *mpdPlayer) isRadio(categoryType extremote.DBCategoryType) bool {
+	return p.stations != nil && categoryType == p.radioCD
+}
+
+// stationNames returns the names of the radio stations.
+func (p *mpdPlayer) stationNames() []string {
+	names := make([]string, len(p.stations))
+	for i, station := range p.stations {
+		names[i] = station.Name
+	}
+	return names
+}
+
+// selectStation selects a radio station as a single track.
+func (p *mpdPlayer) selectStation(recordIndex int) {
+	if recordIndex >= len(p.stations) {
+		logger.Warn("Selected record doesn't exist", "category", p.radioCD, "index", recordIndex)
+		return
+	}
+	station := p.stations[recordIndex]
+	p.selected = []mpd.Attrs{{"file": station.URL, "Title": station.Name}}
+}
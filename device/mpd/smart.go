@@ -0,0 +1,104 @@
+package mpd
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"bmwctrl/device/smart"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// loadSmartPlaylists reads smart playlists from a file, to be listed after
+// the other playlists.  A smart playlist with the same name as another
+// playlist is left out.
+func (p *mpdPlayer) loadSmartPlaylists(path string) error {
+	lists, err := smart.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	used := make(map[string]bool, len(p.playlists))
+	for _, name := range p.playlists {
+		used[name] = true
+	}
+	p.smartLists = make(map[string]smart.Playlist)
+	for _, list := range lists {
+		if used[list.Name] {
+			logger.Warn("Playlist name already used, leaving out the smart playlist", "playlist", list.Name)
+			continue
+		}
+		used[list.Name] = true
+		p.smartLists[list.Name] = list
+		p.playlists = append(p.playlists, list.Name)
+	}
+	return nil
+}
+
+// smartTracks returns the tracks in MPD's database a smart playlist holds
+// now.
+func (p *mpdPlayer) smartTracks(list smart.Playlist) []mpd.Attrs {
+	all, err := p.mpc.ListAllInfo("/")
+	if check("listallinfo", err) {
+		return []mpd.Attrs{}
+	}
+	var files []mpd.Attrs
+	var tracks []smart.Track
+	for _, attrs := range all {
+		if attrs["file"] == "" {
+			continue // A directory.
+		}
+		t := smartTrack(attrs)
+		if p.history != nil {
+			h := p.history(t.Path)
+			t.Plays, t.LastPlayed = h.Plays, h.LastPlayed
+		}
+		files = append(files, attrs)
+		tracks = append(tracks, t)
+	}
+	selected := []mpd.Attrs{}
+	for _, i := range list.Select(tracks, time.Now()) {
+		selected = append(selected, files[i])
+	}
+	return selected
+}
+
+// smartTrack gives the tags of a file in MPD's database to the rules.
+// Files are added when MPD first sees them (MPD 0.24 and later) or, before
+// that, when they were last modified.
+func smartTrack(attrs mpd.Attrs) smart.Track {
+	number := func(value string) int {
+		if i := strings.IndexByte(value, '/'); i >= 0 {
+			value = value[:i]
+		}
+		n, _ := strconv.Atoi(strings.TrimSpace(value))
+		return n
+	}
+	t := smart.Track{
+		Path:        attrs["file"],
+		Title:       attrs["Title"],
+		Artist:      attrs["Artist"],
+		AlbumArtist: attrs["AlbumArtist"],
+		Album:       attrs["Album"],
+		Genre:       attrs["Genre"],
+		Track:       number(attrs["Track"]),
+		Disc:        number(attrs["Disc"]),
+	}
+	if t.AlbumArtist == "" {
+		t.AlbumArtist = t.Artist
+	}
+	if date := attrs["Date"]; len(date) >= 4 {
+		t.Year = number(date[:4])
+	}
+	if seconds, err := strconv.ParseFloat(attrs["duration"], 64); err == nil {
+		t.Length = time.Duration(seconds * float64(time.Second))
+	} else if seconds, err := strconv.Atoi(attrs["Time"]); err == nil {
+		t.Length = time.Duration(seconds) * time.Second
+	}
+	added := attrs["Added"]
+	if added == "" {
+		added = attrs["Last-Modified"]
+	}
+	t.Added, _ = time.Parse(time.RFC3339, added)
+	return t
+}
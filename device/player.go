@@ -1,6 +1,11 @@
 package device
 
 import (
+	"sync"
+	"time"
+
+	"bmwctrl/metrics"
+
 	"github.com/oandrew/ipod"
 	"github.com/oandrew/ipod/lingo-extremote"
 )
@@ -24,23 +29,110 @@ type Player interface {
 	GetIndexedPlayingTrackArtistName(index int) string
 	GetIndexedPlayingTrackAlbumName(index int) string
 	SetCurrentPlayingTrack(index int)
+
+	// Seek moves to a position in the playing track, in milliseconds.
+	Seek(position int)
+
+	// Close stops the player's background work, and releases its
+	// connections.  The player isn't used after it is closed.
+	Close() error
+}
+
+// QueueState is a player's play queue and position, saved so that playback
+// can resume where it left off after the Pi loses power.
+type QueueState struct {
+	Tracks   []string `json:"tracks"`   // Player specific IDs of the tracks (e.g. MPD file paths.)
+	Index    int      `json:"index"`    // Index of the playing track.
+	Position int      `json:"position"` // Position in the playing track, in milliseconds.
+	Playing  bool     `json:"playing"`
+}
+
+// Resumer is implemented by players that can save and restore their play
+// queue.
+type Resumer interface {
+	SaveQueue() QueueState
+	RestoreQueue(queue QueueState)
+}
+
+// TrackIdentifier is implemented by players that can identify the tracks in
+// the play queue (e.g. by file), so history is kept for the right track.
+// Without it, tracks are identified by artist, album and title.
+type TrackIdentifier interface {
+	GetIndexedPlayingTrackID(index int) string
+}
+
+// TrackHistory is how a track has been listened to.
+type TrackHistory struct {
+	Plays      int       `json:"plays"`
+	Skips      int       `json:"skips"`
+	LastPlayed time.Time `json:"last_played"`
+}
+
+// HistoryUser is implemented by players that use the listening history,
+// e.g. for smart playlists.  UseHistory is called before the player is used.
+type HistoryUser interface {
+	UseHistory(lookup func(id string) TrackHistory)
 }
 
+// HistoryWriter is implemented by players that keep the listening history
+// themselves as well, e.g. in MPD's stickers.
+type HistoryWriter interface {
+	WriteHistory(id string, history TrackHistory)
+}
+
+var playerErrors = metrics.NewCounterVec("bmwctrl_player_errors_total",
+	"Errors from the player's backend (e.g. MPD), by operation.", "player", "op")
+
+// CountError counts an error from a player's backend.
+func CountError(player, op string) {
+	playerErrors.With(player, op).Inc()
+}
+
+// PlayerNotifications sends the car the play status changes it has asked
+// for with SetPlayStatusChangeNotification.  Players report every change,
+// and those the car hasn't asked for are dropped here, so that every player
+// behaves the same.  A nil PlayerNotifications sends nothing.
 type PlayerNotifications struct {
 	cmdWriter ipod.CommandWriter
+	mutex     sync.Mutex
+	mask      extremote.Notifications
 }
 
 func NewPlayerNotifications(cmdWriter ipod.CommandWriter) *PlayerNotifications {
-	return &PlayerNotifications{cmdWriter}
+	return &PlayerNotifications{cmdWriter: cmdWriter}
+}
+
+// SetMask sets the notifications the car wants.  None are sent until it
+// asks for them.
+func (n *PlayerNotifications) SetMask(mask extremote.Notifications) {
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+	n.mask = mask
+}
+
+// Mask returns the notifications the car wants.
+func (n *PlayerNotifications) Mask() extremote.Notifications {
+	if n == nil {
+		return extremote.Notifications{}
+	}
+	defer n.mutex.Unlock()
+	n.mutex.Lock()
+	return n.mask
 }
 
 func (n *PlayerNotifications) PlaybackStopped() {
+	if !n.Mask().PlaybackStopped {
+		return
+	}
 	ipod.Send(n.cmdWriter, &extremote.PlayStatusChangeNotification{
 		Status: 0x00,
 	})
 }
 
 func (n *PlayerNotifications) TrackIndexChanged(index int) {
+	if !n.Mask().TrackIndex {
+		return
+	}
 	ipod.Send(n.cmdWriter, &extremote.TrackIndexChangeNotification{
 		Status: 0x01,
 		Index:  uint32(index),
@@ -48,20 +140,41 @@ func (n *PlayerNotifications) TrackIndexChanged(index int) {
 }
 
 func (n *PlayerNotifications) PlaybackFFWSeekStopped() {
+	if !n.Mask().PlaybackFFWSeekStop {
+		return
+	}
 	ipod.Send(n.cmdWriter, &extremote.PlayStatusChangeNotification{
 		Status: 0x02,
 	})
 }
 
 func (n *PlayerNotifications) PlaybackREWSeekStopped() {
+	if !n.Mask().PlaybackREWSeekStop {
+		return
+	}
 	ipod.Send(n.cmdWriter, &extremote.PlayStatusChangeNotification{
 		Status: 0x03,
 	})
 }
 
 func (n *PlayerNotifications) TrackTimeOffset(offset int) {
+	if !n.Mask().TrackTimeOffset {
+		return
+	}
 	ipod.Send(n.cmdWriter, &extremote.TrackTimeOffsetChangeNotification{
 		Status: 0x04,
 		Offset: uint32(offset),
 	})
 }
+
+// ChapterIndexChanged reports a move to another chapter of the playing
+// track.  The notification is laid out like a track index change.
+func (n *PlayerNotifications) ChapterIndexChanged(index int) {
+	if !n.Mask().ChapterIndex {
+		return
+	}
+	ipod.Send(n.cmdWriter, &extremote.TrackIndexChangeNotification{
+		Status: 0x05,
+		Index:  uint32(index),
+	})
+}
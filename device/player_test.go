@@ -0,0 +1,62 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+type recordingWriter struct {
+	sent []interface{}
+}
+
+func (w *recordingWriter) WriteCommand(cmd *ipod.Command) error {
+	w.sent = append(w.sent, cmd.Payload)
+	return nil
+}
+
+func TestPlayerNotifications(t *testing.T) {
+	w := &recordingWriter{}
+	n := NewPlayerNotifications(w)
+	sendAll := func() {
+		n.PlaybackStopped()
+		n.TrackIndexChanged(3)
+		n.PlaybackFFWSeekStopped()
+		n.PlaybackREWSeekStopped()
+		n.TrackTimeOffset(1000)
+		n.ChapterIndexChanged(2)
+	}
+
+	// Nothing is sent until the car asks for it.
+	sendAll()
+	if len(w.sent) != 0 {
+		t.Errorf("sent %v before the mask was set", w.sent)
+	}
+
+	n.SetMask(extremote.Notifications{TrackIndex: true, PlaybackREWSeekStop: true})
+	sendAll()
+	if len(w.sent) != 2 {
+		t.Fatalf("sent %v", w.sent)
+	}
+	if index, ok := w.sent[0].(*extremote.TrackIndexChangeNotification); !ok || index.Status != 0x01 || index.Index != 3 {
+		t.Errorf("sent %#v, want the track index", w.sent[0])
+	}
+	if rew, ok := w.sent[1].(*extremote.PlayStatusChangeNotification); !ok || rew.Status != 0x03 {
+		t.Errorf("sent %#v, want rewind stopped", w.sent[1])
+	}
+
+	w.sent = nil
+	n.SetMask(extremote.Notifications{ChapterIndex: true})
+	sendAll()
+	if len(w.sent) != 1 {
+		t.Fatalf("sent %v", w.sent)
+	}
+	if chapter, ok := w.sent[0].(*extremote.TrackIndexChangeNotification); !ok || chapter.Status != 0x05 || chapter.Index != 2 {
+		t.Errorf("sent %#v, want the chapter index", w.sent[0])
+	}
+
+	// A nil PlayerNotifications sends nothing.
+	var none *PlayerNotifications
+	none.TrackIndexChanged(1)
+}
@@ -0,0 +1,245 @@
+// Package playlist reads playlist files (M3U, M3U8, PLS and XSPF), for
+// players to offer as CDs alongside their own playlists.
+package playlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"bmwctrl/logging"
+)
+
+var logger = logging.New("playlist")
+
+// Playlist is a playlist file's entries, in order.
+type Playlist struct {
+	Name    string // The file name, without the extension.
+	Path    string
+	Entries []Entry
+	Missing int // Entries left out because their files don't exist.
+}
+
+// Entry is a track in a playlist: a local file, or a URL (e.g. a stream.)
+type Entry struct {
+	Path  string // Absolute and cleaned, for a local file.
+	Title string // The title given by the playlist, if any.
+}
+
+// IsURL reports whether the entry is a URL rather than a local file.
+func (e Entry) IsURL() bool {
+	return strings.Contains(e.Path, "://")
+}
+
+// Extensions are the file types Load reads.
+var Extensions = map[string]bool{".m3u": true, ".m3u8": true, ".pls": true, ".xspf": true}
+
+// Load reads a playlist file.  Relative paths are resolved against the
+// playlist's directory, and local files that don't exist are left out.
+func Load(path string) (Playlist, error) {
+	list := Playlist{
+		Name: strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)),
+		Path: path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return list, err
+	}
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+	var entries []Entry
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".m3u", ".m3u8":
+		// Plain .m3u files are often Latin-1.
+		if ext == ".m3u" && !utf8.Valid(data) {
+			data = latin1(data)
+		}
+		entries = parseM3U(data)
+	case ".pls":
+		entries, err = parsePLS(data)
+	case ".xspf":
+		entries, err = parseXSPF(data)
+	default:
+		err = fmt.Errorf("unknown playlist type '%s'", ext)
+	}
+	if err != nil {
+		return list, fmt.Errorf("%s: %s", path, err)
+	}
+	dir := filepath.Dir(path)
+	for _, entry := range entries {
+		if !resolve(&entry, dir) {
+			continue
+		}
+		if !entry.IsURL() {
+			if _, err := os.Stat(entry.Path); err != nil {
+				logger.Debug("Playlist entry not found", "playlist", path, "entry", entry.Path)
+				list.Missing++
+				continue
+			}
+		}
+		list.Entries = append(list.Entries, entry)
+	}
+	return list, nil
+}
+
+// LoadDir reads every playlist file in dir (and below it), sorted by name.
+// Files that can't be read are logged and left out.
+func LoadDir(dir string) ([]Playlist, error) {
+	var lists []Playlist
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !Extensions[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		list, err := Load(path)
+		if err != nil {
+			logger.Warn("Can't read playlist", "err", err)
+			return nil
+		}
+		if list.Missing > 0 {
+			logger.Info("Playlist has missing files", "playlist", path, "missing", list.Missing)
+		}
+		lists = append(lists, list)
+		return nil
+	})
+	sort.SliceStable(lists, func(i, j int) bool {
+		return strings.ToLower(lists[i].Name) < strings.ToLower(lists[j].Name)
+	})
+	return lists, err
+}
+
+// resolve turns an entry's location into a URL or a clean absolute path,
+// reporting false if it's empty.
+func resolve(entry *Entry, dir string) bool {
+	location := strings.TrimSpace(entry.Path)
+	if location == "" {
+		return false
+	}
+	if strings.HasPrefix(location, "file://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return false
+		}
+		location = u.Path
+	} else if strings.Contains(location, "://") {
+		entry.Path = location
+		return true
+	}
+	// Playlists written on Windows use backslashes.
+	location = strings.Replace(location, "\\", "/", -1)
+	if !filepath.IsAbs(location) {
+		location = filepath.Join(dir, location)
+	}
+	entry.Path = filepath.Clean(location)
+	return true
+}
+
+func latin1(data []byte) []byte {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return []byte(string(runes))
+}
+
+// parseM3U reads an M3U playlist: one location per line, with titles from
+// #EXTINF lines.
+func parseM3U(data []byte) []Entry {
+	var entries []Entry
+	title := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			// #EXTINF:length,Artist - Title
+			if i := strings.IndexByte(line, ','); i >= 0 {
+				title = strings.TrimSpace(line[i+1:])
+			}
+		case line == "" || strings.HasPrefix(line, "#"):
+		default:
+			entries = append(entries, Entry{Path: line, Title: title})
+			title = ""
+		}
+	}
+	return entries
+}
+
+// parsePLS reads a PLS playlist: FileN and TitleN keys in a [playlist]
+// section.
+func parsePLS(data []byte) ([]Entry, error) {
+	files := map[int]*Entry{}
+	entry := func(n int) *Entry {
+		if files[n] == nil {
+			files[n] = &Entry{}
+		}
+		return files[n]
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		key, value := strings.ToLower(strings.TrimSpace(line[:eq])), strings.TrimSpace(line[eq+1:])
+		if strings.HasPrefix(key, "file") {
+			if n, err := strconv.Atoi(key[4:]); err == nil {
+				entry(n).Path = value
+			}
+		} else if strings.HasPrefix(key, "title") {
+			if n, err := strconv.Atoi(key[5:]); err == nil {
+				entry(n).Title = value
+			}
+		}
+	}
+	numbers := make([]int, 0, len(files))
+	for n := range files {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	entries := make([]Entry, 0, len(numbers))
+	for _, n := range numbers {
+		entries = append(entries, *files[n])
+	}
+	return entries, scanner.Err()
+}
+
+// parseXSPF reads an XSPF playlist.  Locations are URIs, so local files are
+// given as file:// URLs, or relative to the playlist.
+func parseXSPF(data []byte) ([]Entry, error) {
+	var doc struct {
+		Tracks []struct {
+			Location []string `xml:"location"`
+			Title    string   `xml:"title"`
+		} `xml:"trackList>track"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, track := range doc.Tracks {
+		if len(track.Location) == 0 {
+			continue
+		}
+		location := track.Location[0]
+		if !strings.Contains(location, "://") {
+			// A relative URI, which may be escaped.
+			if unescaped, err := url.PathUnescape(location); err == nil {
+				location = unescaped
+			}
+		}
+		entries = append(entries, Entry{Path: location, Title: track.Title})
+	}
+	return entries, nil
+}
@@ -0,0 +1,59 @@
+package playlist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "playlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data string) {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("music/a b.mp3", "")
+	write("music/c.flac", "")
+	music := filepath.Join(dir, "music")
+
+	write("lists/one.m3u", "#EXTM3U\n#EXTINF:123,Artist - A B\n..\\music\\a b.mp3\nmissing.mp3\n\nhttp://radio/stream\n")
+	write("lists/Two.pls", "[playlist]\nFile2=../music/c.flac\nTitle2=C\nFile1="+music+"/a b.mp3\nNumberOfEntries=2\n")
+	write("lists/three.xspf", `<?xml version="1.0" encoding="UTF-8"?>
+<playlist version="1" xmlns="http://xspf.org/ns/0/">
+  <trackList>
+    <track><location>file://`+music+`/c.flac</location><title>C</title></track>
+    <track><location>../music/a%20b.mp3</location></track>
+  </trackList>
+</playlist>`)
+	write("lists/latin1.m3u", "../music/c.flac\n# caf\xe9\n")
+
+	lists, err := LoadDir(filepath.Join(dir, "lists"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab, c := filepath.Join(music, "a b.mp3"), filepath.Join(music, "c.flac")
+	want := []Playlist{
+		{Name: "latin1", Entries: []Entry{{Path: c}}},
+		{Name: "one", Entries: []Entry{{ab, "Artist - A B"}, {"http://radio/stream", ""}}, Missing: 1},
+		{Name: "three", Entries: []Entry{{c, "C"}, {ab, ""}}},
+		{Name: "Two", Entries: []Entry{{ab, ""}, {c, "C"}}},
+	}
+	if len(lists) != len(want) {
+		t.Fatalf("got %d playlists: %+v", len(lists), lists)
+	}
+	for i := range want {
+		lists[i].Path = ""
+		if !reflect.DeepEqual(lists[i], want[i]) {
+			t.Errorf("got %+v\nwant %+v", lists[i], want[i])
+		}
+	}
+}
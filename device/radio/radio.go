@@ -0,0 +1,196 @@
+// Package radio plays internet radio: the stations listed in a playlist
+// file, and their streams, with the title of what's playing taken from the
+// stream's ICY metadata.
+package radio
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/device/playlist"
+	"bmwctrl/logging"
+)
+
+var logger = logging.New("radio")
+
+// Length is the track length reported for a stream.  Streams don't end,
+// but the head unit moves on to the next track when the position reaches
+// the length, so it's longer than any drive.
+const Length = 24 * time.Hour
+
+// Station is a radio station.
+type Station struct {
+	Name string
+	URL  string
+}
+
+// LoadStations reads the stations from a playlist file (M3U, PLS or XSPF),
+// named by the entries' titles.  Entries that aren't URLs are left out.
+func LoadStations(path string) ([]Station, error) {
+	list, err := playlist.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	var stations []Station
+	for _, entry := range list.Entries {
+		if !entry.IsURL() {
+			logger.Warn("Not a stream, leaving it out", "playlist", path, "entry", entry.Path)
+			continue
+		}
+		name := entry.Title
+		if name == "" {
+			name = entry.Path
+		}
+		stations = append(stations, Station{name, entry.Path})
+	}
+	return stations, nil
+}
+
+// IsStream reports whether a track is a stream, going by its path or URI.
+func IsStream(path string) bool {
+	return strings.Contains(path, "://")
+}
+
+// Stream reads a station's audio, without its ICY metadata, keeping the
+// stream title from the metadata.  It connects on the first Read, so
+// opening it doesn't hold anything up, and Close stops it wherever it is.
+type Stream struct {
+	url    string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	body      io.ReadCloser
+	metaInt   int // Audio bytes between metadata blocks, or 0 for none.
+	remaining int // Audio bytes before the next metadata block.
+
+	mutex sync.Mutex
+	title string
+}
+
+// Open returns a stream of a URL.
+func Open(url string) *Stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Stream{url: url, ctx: ctx, cancel: cancel}
+}
+
+// Title returns the stream title (e.g. "Artist - Title"), or "" if the
+// station hasn't sent one.
+func (s *Stream) Title() string {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.title
+}
+
+// Close stops the stream.  A Read in progress returns with an error.
+func (s *Stream) Close() error {
+	s.cancel()
+	return nil
+}
+
+// Closed reports whether the stream has been closed, so errors reading it
+// are expected.
+func (s *Stream) Closed() bool {
+	return s.ctx.Err() != nil
+}
+
+func (s *Stream) connect() error {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(s.ctx)
+	req.Header.Set("Icy-MetaData", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return fmt.Errorf("%s: %s", s.url, resp.Status)
+	}
+	s.body = resp.Body
+	s.metaInt, _ = strconv.Atoi(resp.Header.Get("Icy-Metaint"))
+	s.remaining = s.metaInt
+	logger.Info("Stream connected", "url", s.url, "station", resp.Header.Get("Icy-Name"))
+	return nil
+}
+
+// Read reads audio.
+func (s *Stream) Read(p []byte) (int, error) {
+	n, err := s.read(p)
+	if err != nil && s.body != nil {
+		s.body.Close()
+	}
+	return n, err
+}
+
+func (s *Stream) read(p []byte) (int, error) {
+	if s.body == nil {
+		if err := s.connect(); err != nil {
+			return 0, err
+		}
+	}
+	if s.metaInt > 0 && s.remaining == 0 {
+		if err := s.readMetadata(); err != nil {
+			return 0, err
+		}
+		s.remaining = s.metaInt
+	}
+	if s.metaInt > 0 && len(p) > s.remaining {
+		p = p[:s.remaining]
+	}
+	n, err := s.body.Read(p)
+	s.remaining -= n
+	return n, err
+}
+
+// readMetadata reads a metadata block: its length in 16 byte units, then
+// e.g. "StreamTitle='Artist - Title';", padded with zeros.
+func (s *Stream) readMetadata() error {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(s.body, size); err != nil {
+		return err
+	}
+	if size[0] == 0 {
+		return nil
+	}
+	meta := make([]byte, int(size[0])*16)
+	if _, err := io.ReadFull(s.body, meta); err != nil {
+		return err
+	}
+	meta = bytes.TrimRight(meta, "\x00")
+	if title, ok := streamTitle(string(meta)); ok {
+		s.mutex.Lock()
+		changed := title != s.title
+		s.title = title
+		s.mutex.Unlock()
+		if changed {
+			logger.Debug("Stream title", "url", s.url, "title", title)
+		}
+	}
+	return nil
+}
+
+// streamTitle finds the StreamTitle in a metadata block.  Titles can hold
+// quotes, so the title ends at the "';" that ends the field.
+func streamTitle(meta string) (string, bool) {
+	const key = "StreamTitle='"
+	i := strings.Index(meta, key)
+	if i < 0 {
+		return "", false
+	}
+	title := meta[i+len(key):]
+	if end := strings.Index(title, "';"); end >= 0 {
+		title = title[:end]
+	} else {
+		title = strings.TrimSuffix(title, "'")
+	}
+	return strings.TrimSpace(title), true
+}
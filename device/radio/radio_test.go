@@ -0,0 +1,90 @@
+package radio
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// icyBlock builds a metadata block.
+func icyBlock(meta string) []byte {
+	size := (len(meta) + 15) / 16
+	block := make([]byte, 1+size*16)
+	block[0] = byte(size)
+	copy(block[1:], meta)
+	return block
+}
+
+func TestStream(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Icy-MetaData") != "1" {
+			t.Errorf("no Icy-MetaData header")
+		}
+		w.Header().Set("Icy-Metaint", "4")
+		w.Write([]byte("abcd"))
+		w.Write(icyBlock("StreamTitle='Artist - It's Here';StreamUrl='';"))
+		w.Write([]byte("efgh"))
+		w.Write([]byte{0})
+		w.Write([]byte("ij"))
+	}))
+	defer server.Close()
+
+	s := Open(server.URL)
+	defer s.Close()
+	if s.Title() != "" {
+		t.Errorf("title before reading: %q", s.Title())
+	}
+	audio, err := ioutil.ReadAll(s)
+	if err != nil || string(audio) != "abcdefghij" {
+		t.Errorf("audio = %q, %v", audio, err)
+	}
+	if s.Title() != "Artist - It's Here" {
+		t.Errorf("title = %q", s.Title())
+	}
+}
+
+func TestStreamClose(t *testing.T) {
+	closed := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("audio"))
+		w.(http.Flusher).Flush()
+		<-closed
+	}))
+	defer server.Close()
+	defer close(closed)
+
+	s := Open(server.URL)
+	buf := make([]byte, 5)
+	if n, err := s.Read(buf); err != nil || n != 5 {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	s.Close()
+	if _, err := s.Read(buf); err == nil {
+		t.Error("no error reading after closing")
+	}
+}
+
+func TestLoadStations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "radio")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "radio.m3u")
+	m3u := bytes.Join([][]byte{
+		[]byte("#EXTM3U"),
+		[]byte("#EXTINF:-1,Radio Paradise"),
+		[]byte("http://stream.radioparadise.com/mp3-192"),
+		[]byte("http://example.com/unnamed"),
+	}, []byte("\n"))
+	ioutil.WriteFile(path, m3u, 0644)
+	stations, err := LoadStations(path)
+	if err != nil || len(stations) != 2 || stations[0].Name != "Radio Paradise" ||
+		stations[1].Name != "http://example.com/unnamed" {
+		t.Errorf("got %+v, %v", stations, err)
+	}
+}
@@ -0,0 +1,96 @@
+package device
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"bmwctrl/options"
+)
+
+// Backend describes a kind of player, registered with Register so that it
+// can be chosen by name (e.g. with --player.)
+type Backend struct {
+	Name        string
+	Description string
+
+	// Options are the keys the backend takes, in the order they're
+	// listed.  The first one can be given without its key.
+	Options []Option
+
+	// New creates a player.  The options have been checked against
+	// Options, and the defaults filled in.
+	New func(notifications *PlayerNotifications, opts options.Options) (Player, error)
+}
+
+// Option describes an option key of a backend.
+type Option struct {
+	Name    string
+	Default string
+	Usage   string
+}
+
+var (
+	backends      = map[string]Backend{}
+	backendsMutex sync.Mutex
+)
+
+// Register makes a backend available by name.  It's called from the init
+// function of the backend's package, and panics if the name is taken.
+func Register(backend Backend) {
+	defer backendsMutex.Unlock()
+	backendsMutex.Lock()
+	if _, ok := backends[backend.Name]; ok {
+		panic("device: player " + backend.Name + " registered twice")
+	}
+	backends[backend.Name] = backend
+}
+
+// Backends returns the registered backends, sorted by name.
+func Backends() []Backend {
+	defer backendsMutex.Unlock()
+	backendsMutex.Lock()
+	list := make([]Backend, 0, len(backends))
+	for _, backend := range backends {
+		list = append(list, backend)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// NewPlayer creates a player of a registered backend, with options given as
+// key=value pairs separated by commas.
+func NewPlayer(name string, opts string, notifications *PlayerNotifications) (Player, error) {
+	backendsMutex.Lock()
+	backend, ok := backends[name]
+	backendsMutex.Unlock()
+	if !ok {
+		var names []string
+		for _, backend := range Backends() {
+			names = append(names, backend.Name)
+		}
+		return nil, fmt.Errorf("unknown player '%s' (%s)", name, strings.Join(names, ", "))
+	}
+	positional := ""
+	keys := make([]string, len(backend.Options))
+	for i, option := range backend.Options {
+		keys[i] = option.Name
+	}
+	if len(keys) > 0 {
+		positional = keys[0]
+	}
+	parsed, err := options.Parse(opts, positional)
+	if err != nil {
+		return nil, err
+	}
+	if err := parsed.Check(keys...); err != nil {
+		return nil, err
+	}
+	for _, option := range backend.Options {
+		if _, ok := parsed[option.Name]; !ok && option.Default != "" {
+			parsed[option.Name] = option.Default
+		}
+	}
+	return backend.New(notifications, parsed)
+}
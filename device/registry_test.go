@@ -0,0 +1,35 @@
+package device
+
+import (
+	"testing"
+
+	"bmwctrl/options"
+)
+
+func TestNewPlayer(t *testing.T) {
+	var got options.Options
+	Register(Backend{
+		Name: "test",
+		Options: []Option{
+			{Name: "addr", Default: "localhost:1"},
+			{Name: "tag", Default: "Artist"},
+		},
+		New: func(notifications *PlayerNotifications, opts options.Options) (Player, error) {
+			got = opts
+			return nil, nil
+		},
+	})
+
+	if _, err := NewPlayer("test", "remote:2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got["addr"] != "remote:2" || got["tag"] != "Artist" {
+		t.Errorf("options = %v", got)
+	}
+	if _, err := NewPlayer("test", "colour=red", nil); err == nil {
+		t.Error("no error for an unknown option")
+	}
+	if _, err := NewPlayer("nope", "", nil); err == nil {
+		t.Error("no error for an unknown player")
+	}
+}
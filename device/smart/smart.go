@@ -0,0 +1,429 @@
+// Package smart evaluates smart playlists: playlists defined by rules on
+// the library's tags and play history, rather than by a list of tracks.
+//
+// A rule is a condition, optionally followed by how to sort the tracks and
+// how many to keep:
+//
+//	genre = Jazz and year < 1970
+//	added < 30d | sort added desc | limit 100
+//	plays > 0 | sort plays desc | limit 50
+//	artist ~ "beatles" or (genre = Pop and not length > 5m)
+//
+// The fields are title, artist, albumartist, album, genre and path
+// (strings, compared without case; ~ means "contains"), year, track, disc
+// and plays (numbers), length (a duration, e.g. 5m30s), and added and
+// played (ages: "added < 30d" means added in the last 30 days, and a track
+// never played has been unplayed forever.)  Durations take d and w as well
+// as Go's units.  Sorting by added or played sorts by date.
+package smart
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Track is what rules are evaluated against.
+type Track struct {
+	Path        string
+	Title       string
+	Artist      string
+	AlbumArtist string
+	Album       string
+	Genre       string
+	Year        int
+	Track       int
+	Disc        int
+	Length      time.Duration
+	Added       time.Time
+	Plays       int
+	LastPlayed  time.Time
+}
+
+// Playlist is a named rule.
+type Playlist struct {
+	Name  string
+	Rule  string
+	cond  condition
+	sort  string
+	desc  bool
+	limit int
+}
+
+// Select returns the indices of the tracks the playlist holds, in order.
+func (p Playlist) Select(tracks []Track, now time.Time) []int {
+	var selected []int
+	for i := range tracks {
+		if p.cond == nil || p.cond(&tracks[i], now) {
+			selected = append(selected, i)
+		}
+	}
+	if p.sort != "" {
+		f := fields[p.sort]
+		sort.SliceStable(selected, func(i, j int) bool {
+			c := f.compare(&tracks[selected[i]], &tracks[selected[j]])
+			if p.desc {
+				return c > 0
+			}
+			return c < 0
+		})
+	}
+	if p.limit > 0 && len(selected) > p.limit {
+		selected = selected[:p.limit]
+	}
+	return selected
+}
+
+// LoadFile reads smart playlists from a file, one per line as "name =
+// rule".  Blank lines and lines starting with # are ignored.
+func LoadFile(path string) ([]Playlist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lists []Playlist
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("%s:%d: expected 'name = rule'", path, n)
+		}
+		list, err := Parse(strings.TrimSpace(line[:eq]), strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		lists = append(lists, list)
+	}
+	return lists, scanner.Err()
+}
+
+// Parse parses a rule.
+func Parse(name string, rule string) (Playlist, error) {
+	p := Playlist{Name: name, Rule: rule}
+	parts := strings.Split(rule, "|")
+	if where := strings.TrimSpace(parts[0]); where != "" {
+		tokens, err := tokenize(where)
+		if err != nil {
+			return p, err
+		}
+		parser := &parser{tokens: tokens}
+		if p.cond, err = parser.expr(); err != nil {
+			return p, err
+		}
+		if len(parser.tokens) > 0 {
+			return p, fmt.Errorf("unexpected '%s'", parser.tokens[0])
+		}
+	}
+	for _, part := range parts[1:] {
+		words := strings.Fields(part)
+		switch {
+		case len(words) >= 2 && len(words) <= 3 && words[0] == "sort":
+			if _, ok := fields[words[1]]; !ok {
+				return p, fmt.Errorf("unknown field '%s'", words[1])
+			}
+			p.sort = words[1]
+			if len(words) == 3 {
+				switch words[2] {
+				case "asc":
+				case "desc":
+					p.desc = true
+				default:
+					return p, fmt.Errorf("sort order must be asc or desc, got '%s'", words[2])
+				}
+			}
+		case len(words) == 2 && words[0] == "limit":
+			n, err := strconv.Atoi(words[1])
+			if err != nil || n <= 0 {
+				return p, fmt.Errorf("bad limit '%s'", words[1])
+			}
+			p.limit = n
+		default:
+			return p, fmt.Errorf("expected 'sort FIELD [asc|desc]' or 'limit N', got '%s'", strings.TrimSpace(part))
+		}
+	}
+	return p, nil
+}
+
+// condition reports whether a track matches.
+type condition func(t *Track, now time.Time) bool
+
+type kind int
+
+const (
+	stringField kind = iota
+	numberField
+	durationField
+	ageField
+)
+
+type field struct {
+	kind   kind
+	string func(t *Track) string
+	number func(t *Track) int64
+	time   func(t *Track) time.Time
+}
+
+var fields = map[string]field{
+	"title":       {kind: stringField, string: func(t *Track) string { return t.Title }},
+	"artist":      {kind: stringField, string: func(t *Track) string { return t.Artist }},
+	"albumartist": {kind: stringField, string: func(t *Track) string { return t.AlbumArtist }},
+	"album":       {kind: stringField, string: func(t *Track) string { return t.Album }},
+	"genre":       {kind: stringField, string: func(t *Track) string { return t.Genre }},
+	"path":        {kind: stringField, string: func(t *Track) string { return t.Path }},
+	"year":        {kind: numberField, number: func(t *Track) int64 { return int64(t.Year) }},
+	"track":       {kind: numberField, number: func(t *Track) int64 { return int64(t.Track) }},
+	"disc":        {kind: numberField, number: func(t *Track) int64 { return int64(t.Disc) }},
+	"plays":       {kind: numberField, number: func(t *Track) int64 { return int64(t.Plays) }},
+	"length":      {kind: durationField, number: func(t *Track) int64 { return int64(t.Length) }},
+	"added":       {kind: ageField, time: func(t *Track) time.Time { return t.Added }},
+	"played":      {kind: ageField, time: func(t *Track) time.Time { return t.LastPlayed }},
+}
+
+// compare orders two tracks by the field, for sorting.
+func (f field) compare(a, b *Track) int {
+	switch f.kind {
+	case stringField:
+		return strings.Compare(strings.ToLower(f.string(a)), strings.ToLower(f.string(b)))
+	case ageField:
+		ta, tb := f.time(a), f.time(b)
+		if ta.Before(tb) {
+			return -1
+		} else if ta.After(tb) {
+			return 1
+		}
+		return 0
+	default:
+		na, nb := f.number(a), f.number(b)
+		if na < nb {
+			return -1
+		} else if na > nb {
+			return 1
+		}
+		return 0
+	}
+}
+
+// test builds the condition "field op value".
+func (f field) test(op string, value string) (condition, error) {
+	switch f.kind {
+	case stringField:
+		value = strings.ToLower(value)
+		if op == "~" {
+			return func(t *Track, now time.Time) bool {
+				return strings.Contains(strings.ToLower(f.string(t)), value)
+			}, nil
+		}
+		return func(t *Track, now time.Time) bool {
+			return compared(strings.Compare(strings.ToLower(f.string(t)), value), op)
+		}, nil
+	case numberField:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("expected a number, got '%s'", value)
+		}
+		return func(t *Track, now time.Time) bool {
+			return compared(compareInts(f.number(t), n), op)
+		}, nil
+	case durationField:
+		d, err := parseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *Track, now time.Time) bool {
+			return compared(compareInts(f.number(t), int64(d)), op)
+		}, nil
+	default:
+		d, err := parseDuration(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(t *Track, now time.Time) bool {
+			when := f.time(t)
+			if when.IsZero() {
+				// Never: older than any age.
+				return compared(1, op)
+			}
+			return compared(compareInts(int64(now.Sub(when)), int64(d)), op)
+		}, nil
+	}
+}
+
+func compareInts(a, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compared reports whether the result of a comparison satisfies op.
+func compared(c int, op string) bool {
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// parseDuration parses a duration, which may be in days (d) or weeks (w).
+func parseDuration(s string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n, err := strconv.Atoi(strings.TrimSuffix(s, suffix)); err == nil && strings.HasSuffix(s, suffix) {
+			return time.Duration(n) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("expected a duration (e.g. 30d or 5m), got '%s'", s)
+	}
+	return d, nil
+}
+
+// tokenize splits a condition into words, quoted strings, operators and
+// parentheses.
+func tokenize(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '(' || c == ')' || c == '~':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '=' || c == '<' || c == '>' || c == '!':
+			if i+1 < len(s) && s[i+1] == '=' {
+				tokens = append(tokens, s[i:i+2])
+				i += 2
+			} else if c == '!' {
+				return nil, fmt.Errorf("expected '!='")
+			} else {
+				tokens = append(tokens, string(c))
+				i++
+			}
+		case c == '"':
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			// Quoted strings are marked with their opening quote.
+			tokens = append(tokens, s[i:i+1+end])
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t()~=<>!\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []string
+}
+
+func (p *parser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	if len(p.tokens) > 0 {
+		p.tokens = p.tokens[1:]
+	}
+	return t
+}
+
+func (p *parser) expr() (condition, error) {
+	left, err := p.and()
+	for err == nil && p.peek() == "or" {
+		p.next()
+		var right condition
+		if right, err = p.and(); err == nil {
+			a, b := left, right
+			left = func(t *Track, now time.Time) bool { return a(t, now) || b(t, now) }
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (condition, error) {
+	left, err := p.cond()
+	for err == nil && p.peek() == "and" {
+		p.next()
+		var right condition
+		if right, err = p.cond(); err == nil {
+			a, b := left, right
+			left = func(t *Track, now time.Time) bool { return a(t, now) && b(t, now) }
+		}
+	}
+	return left, err
+}
+
+func (p *parser) cond() (condition, error) {
+	switch token := p.next(); token {
+	case "":
+		return nil, fmt.Errorf("unexpected end of rule")
+	case "not":
+		c, err := p.cond()
+		if err != nil {
+			return nil, err
+		}
+		return func(t *Track, now time.Time) bool { return !c(t, now) }, nil
+	case "(":
+		c, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		return c, nil
+	default:
+		f, ok := fields[token]
+		if !ok {
+			return nil, fmt.Errorf("unknown field '%s'", token)
+		}
+		op := p.next()
+		switch op {
+		case "=", "!=", "<", "<=", ">", ">=":
+		case "~":
+			if f.kind != stringField {
+				return nil, fmt.Errorf("~ only applies to text fields, not '%s'", token)
+			}
+		default:
+			return nil, fmt.Errorf("expected a comparison after '%s', got '%s'", token, op)
+		}
+		value := p.next()
+		if value == "" || value == ")" || value == "(" {
+			return nil, fmt.Errorf("expected a value after '%s %s'", token, op)
+		}
+		return f.test(op, strings.TrimPrefix(value, "\""))
+	}
+}
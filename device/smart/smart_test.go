@@ -0,0 +1,88 @@
+package smart
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSelect(t *testing.T) {
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tracks := []Track{
+		{Title: "So What", Genre: "Jazz", Year: 1959, Added: now.Add(-100 * day), Plays: 12},
+		{Title: "Giant Steps", Genre: "jazz", Year: 1960, Added: now.Add(-2 * day), Plays: 3, Length: 4*time.Minute + 43*time.Second},
+		{Title: "Blue Train", Genre: "Jazz", Year: 1970, Added: now.Add(-40 * day)},
+		{Title: "Help!", Artist: "The Beatles", Genre: "Pop", Year: 1965, Added: now.Add(-10 * day), Plays: 7, LastPlayed: now.Add(-time.Hour)},
+	}
+	for rule, want := range map[string][]string{
+		"genre = Jazz and year < 1970":           {"So What", "Giant Steps"},
+		"added < 30d | sort added desc":          {"Giant Steps", "Help!"},
+		"plays = 0":                              {"Blue Train"},
+		"plays > 0 | sort plays desc | limit 2":  {"So What", "Help!"},
+		"played > 1w":                            {"So What", "Giant Steps", "Blue Train"},
+		`artist ~ "beatles" or (length > 4m30s)`: {"Giant Steps", "Help!"},
+		"not genre = jazz":                       {"Help!"},
+		"| sort title":                           {"Blue Train", "Giant Steps", "Help!", "So What"},
+		"genre != pop and title >= g | limit 1":  {"So What"},
+	} {
+		list, err := Parse("test", rule)
+		if err != nil {
+			t.Errorf("%s: %s", rule, err)
+			continue
+		}
+		var got []string
+		for _, i := range list.Select(tracks, now) {
+			got = append(got, tracks[i].Title)
+		}
+		if len(got) != len(want) {
+			t.Errorf("%s: got %q, want %q", rule, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: got %q, want %q", rule, got, want)
+				break
+			}
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, rule := range []string{
+		"colour = red",
+		"year < recent",
+		"added < soon",
+		"year ~ 19",
+		"genre = Jazz and",
+		"(genre = Jazz",
+		`title = "open`,
+		"genre = Jazz | limit none",
+		"genre = Jazz | sort colour",
+		"genre = Jazz | shuffle",
+	} {
+		if _, err := Parse("test", rule); err == nil {
+			t.Errorf("%s: no error", rule)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "smart")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "smart.conf")
+	ioutil.WriteFile(path, []byte("# Comment\n\nRecently Added = added < 30d\nNever Played = plays = 0\n"), 0644)
+	lists, err := LoadFile(path)
+	if err != nil || len(lists) != 2 || lists[0].Name != "Recently Added" || lists[1].Rule != "plays = 0" {
+		t.Errorf("got %+v, %v", lists, err)
+	}
+	ioutil.WriteFile(path, []byte("Broken = year <\n"), 0644)
+	if _, err := LoadFile(path); err == nil {
+		t.Error("no error for a broken rule")
+	}
+}
@@ -1,6 +1,21 @@
 package spotify
 
-import "bmwctrl/device"
+import (
+	"errors"
+
+	"bmwctrl/device"
+	"bmwctrl/options"
+)
+
+func init() {
+	device.Register(device.Backend{
+		Name:        "spotify",
+		Description: "Spotify (not implemented yet.)",
+		New: func(notifications *device.PlayerNotifications, opts options.Options) (device.Player, error) {
+			return nil, errors.New("the spotify player isn't implemented yet")
+		},
+	})
+}
 
 func NewPlayer(notifications *device.PlayerNotifications) device.Player {
 	return nil
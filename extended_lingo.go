@@ -2,16 +2,17 @@ package main
 
 import (
 	"bmwctrl/device"
-	"log"
+	"bmwctrl/logging"
+	"bmwctrl/session"
+	"fmt"
 
 	"github.com/oandrew/ipod"
 	extremote "github.com/oandrew/ipod/lingo-extremote"
 )
 
-var shuffleMode = extremote.ShuffleOff
-var repeatMode = extremote.RepeatOff
+var extremoteLog = logging.New("extremote")
 
-func handleExtendedLingo(cmd *ipod.Command, cmdWriter ipod.CommandWriter, player device.Player) {
+func handleExtendedLingo(cmd *ipod.Command, cmdWriter ipod.CommandWriter, player device.Player, notifications *device.PlayerNotifications, sess *session.Session) {
 	switch msg := cmd.Payload.(type) {
 
 	// BMW wants to know the screen size (it draws a BMW logo on real iPods).
@@ -33,20 +34,25 @@ func handleExtendedLingo(cmd *ipod.Command, cmdWriter ipod.CommandWriter, player
 	// to allow different services to be hooked up to the car.
 	case *extremote.ResetDBSelection:
 		player.ResetDBSelection()
+		sess.ResetSelection()
 		extremote.RespondSuccess(cmd, cmdWriter)
 
 	case *extremote.SelectDBRecord:
 		player.SelectDBRecord(msg.CategoryType, int(msg.RecordIndex))
+		sess.Select(msg.CategoryType, int(msg.RecordIndex))
 		extremote.RespondSuccess(cmd, cmdWriter)
 
 	case *extremote.GetNumberCategorizedDBRecords:
+		count := player.GetNumberCategorizedDBRecords(msg.CategoryType)
+		sess.RecordsCounted(msg.CategoryType, count)
 		ipod.Respond(cmd, cmdWriter, &extremote.ReturnNumberCategorizedDBRecords{
-			RecordCount: int32(player.GetNumberCategorizedDBRecords(msg.CategoryType)),
+			RecordCount: int32(count),
 		})
 
 	case *extremote.RetrieveCategorizedDatabaseRecords:
 		offset := int(msg.Offset)
 		records := player.RetrieveCategorizedDatabaseRecords(msg.CategoryType, offset, int(msg.Count))
+		sess.RecordsRetrieved(msg.CategoryType, offset, records)
 		for index, record := range records {
 			ipod.Respond(cmd, cmdWriter, &extremote.ReturnCategorizedDatabaseRecord{
 				RecordCategoryIndex: uint32(index + offset),
@@ -84,7 +90,10 @@ func handleExtendedLingo(cmd *ipod.Command, cmdWriter ipod.CommandWriter, player
 			AlbumName: player.GetIndexedPlayingTrackAlbumName(int(msg.TrackIndex)),
 		})
 
+	// The mask is applied to every player's notifications, and the player
+	// is told as well.
 	case *extremote.SetPlayStatusChangeNotification:
+		notifications.SetMask(msg.Mask)
 		player.SetPlayStatusChangeNotification(msg.Mask)
 		extremote.RespondSuccess(cmd, cmdWriter)
 
@@ -93,31 +102,35 @@ func handleExtendedLingo(cmd *ipod.Command, cmdWriter ipod.CommandWriter, player
 		extremote.RespondSuccess(cmd, cmdWriter)
 
 	case *extremote.PlayControl:
+		sess.PlayControlled(msg.Cmd)
 		player.PlayControl(msg.Cmd)
 		extremote.RespondSuccess(cmd, cmdWriter)
 
 	// The shuffle and repeat support is handled internal, and not delegated.  This insures
 	// that the iPod rules for these feature is respected, and removes redundant work from
-	// the playback engine interface.
+	// the playback engine interface.  The modes are kept in the session, so they can also
+	// be changed remotely.
 	case *extremote.GetShuffle:
 		ipod.Respond(cmd, cmdWriter, &extremote.ReturnShuffle{
-			Mode: shuffleMode,
+			Mode: sess.Shuffle(),
 		})
 
 	case *extremote.SetShuffle:
-		shuffleMode = msg.Mode
+		sess.SetShuffle(msg.Mode)
 		extremote.RespondSuccess(cmd, cmdWriter)
 
 	case *extremote.GetRepeat:
 		ipod.Respond(cmd, cmdWriter, &extremote.ReturnRepeat{
-			Mode: repeatMode,
+			Mode: sess.Repeat(),
 		})
 
 	case *extremote.SetRepeat:
-		repeatMode = msg.Mode
+		sess.SetRepeat(msg.Mode)
 		extremote.RespondSuccess(cmd, cmdWriter)
 
 	default:
-		log.Printf("[WARN] Unhandled extended lingo command: %x", cmd.ID.CmdID())
+		sess.CommandUnhandled(cmd)
+		countUnhandled(cmd)
+		extremoteLog.Warn("Unhandled command", "id", fmt.Sprintf("%x", cmd.ID.CmdID()), "type", fmt.Sprintf("%T", cmd.Payload))
 	}
 }
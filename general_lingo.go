@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bmwctrl/logging"
+
 	"github.com/oandrew/ipod"
 	general "github.com/oandrew/ipod/lingo-general"
 )
 
+var generalLog = logging.New("general")
+
 // Handles the general indentification messages.  None of these are of any actual interest,
 // but are necessary handshaking.  We pretend to be a 4G iPod.  The code is organized in the
 // order BMW sends the commands upon initial connection.
@@ -0,0 +1,103 @@
+// Package history records what's listened to in the car: how many times
+// each track has been played and skipped, and when it was last played.
+package history
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bmwctrl/device"
+	"bmwctrl/logging"
+	"bmwctrl/options"
+	"bmwctrl/statefile"
+)
+
+var logger = logging.New("history")
+
+// Options configures the history.
+type Options struct {
+	Path    string        // The file the history is kept in.
+	Percent int           // A track is played once this much of it has been.
+	After   time.Duration // Or once this long has been played (0 for no limit.)
+}
+
+// ParseOptions reads history options.  The keys are:
+//
+//	file    The history file (required; the positional option)
+//	played  How much of a track, in percent, has to be played for it to
+//	        count as played (default 50)
+//	after   Or how long (default 4m, 0 for no limit), whichever is first
+func ParseOptions(opts options.Options) (Options, error) {
+	o := Options{}
+	if err := opts.Check("file", "played", "after"); err != nil {
+		return o, err
+	}
+	o.Path = opts.String("file", "")
+	if o.Path == "" {
+		return o, fmt.Errorf("option 'file' is required")
+	}
+	var err error
+	if o.Percent, err = opts.Int("played", 50); err != nil {
+		return o, err
+	}
+	if o.Percent <= 0 || o.Percent > 100 {
+		return o, fmt.Errorf("option 'played' must be from 1 to 100, got '%d'", o.Percent)
+	}
+	if o.After, err = opts.Duration("after", 4*time.Minute); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// Store is the history of each track, by ID, kept in a JSON file.  Each
+// change is written straight away, replacing the file atomically.
+type Store struct {
+	path   string
+	mutex  sync.Mutex
+	tracks map[string]device.TrackHistory
+}
+
+// Open reads the history file, if it exists.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, tracks: map[string]device.TrackHistory{}}
+	if err := statefile.ReadJSON(path, &s.tracks); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Get returns a track's history.
+func (s *Store) Get(id string) device.TrackHistory {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.tracks[id]
+}
+
+// Played records a play of a track, and returns its history.
+func (s *Store) Played(id string, when time.Time) device.TrackHistory {
+	return s.update(id, func(h *device.TrackHistory) {
+		h.Plays++
+		h.LastPlayed = when
+	})
+}
+
+// Skipped records a skip of a track, and returns its history.
+func (s *Store) Skipped(id string) device.TrackHistory {
+	return s.update(id, func(h *device.TrackHistory) {
+		h.Skips++
+	})
+}
+
+func (s *Store) update(id string, change func(h *device.TrackHistory)) device.TrackHistory {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	h := s.tracks[id]
+	change(&h)
+	s.tracks[id] = h
+	if err := statefile.WriteJSON(s.path, s.tracks); err != nil {
+		logger.Warn("Can't save the history", "path", s.path, "err", err)
+	}
+	return h
+}
@@ -0,0 +1,97 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bmwctrl/options"
+	"bmwctrl/session"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+func tempStore(t *testing.T) (*Store, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(filepath.Join(dir, "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, func() { os.RemoveAll(dir) }
+}
+
+func TestStore(t *testing.T) {
+	store, cleanup := tempStore(t)
+	defer cleanup()
+	when := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	store.Played("a.mp3", when)
+	store.Played("a.mp3", when.Add(time.Hour))
+	store.Skipped("b.mp3")
+
+	reopened, err := Open(store.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := reopened.Get("a.mp3"); h.Plays != 2 || h.Skips != 0 || !h.LastPlayed.Equal(when.Add(time.Hour)) {
+		t.Errorf("a.mp3: %+v", h)
+	}
+	if h := reopened.Get("b.mp3"); h.Plays != 0 || h.Skips != 1 || !h.LastPlayed.IsZero() {
+		t.Errorf("b.mp3: %+v", h)
+	}
+}
+
+func TestTracker(t *testing.T) {
+	store, cleanup := tempStore(t)
+	defer cleanup()
+	opts, _ := ParseOptions(options.Options{"file": "-"})
+	tracker := NewTracker(session.New(nil), store, opts)
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	play := func(id string, length time.Duration, from, to time.Duration) {
+		for position := from; position <= to; position += time.Second {
+			tracker.update(observation{id: id, length: length, position: position, playing: true}, now)
+			now = now.Add(time.Second)
+		}
+	}
+
+	// Seeking past half way doesn't count; listening to half does.
+	play("a", time.Minute, 0, 15*time.Second)
+	play("a", time.Minute, 40*time.Second, 45*time.Second)
+	if h := store.Get("a"); h.Plays != 0 {
+		t.Errorf("a played after seeking: %+v", h)
+	}
+	play("a", time.Minute, 46*time.Second, 60*time.Second)
+	if h := store.Get("a"); h.Plays != 1 || h.LastPlayed.IsZero() {
+		t.Errorf("a not played: %+v", h)
+	}
+
+	// Next before half way is a skip; anything else moving on isn't.
+	play("b", time.Minute, 0, 10*time.Second)
+	tracker.update(observation{id: "c", length: time.Minute, playing: true,
+		control: extremote.PlayControlNextTrack, controlled: now}, now.Add(time.Second))
+	now = now.Add(2 * time.Second)
+	tracker.update(observation{id: "d", length: time.Minute, playing: true,
+		control: extremote.PlayControlPrevTrack, controlled: now}, now)
+	if h := store.Get("b"); h.Skips != 1 {
+		t.Errorf("b not skipped: %+v", h)
+	}
+	if h := store.Get("c"); h.Skips != 0 {
+		t.Errorf("c skipped: %+v", h)
+	}
+
+	// Long tracks are played after 4 minutes.
+	play("e", time.Hour, 0, 4*time.Minute)
+	if h := store.Get("e"); h.Plays != 1 {
+		t.Errorf("e not played: %+v", h)
+	}
+
+	// Repeating a track plays it again.
+	play("e", time.Hour, 0, 4*time.Minute)
+	if h := store.Get("e"); h.Plays != 2 {
+		t.Errorf("e not played again: %+v", h)
+	}
+}
@@ -0,0 +1,217 @@
+package history
+
+import (
+	"fmt"
+	"time"
+
+	"bmwctrl/device"
+	"bmwctrl/device/radio"
+	"bmwctrl/session"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+// How often the player is checked.
+const pollInterval = time.Second
+
+// A position further on than this since the last check means the track was
+// sought rather than listened to.
+const maxStep = 3 * pollInterval
+
+// Tracker watches the player, and records plays and skips in the store: a
+// track is played once enough of it has been listened to (seeking doesn't
+// count), and skipped if the next track control moves on before then.
+// Plays are also written back to players that keep history themselves.
+type Tracker struct {
+	opts      Options
+	store     *Store
+	session   *session.Session
+	current   listen
+	listeners []func(play Play)
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// Play is a track that has been played, as given to listeners.
+type Play struct {
+	ID      string
+	Title   string
+	Artist  string
+	Album   string
+	Length  time.Duration
+	Started time.Time // When it started playing.
+}
+
+// listen is the track being listened to.
+type listen struct {
+	id       string
+	title    string
+	artist   string
+	album    string
+	length   time.Duration
+	position time.Duration // At the last check.
+	listened time.Duration // How much has been played, not counting seeks.
+	started  time.Time
+	counted  bool // The play has been recorded.
+}
+
+// observation is what the tracker sees of the player at each check.
+type observation struct {
+	id         string // Empty if nothing is playing or paused.
+	title      string
+	artist     string
+	album      string
+	length     time.Duration
+	position   time.Duration
+	playing    bool
+	control    extremote.PlayControlCmd // The last play control.
+	controlled time.Time                // When it was given.
+}
+
+// NewTracker creates a tracker for the session's player.
+func NewTracker(s *session.Session, store *Store, opts Options) *Tracker {
+	return &Tracker{
+		opts:    opts,
+		store:   store,
+		session: s,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// OnPlay adds a function called with each play, e.g. to scrobble it.  It
+// must be called before Start.
+func (t *Tracker) OnPlay(fn func(play Play)) {
+	t.listeners = append(t.listeners, fn)
+}
+
+// Start starts watching the player.
+func (t *Tracker) Start() {
+	go t.run()
+}
+
+// Close stops watching the player.
+func (t *Tracker) Close() {
+	close(t.stop)
+	<-t.done
+}
+
+func (t *Tracker) run() {
+	defer close(t.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.update(t.observe(), time.Now())
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// TrackID identifies a track in the player's play queue: by the player's ID
+// for it, if it has one, or by its artist, album and title.
+func TrackID(player device.Player, index int) string {
+	if identifier, ok := player.(device.TrackIdentifier); ok {
+		if id := identifier.GetIndexedPlayingTrackID(index); id != "" {
+			return id
+		}
+	}
+	return fmt.Sprintf("%s / %s / %s", player.GetIndexedPlayingTrackArtistName(index),
+		player.GetIndexedPlayingTrackAlbumName(index), player.GetIndexedPlayingTrackTitle(index))
+}
+
+func (t *Tracker) observe() observation {
+	var o observation
+	t.session.WithPlayer(func(player device.Player) {
+		length, position, state := player.GetPlayStatus()
+		if state == extremote.PlayerStateStopped || player.GetNumPlayingTracks() == 0 {
+			return
+		}
+		index := player.GetCurrentPlayingTrackIndex()
+		id := TrackID(player, index)
+		if radio.IsStream(id) {
+			// A radio station isn't a track that can be played or skipped.
+			return
+		}
+		o.id = id
+		o.title = player.GetIndexedPlayingTrackTitle(index)
+		o.artist = player.GetIndexedPlayingTrackArtistName(index)
+		o.album = player.GetIndexedPlayingTrackAlbumName(index)
+		o.length = time.Duration(length) * time.Millisecond
+		o.position = time.Duration(position) * time.Millisecond
+		o.playing = state == extremote.PlayerStatePlaying
+	})
+	o.control, o.controlled = t.session.LastPlayControl()
+	return o
+}
+
+// update follows the listen from one check to the next.  A new listen
+// starts when the track changes, or the same track starts again after its
+// play was counted (e.g. repeating one track.)
+func (t *Tracker) update(o observation, now time.Time) {
+	restarted := o.id == t.current.id && t.current.counted && o.position+maxStep < t.current.position
+	if o.id != t.current.id || restarted {
+		t.finish(o)
+		t.current = listen{id: o.id, position: o.position, started: now}
+	}
+	if t.current.id == "" {
+		return
+	}
+	step := o.position - t.current.position
+	if o.playing && step > 0 && step <= maxStep {
+		t.current.listened += step
+	}
+	t.current.position = o.position
+	t.current.title, t.current.artist, t.current.album = o.title, o.artist, o.album
+	t.current.length = o.length
+	if !t.current.counted && t.played() {
+		t.current.counted = true
+		h := t.store.Played(t.current.id, now)
+		logger.Debug("Played", "track", t.current.id, "plays", h.Plays)
+		t.write(t.current.id, h)
+		play := Play{
+			ID:      t.current.id,
+			Title:   t.current.title,
+			Artist:  t.current.artist,
+			Album:   t.current.album,
+			Length:  t.current.length,
+			Started: t.current.started,
+		}
+		for _, fn := range t.listeners {
+			fn(play)
+		}
+	}
+}
+
+// played reports whether enough of the track has been listened to.
+func (t *Tracker) played() bool {
+	if t.opts.After > 0 && t.current.listened >= t.opts.After {
+		return true
+	}
+	return t.current.length > 0 && t.current.listened >= t.current.length*time.Duration(t.opts.Percent)/100
+}
+
+// finish ends the current listen: if it wasn't counted as a play, and the
+// next track control moved on from it, it was skipped.
+func (t *Tracker) finish(o observation) {
+	if t.current.id == "" || t.current.counted {
+		return
+	}
+	next := o.control == extremote.PlayControlNextTrack || o.control == extremote.PlayControlNext
+	if next && o.controlled.After(t.current.started) {
+		h := t.store.Skipped(t.current.id)
+		logger.Debug("Skipped", "track", t.current.id, "skips", h.Skips)
+		t.write(t.current.id, h)
+	}
+}
+
+// write gives a track's history to the player, if it keeps history itself.
+func (t *Tracker) write(id string, h device.TrackHistory) {
+	t.session.WithPlayer(func(player device.Player) {
+		if writer, ok := player.(device.HistoryWriter); ok {
+			writer.WriteHistory(id, h)
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package idle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/logging"
+	"bmwctrl/options"
+)
+
+var logger = logging.New("idle")
+
+// How often the ignition input and the time since the last frame are
+// checked.
+const pollInterval = time.Second
+
+// Options configures how the car is detected going to sleep.
+type Options struct {
+	Timeout   time.Duration // No frames from the car for this long means it's asleep (0 to never time out.)
+	GPIO      string        // The sysfs value file of the ignition input, e.g. /sys/class/gpio/gpio17/value.
+	ActiveLow bool          // The ignition is on when the input reads 0.
+	Hook      string        // Run with "idle" or "active" when the mode changes.
+}
+
+// ParseOptions reads idle options.  The keys are:
+//
+//	timeout  How long without frames from the car before going idle
+//	         (default 5m, 0 to only use the GPIO input)
+//	gpio     The sysfs value file of the ignition input
+//	active   The level of the input while the ignition is on, high or low
+//	         (default high)
+//	hook     A program run with "idle" when going idle and "active" when
+//	         the car wakes up
+func ParseOptions(opts options.Options) (Options, error) {
+	o := Options{}
+	if err := opts.Check("timeout", "gpio", "active", "hook"); err != nil {
+		return o, err
+	}
+	var err error
+	if o.Timeout, err = opts.Duration("timeout", 5*time.Minute); err != nil {
+		return o, err
+	}
+	o.GPIO = opts.String("gpio", "")
+	switch active := opts.String("active", "high"); active {
+	case "high":
+	case "low":
+		o.ActiveLow = true
+	default:
+		return o, fmt.Errorf("option 'active' must be high or low, got '%s'", active)
+	}
+	o.Hook = opts.String("hook", "")
+	if o.Timeout == 0 && o.GPIO == "" {
+		return o, fmt.Errorf("either option 'timeout' or option 'gpio' is needed")
+	}
+	return o, nil
+}
+
+// Monitor watches for the car going to sleep: no frames from it for a
+// while, or the ignition input going off.  Then it goes idle, calling the
+// idle function (e.g. to pause the player and save its state) and running
+// the hook, and when the car wakes up again it goes active.
+type Monitor struct {
+	opts         Options
+	lastActivity func() time.Time
+	onIdle       func()
+	onActive     func()
+	started      time.Time
+	idle         bool
+	gpioFailed   bool
+	mutex        sync.Mutex
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewMonitor creates a monitor.  lastActivity returns when the car last
+// sent a frame, or the zero time if it hasn't.  onIdle and onActive may be
+// nil.
+func NewMonitor(opts Options, lastActivity func() time.Time, onIdle, onActive func()) *Monitor {
+	return &Monitor{
+		opts:         opts,
+		lastActivity: lastActivity,
+		onIdle:       onIdle,
+		onActive:     onActive,
+		started:      time.Now(),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start starts watching the car.
+func (m *Monitor) Start() {
+	logger.Info("Watching for the car going to sleep", "timeout", m.opts.Timeout, "gpio", m.opts.GPIO)
+	go m.run()
+}
+
+// Close stops watching the car.
+func (m *Monitor) Close() {
+	close(m.stop)
+	<-m.done
+}
+
+// Idle reports whether the car is asleep.
+func (m *Monitor) Idle() bool {
+	defer m.mutex.Unlock()
+	m.mutex.Lock()
+	return m.idle
+}
+
+func (m *Monitor) run() {
+	defer close(m.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			m.check(now)
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// check switches between idle and active, if the car has gone to sleep or
+// woken up.
+func (m *Monitor) check(now time.Time) {
+	asleep, reason := m.asleep(now)
+	m.mutex.Lock()
+	changed := asleep != m.idle
+	m.idle = asleep
+	m.mutex.Unlock()
+	if !changed {
+		return
+	}
+	if asleep {
+		logger.Info("Car is asleep, going idle", "reason", reason)
+		if m.onIdle != nil {
+			m.onIdle()
+		}
+		m.runHook("idle")
+	} else {
+		logger.Info("Car is awake")
+		if m.onActive != nil {
+			m.onActive()
+		}
+		m.runHook("active")
+	}
+}
+
+// asleep reports whether the car is asleep, and why.
+func (m *Monitor) asleep(now time.Time) (bool, string) {
+	if m.opts.GPIO != "" {
+		if on, ok := m.ignition(); ok && !on {
+			return true, "ignition off"
+		}
+	}
+	if m.opts.Timeout > 0 {
+		last := m.lastActivity()
+		if last.IsZero() {
+			last = m.started
+		}
+		if now.Sub(last) >= m.opts.Timeout {
+			return true, "no frames"
+		}
+	}
+	return false, ""
+}
+
+// ignition reads the ignition input, reporting whether it could be read.
+func (m *Monitor) ignition() (on bool, ok bool) {
+	data, err := ioutil.ReadFile(m.opts.GPIO)
+	if err != nil {
+		if !m.gpioFailed {
+			logger.Warn("Can't read the ignition input", "path", m.opts.GPIO, "err", err)
+			m.gpioFailed = true
+		}
+		return false, false
+	}
+	m.gpioFailed = false
+	high := strings.TrimSpace(string(data)) != "0"
+	return high != m.opts.ActiveLow, true
+}
+
+// runHook runs the hook, if there is one, and waits for it, so long jobs
+// (e.g. syncing music) should put themselves in the background.  Its output
+// is logged.
+func (m *Monitor) runHook(mode string) {
+	if m.opts.Hook == "" {
+		return
+	}
+	cmd := exec.Command(m.opts.Hook, mode)
+	cmd.Env = append(os.Environ(), "BMWCTRL_MODE="+mode)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		logger.Info("Hook output", "hook", m.opts.Hook, "output", strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		logger.Warn("Hook failed", "hook", m.opts.Hook, "mode", mode, "err", err)
+	}
+}
@@ -0,0 +1,61 @@
+package idle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "idle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	gpio := filepath.Join(dir, "value")
+	hooked := filepath.Join(dir, "hooked")
+	hook := filepath.Join(dir, "hook.sh")
+	script := "#!/bin/sh\necho \"$1\" >> " + hooked + "\n"
+	if err := ioutil.WriteFile(hook, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	setIgnition := func(value string) {
+		if err := ioutil.WriteFile(gpio, []byte(value+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var last time.Time
+	idled, woken := 0, 0
+	m := NewMonitor(Options{Timeout: time.Minute, GPIO: gpio, Hook: hook},
+		func() time.Time { return last }, func() { idled++ }, func() { woken++ })
+	now := m.started
+
+	setIgnition("1")
+	m.check(now.Add(30 * time.Second))
+	if m.Idle() {
+		t.Fatal("idle before the timeout")
+	}
+	setIgnition("0")
+	m.check(now.Add(31 * time.Second))
+	if !m.Idle() || idled != 1 {
+		t.Fatalf("not idle with the ignition off (idled %d)", idled)
+	}
+	setIgnition("1")
+	last = now.Add(40 * time.Second)
+	m.check(now.Add(41 * time.Second))
+	if m.Idle() || woken != 1 {
+		t.Fatalf("still idle with the ignition on (woken %d)", woken)
+	}
+	m.check(now.Add(101 * time.Second))
+	if !m.Idle() || idled != 2 {
+		t.Fatalf("not idle without frames (idled %d)", idled)
+	}
+
+	data, err := ioutil.ReadFile(hooked)
+	if err != nil || string(data) != "idle\nactive\nidle\n" {
+		t.Errorf("hook ran with %q, %v", data, err)
+	}
+}
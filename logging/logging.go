@@ -0,0 +1,364 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", s)
+}
+
+// Format is the layout of the log output.
+type Format int
+
+const (
+	// FormatText is meant for people: "[WARN] transport: Dropped frame reason=...".
+	FormatText Format = iota
+	// FormatLogfmt is meant for grep: "level=warn subsystem=transport msg=...".
+	FormatLogfmt
+	// FormatJSON writes one JSON object per line.
+	FormatJSON
+)
+
+// ParseFormat returns the format with the given name (text, logfmt or json.)
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text", "":
+		return FormatText, nil
+	case "logfmt":
+		return FormatLogfmt, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("unknown log format '%s'", s)
+}
+
+// The configuration is shared by all loggers, and is normally set once at
+// startup, before anything is logged.
+var config = struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	format     Format
+	timestamps bool
+	level      Level
+	levels     map[string]Level
+	hooks      []hook
+}{
+	out:    os.Stderr,
+	format: FormatText,
+	level:  LevelInfo,
+	levels: map[string]Level{},
+}
+
+// SetOutput sets where all the loggers write to.
+func SetOutput(w io.Writer) {
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	config.out = w
+}
+
+// SetFormat sets the layout of the log output.
+func SetFormat(format Format) {
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	config.format = format
+}
+
+// SetTimestamps turns timestamps on or off.
+func SetTimestamps(on bool) {
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	config.timestamps = on
+}
+
+// SetLevel sets the minimum level logged by a subsystem.  An empty subsystem
+// sets the default level, used by subsystems that have no level of their
+// own.  Setting a level for "player" also covers "player/mpd", unless it has
+// its own level.
+func SetLevel(subsystem string, level Level) {
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	if subsystem == "" {
+		config.level = level
+	} else {
+		config.levels[subsystem] = level
+	}
+}
+
+// Entry is a logged message, as passed to hooks.
+type Entry struct {
+	Time      time.Time
+	Level     Level
+	Subsystem string
+	Msg       string
+	KeyVals   []interface{}
+}
+
+type hook struct {
+	level Level
+	fn    func(Entry)
+}
+
+// AddHook calls fn for every message logged at level or above, after it is
+// written.  Hooks are called on the goroutine that logged the message, so
+// must not block.
+func AddHook(level Level, fn func(Entry)) {
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	config.hooks = append(config.hooks, hook{level, fn})
+}
+
+// SetLevels sets levels from a comma separated list, where each entry is
+// either a default level, or a subsystem=level pair.  For example,
+// "warn,transport=debug,player/mpd=info".
+func SetLevels(spec string) error {
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		subsystem, name := "", field
+		if i := strings.Index(field, "="); i >= 0 {
+			subsystem, name = field[:i], field[i+1:]
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		SetLevel(subsystem, level)
+	}
+	return nil
+}
+
+// Logger writes messages for one subsystem.  Messages are followed by
+// key/value pairs that give the details, so that the output can be filtered
+// and parsed, e.g. logger.Warn("Dropped frame", "reason", "bad checksum").
+type Logger struct {
+	subsystem string
+}
+
+// New returns a logger for the named subsystem.  Loggers are normally
+// created once per package.
+func New(subsystem string) *Logger {
+	return &Logger{subsystem}
+}
+
+// Enabled reports whether messages at level are logged.  This can be used to
+// skip expensive work that is only needed for logging.
+func (l *Logger) Enabled(level Level) bool {
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	return level >= l.level()
+}
+
+// level returns the minimum level for this logger.  The config mutex must be
+// held.
+func (l *Logger) level() Level {
+	subsystem := l.subsystem
+	for subsystem != "" {
+		if level, ok := config.levels[subsystem]; ok {
+			return level
+		}
+		i := strings.LastIndex(subsystem, "/")
+		if i < 0 {
+			break
+		}
+		subsystem = subsystem[:i]
+	}
+	return config.level
+}
+
+// Debug, Info, Warn and Error log a message at their level.
+func (l *Logger) Debug(msg string, keyvals ...interface{}) { l.log(LevelDebug, msg, keyvals) }
+func (l *Logger) Info(msg string, keyvals ...interface{})  { l.log(LevelInfo, msg, keyvals) }
+func (l *Logger) Warn(msg string, keyvals ...interface{})  { l.log(LevelWarn, msg, keyvals) }
+func (l *Logger) Error(msg string, keyvals ...interface{}) { l.log(LevelError, msg, keyvals) }
+
+// Fatal logs an error, and exits.
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+	os.Exit(1)
+}
+
+// Writer returns a writer that logs each line written to it as a message at
+// level.  This is used to capture the output of the standard log package.
+func (l *Logger) Writer(level Level) io.Writer {
+	return &lineWriter{l, level}
+}
+
+type lineWriter struct {
+	logger *Logger
+	level  Level
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.log(w.level, line, nil)
+	}
+	return len(p), nil
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	// Hooks are called once the lock is released, so they can log.
+	var hooks []hook
+	defer func() {
+		for _, h := range hooks {
+			h.fn(Entry{time.Now(), level, l.subsystem, msg, keyvals})
+		}
+	}()
+	defer config.mutex.Unlock()
+	config.mutex.Lock()
+	if level < l.level() {
+		return
+	}
+	for _, h := range config.hooks {
+		if level >= h.level {
+			hooks = append(hooks, h)
+		}
+	}
+	if len(keyvals)%2 != 0 {
+		keyvals = append(keyvals, "(missing)")
+	}
+
+	var now time.Time
+	if config.timestamps {
+		now = time.Now()
+	}
+	buffer := bytes.Buffer{}
+	switch config.format {
+	case FormatLogfmt:
+		writeLogfmt(&buffer, now, level, l.subsystem, msg, keyvals)
+	case FormatJSON:
+		writeJSON(&buffer, now, level, l.subsystem, msg, keyvals)
+	default:
+		writeText(&buffer, now, level, l.subsystem, msg, keyvals)
+	}
+	buffer.WriteByte('\n')
+	config.out.Write(buffer.Bytes())
+}
+
+func writeText(b *bytes.Buffer, now time.Time, level Level, subsystem string, msg string, keyvals []interface{}) {
+	if !now.IsZero() {
+		b.WriteString(now.Format("15:04:05.000000 "))
+	}
+	fmt.Fprintf(b, "[%s] %s: %s", strings.ToUpper(level.String()), subsystem, msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(b, " %s=%s", keyvals[i], logfmtValue(keyvals[i+1]))
+	}
+}
+
+func writeLogfmt(b *bytes.Buffer, now time.Time, level Level, subsystem string, msg string, keyvals []interface{}) {
+	if !now.IsZero() {
+		fmt.Fprintf(b, "ts=%s ", now.Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(b, "level=%s subsystem=%s msg=%s", level, subsystem, logfmtValue(msg))
+	for i := 0; i < len(keyvals); i += 2 {
+		fmt.Fprintf(b, " %s=%s", keyvals[i], logfmtValue(keyvals[i+1]))
+	}
+}
+
+func writeJSON(b *bytes.Buffer, now time.Time, level Level, subsystem string, msg string, keyvals []interface{}) {
+	fields := map[string]interface{}{
+		"level":     level.String(),
+		"subsystem": subsystem,
+		"msg":       msg,
+	}
+	if !now.IsZero() {
+		fields["ts"] = now.Format(time.RFC3339Nano)
+	}
+	for i := 0; i < len(keyvals); i += 2 {
+		fields[fmt.Sprint(keyvals[i])] = jsonValue(keyvals[i+1])
+	}
+
+	// Keep the common fields first, so lines are easy to read.
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		switch key {
+		case "ts", "level", "subsystem", "msg":
+		default:
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{"ts", "level", "subsystem", "msg"}, keys...)
+
+	b.WriteByte('{')
+	first := true
+	for _, key := range keys {
+		value, ok := fields[key]
+		if !ok {
+			continue
+		}
+		if !first {
+			b.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(v)
+	}
+	b.WriteByte('}')
+}
+
+// logfmtValue formats a value, quoting it if it has spaces, quotes or equal
+// signs in it.
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(jsonValue(value))
+	if s == "" || strings.ContainsAny(s, " =\"\t\n") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// jsonValue keeps values JSON knows how to handle as they are, and turns
+// everything else into a string.
+func jsonValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case nil, string, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%+v", v)
+	}
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	SetOutput(buffer)
+	defer SetOutput(os.Stderr)
+	defer SetFormat(FormatText)
+
+	logger := New("transport")
+	tests := []struct {
+		format Format
+		want   string
+	}{
+		{FormatText, "[WARN] transport: Dropped frame reason=\"bad checksum\" count=2 err=boom\n"},
+		{FormatLogfmt, "level=warn subsystem=transport msg=\"Dropped frame\" reason=\"bad checksum\" count=2 err=boom\n"},
+		{FormatJSON, "{\"level\":\"warn\",\"subsystem\":\"transport\",\"msg\":\"Dropped frame\",\"count\":2,\"err\":\"boom\",\"reason\":\"bad checksum\"}\n"},
+	}
+	for _, test := range tests {
+		buffer.Reset()
+		SetFormat(test.format)
+		logger.Warn("Dropped frame", "reason", "bad checksum", "count", 2, "err", errors.New("boom"))
+		if got := buffer.String(); got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
+
+func TestLevels(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	SetOutput(buffer)
+	defer SetOutput(os.Stderr)
+	defer func() {
+		config.level = LevelInfo
+		config.levels = map[string]Level{}
+	}()
+
+	if err := SetLevels("warn,player=debug,player/mpd=error"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		subsystem string
+		level     Level
+		enabled   bool
+	}{
+		{"transport", LevelInfo, false},
+		{"transport", LevelWarn, true},
+		{"player/mock", LevelDebug, true},
+		{"player/mpd", LevelWarn, false},
+		{"player/mpd", LevelError, true},
+	}
+	for _, test := range tests {
+		if enabled := New(test.subsystem).Enabled(test.level); enabled != test.enabled {
+			t.Errorf("%s at %s: got enabled %t", test.subsystem, test.level, enabled)
+		}
+	}
+	if err := SetLevels("transport=loud"); err == nil {
+		t.Errorf("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,323 @@
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/options"
+)
+
+// The suffix format of rotated files: a sequence number, as the Pi has no
+// clock to go by until it's synced over the network.
+const rotateSeqFormat = "%06d"
+
+// The suffix of a file that's still being compressed.
+const compressingSuffix = ".tmp"
+
+// RotateOptions controls when a logfile is rotated, and how many of the
+// rotated files are kept.  The defaults keep the logs small enough for a
+// Pi's SD card, even with frame logging turned on.
+type RotateOptions struct {
+	MaxSize  int64         // Rotate once the file grows past this many bytes.
+	MaxAge   time.Duration // Rotate once the file has been open this long (0 is never.)
+	Boot     bool          // Rotate when the file is opened, so each run gets its own file.
+	Keep     int           // Number of rotated files to keep.
+	MaxTotal int64         // Cap on the bytes used by the file and its rotated files.
+	Compress bool          // Gzip rotated files.
+}
+
+// ParseRotateOptions reads the rotation settings from key=value options.
+//
+//	size=SIZE          rotate at this size, e.g. 512KB or 2MB (default 1MB)
+//	age=DURATION       rotate after this long, e.g. 24h (default never)
+//	boot=true|false    start a new file each run (default false)
+//	keep=N             rotated files to keep (default 20)
+//	total=SIZE         cap on the space used by all the files (default 50MB)
+//	compress=true|false  gzip rotated files (default true)
+func ParseRotateOptions(opts options.Options) (RotateOptions, error) {
+	o := RotateOptions{}
+	err := opts.Check("size", "age", "boot", "keep", "total", "compress")
+	if err != nil {
+		return o, err
+	}
+	if o.MaxSize, err = parseSize(opts, "size", 1<<20); err != nil {
+		return o, err
+	}
+	if o.MaxAge, err = opts.Duration("age", 0); err != nil {
+		return o, err
+	}
+	if o.Boot, err = opts.Bool("boot", false); err != nil {
+		return o, err
+	}
+	if o.Keep, err = opts.Int("keep", 20); err != nil {
+		return o, err
+	}
+	if o.Keep < 0 {
+		return o, fmt.Errorf("option 'keep' can't be negative, got '%d'", o.Keep)
+	}
+	if o.MaxTotal, err = parseSize(opts, "total", 50<<20); err != nil {
+		return o, err
+	}
+	if o.Compress, err = opts.Bool("compress", true); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// parseSize reads a size in bytes, with an optional KB, MB or GB suffix.
+func parseSize(opts options.Options, key string, def int64) (int64, error) {
+	value, ok := opts[key]
+	if !ok {
+		return def, nil
+	}
+	s := strings.ToUpper(value)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSuffix(s, unit.suffix)
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	if err != nil || n <= 0 {
+		return def, fmt.Errorf("option '%s' must be a size, e.g. 512KB or 2MB, got '%s'", key, value)
+	}
+	return n * multiplier, nil
+}
+
+// RotatingFile is a logfile that is appended to, and rotated once it gets
+// too big or too old.  Rotated files are named after the logfile, with a
+// sequence number added (e.g. bmwctrl.log.000042.gz).  Old rotated files
+// are deleted to stay within the limits.
+type RotatingFile struct {
+	path    string
+	opts    RotateOptions
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	seq     int // The sequence number of the last rotated file.
+	cleanup sync.WaitGroup
+}
+
+// OpenRotatingFile opens path for appending, creating it if needed.
+func OpenRotatingFile(path string, opts RotateOptions) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, opts: opts}
+	for _, file := range f.rotatedFiles() {
+		if file.seq > f.seq {
+			f.seq = file.seq
+		}
+	}
+	if opts.Boot {
+		if info, err := os.Stat(path); err == nil && info.Size() > 0 {
+			if err := f.rotate(); err != nil {
+				return nil, err
+			}
+			return f, nil
+		}
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Write appends p to the logfile, rotating it first if needed.  Lines are
+// never split across files, as the loggers write a line at a time.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	defer f.mutex.Unlock()
+	f.mutex.Lock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	tooBig := f.opts.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.opts.MaxSize
+	tooOld := f.opts.MaxAge > 0 && time.Since(f.opened) > f.opts.MaxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Close closes the logfile, after waiting for any compression or cleanup of
+// rotated files to finish.
+func (f *RotatingFile) Close() error {
+	f.mutex.Lock()
+	var err error
+	if f.file != nil {
+		err = f.file.Close()
+		f.file = nil
+	}
+	f.mutex.Unlock()
+	f.cleanup.Wait()
+	return err
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+// rotate moves the current file aside, and starts a new one.  Compressing
+// and deleting old files happens in the background, so logging isn't held
+// up.
+func (f *RotatingFile) rotate() error {
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.seq++
+	rotated := f.path + "." + fmt.Sprintf(rotateSeqFormat, f.seq)
+	if err := os.Rename(f.path, rotated); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.cleanup.Add(1)
+	go func() {
+		defer f.cleanup.Done()
+		if f.opts.Compress {
+			compressFile(rotated)
+		}
+		f.removeOldFiles()
+	}()
+	return nil
+}
+
+// compressFile gzips path, and removes the original.  The compressed file
+// is written under a temporary name, and renamed when it's complete.  If
+// anything goes wrong, the original is left alone.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz" + compressingSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedFile is one of the rotated files, found by rotatedFiles.
+type rotatedFile struct {
+	name string
+	seq  int
+	size int64
+}
+
+// rotatedFiles finds the rotated files, oldest first.  Only files named
+// with a sequence number count; anything else next to the logfile is left
+// alone.  Files still being compressed aren't included, and neither is the
+// original of a file that has been compressed, which is about to be removed.
+func (f *RotatingFile) rotatedFiles() []rotatedFile {
+	names, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return nil
+	}
+	var files []rotatedFile
+	for _, name := range names {
+		seq, ok := rotatedSeq(strings.TrimSuffix(strings.TrimPrefix(name, f.path+"."), ".gz"))
+		if !ok {
+			continue
+		}
+		if _, err := os.Stat(name + ".gz" + compressingSuffix); err == nil {
+			continue
+		}
+		if !strings.HasSuffix(name, ".gz") {
+			if _, err := os.Stat(name + ".gz"); err == nil {
+				continue
+			}
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		files = append(files, rotatedFile{name, seq, info.Size()})
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].seq < files[j].seq })
+	return files
+}
+
+// rotatedSeq reads the sequence number from a rotated file's suffix: at
+// least as many digits as rotateSeqFormat pads to, and nothing else.
+func rotatedSeq(suffix string) (int, bool) {
+	if len(suffix) < len(fmt.Sprintf(rotateSeqFormat, 0)) {
+		return 0, false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	seq, err := strconv.Atoi(suffix)
+	return seq, err == nil
+}
+
+// removeOldFiles deletes the oldest rotated files until there are no more
+// than Keep of them, and they fit in MaxTotal along with the current file.
+// Files still being compressed are left alone.  It runs without the mutex,
+// so logging isn't held up by the file system.
+func (f *RotatingFile) removeOldFiles() {
+	f.mutex.Lock()
+	total := f.size
+	f.mutex.Unlock()
+
+	files := f.rotatedFiles()
+	for _, file := range files {
+		total += file.size
+	}
+	for len(files) > 0 && (len(files) > f.opts.Keep || (f.opts.MaxTotal > 0 && total > f.opts.MaxTotal)) {
+		os.Remove(files[0].name)
+		total -= files[0].size
+		files = files[1:]
+	}
+}
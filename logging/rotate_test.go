@@ -0,0 +1,131 @@
+package logging
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"bmwctrl/options"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bmwctrl.log")
+
+	// An existing log is appended to, not truncated.
+	if err := ioutil.WriteFile(path, []byte("previous drive\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := OpenRotatingFile(path, RotateOptions{MaxSize: 100, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 39) + "\n"
+	for i := 0; i < 20; i++ {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Fatalf("got %d rotated files, want 2: %v", len(rotated), rotated)
+	}
+	for _, name := range rotated {
+		if !strings.HasSuffix(name, ".gz") {
+			t.Errorf("rotated file %s was not compressed", name)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 100 {
+		t.Errorf("current file is %d bytes, over the limit", info.Size())
+	}
+}
+
+func TestRotateOnBoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bmwctrl.log")
+
+	for drive := 0; drive < 3; drive++ {
+		f, err := OpenRotatingFile(path, RotateOptions{MaxSize: 1 << 20, Boot: true, Keep: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte("driving\n"))
+		f.Close()
+	}
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("got %d rotated files, want one per previous drive: %v", len(rotated), rotated)
+	}
+}
+
+func TestRotatedFileOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bmwctrl.log")
+
+	// Files are pruned by sequence number, not name.  A file still being
+	// compressed, and files that aren't numbered, are left alone, and don't
+	// count towards the limits.
+	others := []string{".20180614-183000.000000000.gz", ".bak", ".old", ".txt", ".000008.gz.tmp"}
+	for _, name := range append([]string{"", ".000009.gz", ".000010.gz"}, others...) {
+		if err := ioutil.WriteFile(path+name, []byte("driving\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f, err := OpenRotatingFile(path, RotateOptions{MaxSize: 1 << 20, Boot: true, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	rotated, _ := filepath.Glob(path + ".*")
+	var want []string
+	for _, name := range append([]string{".000010.gz", ".000011.gz"}, others...) {
+		want = append(want, path+name)
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(rotated, want) {
+		t.Errorf("got %v, want %v", rotated, want)
+	}
+}
+
+func TestParseRotateOptions(t *testing.T) {
+	if _, err := ParseRotateOptions(options.Options{"keep": "-1"}); err == nil {
+		t.Error("no error for a negative keep")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{"512": 512, "2KB": 2048, "1mb": 1 << 20, "3GB": 3 << 30}
+	for value, want := range tests {
+		got, err := parseSize(map[string]string{"size": value}, "size", 0)
+		if err != nil || got != want {
+			t.Errorf("%s: got %d, %v, want %d", value, got, err, want)
+		}
+	}
+	if _, err := parseSize(map[string]string{"size": "big"}, "size", 0); err == nil {
+		t.Errorf("expected an error for a bad size")
+	}
+}
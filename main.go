@@ -3,37 +3,79 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"log"
 	"sync"
 
+	"bmwctrl/api"
 	"bmwctrl/device"
-	"bmwctrl/device/mock"
-	"bmwctrl/device/mpd"
-	"bmwctrl/device/spotify"
+	_ "bmwctrl/device/all"
+	"bmwctrl/history"
+	"bmwctrl/idle"
+	"bmwctrl/logging"
+	"bmwctrl/metrics"
+	"bmwctrl/mqttbridge"
+	"bmwctrl/options"
+	"bmwctrl/scrobble"
+	"bmwctrl/session"
+	"bmwctrl/systemd"
+	"bmwctrl/transport"
 	"os"
+	"time"
 
 	"github.com/urfave/cli"
 
 	"github.com/oandrew/ipod"
 	"github.com/oandrew/ipod/lingo-extremote"
 	"github.com/oandrew/ipod/lingo-general"
-	"github.com/oandrew/ipod/transport-serial"
+)
+
+var (
+	mainLog   = logging.New("main")
+	framesLog = logging.New("transport/frames")
 )
 
 type txLogger struct{}
 
 func (l *txLogger) Write(p []byte) (n int, err error) {
-	log.Println("<", hex.EncodeToString(p))
+	framesLog.Debug("<", "frame", hex.EncodeToString(p))
 	return len(p), nil
 }
 
 type rxLogger struct{}
 
 func (l *rxLogger) Write(p []byte) (n int, err error) {
-	log.Println(">", hex.EncodeToString(p))
+	framesLog.Debug(">", "frame", hex.EncodeToString(p))
 	return len(p), nil
 }
 
+// frameLoggers returns the writers that log frames going to and from the
+// transport, or nil if frame logging is off.
+func frameLoggers() (tx io.Writer, rx io.Writer) {
+	if !framesLog.Enabled(logging.LevelDebug) {
+		return nil, nil
+	}
+	return &txLogger{}, &rxLogger{}
+}
+
+// commandLogger returns the logger for the lingo a command belongs to.
+func commandLogger(cmd *ipod.Command) *logging.Logger {
+	if cmd.ID.LingoID() == general.LingoGeneralID {
+		return generalLog
+	}
+	return extremoteLog
+}
+
+// logCommand logs a command going to or from the car, if enabled.
+func logCommand(direction string, cmd *ipod.Command) {
+	logger := commandLogger(cmd)
+	if logger.Enabled(logging.LevelDebug) {
+		logger.Debug(direction, "id", fmt.Sprintf("%x", cmd.ID.CmdID()),
+			"type", fmt.Sprintf("%T", cmd.Payload), "payload", fmt.Sprintf("%+v", cmd.Payload))
+	}
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "bmwctrl"
@@ -48,98 +90,345 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "transport, t",
-			Usage:  "Use `TRANSPORT` to connects to the bmw",
+			Usage:  "Use `TRANSPORT` (serial, tcp, unix or pty) to connect to the bmw",
 			EnvVar: "BMWCTRL_TRANSPORT",
 		},
 		cli.StringFlag{
 			Name:   "transport-opts, o",
-			Usage:  "Set transport specific options.",
+			Usage:  "Set transport specific `OPTIONS`, as key=value pairs separated by commas.",
 			EnvVar: "BMWCTRL_TRANSPORT_OPTS",
 		},
 		cli.StringFlag{
 			Name:   "player, p",
-			Usage:  "Use 'PLAYER' to play music through the bmw.",
+			Value:  "mock",
+			Usage:  "Use `PLAYER` to play music through the bmw (see 'bmwctrl players')",
 			EnvVar: "BMWCTRL_PLAYER",
 		},
+		cli.StringFlag{
+			Name:   "player-opts",
+			Usage:  "Set player specific `OPTIONS`, as key=value pairs separated by commas.",
+			EnvVar: "BMWCTRL_PLAYER_OPTS",
+		},
 		cli.StringFlag{
 			Name:   "logfile, l",
-			Usage:  "Send all logs to `FILE` instead of stdout/stderr",
+			Usage:  "Append all logs to `FILE` instead of stderr",
 			EnvVar: "BMWCTRL_LOGFILE",
 		},
+		cli.StringFlag{
+			Name:   "log-rotate",
+			Usage:  "Set logfile rotation `OPTIONS`, e.g. \"size=2MB,keep=10,boot=true\"",
+			EnvVar: "BMWCTRL_LOG_ROTATE",
+		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "Set the log `LEVELS`, e.g. \"info,transport=debug,player/mpd=warn\"",
+			EnvVar: "BMWCTRL_LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "Write logs as `FORMAT` (text, logfmt or json)",
+			EnvVar: "BMWCTRL_LOG_FORMAT",
+		},
 		cli.BoolFlag{
 			Name:  "log-frames, f",
-			Usage: "Log all data frames to and from the bmw",
+			Usage: "Log all data frames to and from the bmw (same as --log-level transport/frames=debug)",
 		},
 		cli.BoolFlag{
 			Name:  "log-commands, c",
-			Usage: "Log all commands to and from the bmw",
+			Usage: "Log all commands to and from the bmw (same as --log-level general=debug,extremote=debug)",
 		},
 		cli.BoolFlag{
 			Name:  "log-timestamps, s",
 			Usage: "Prefix logs with a timestamp",
 		},
+		cli.StringFlag{
+			Name:   "mqtt",
+			Usage:  "Bridge to an MQTT broker, with `OPTIONS` such as \"broker=tcp://host:1883,prefix=car\"",
+			EnvVar: "BMWCTRL_MQTT",
+		},
+		cli.StringFlag{
+			Name:   "state",
+			Usage:  "Save the play queue and position in `OPTIONS`, e.g. \"file=/var/lib/bmwctrl/state.json\", and resume from it",
+			EnvVar: "BMWCTRL_STATE",
+		},
+		cli.StringFlag{
+			Name:   "history",
+			Usage:  "Record plays and skips in `OPTIONS`, e.g. \"file=/var/lib/bmwctrl/history.json,played=50\"",
+			EnvVar: "BMWCTRL_HISTORY",
+		},
+		cli.StringFlag{
+			Name:   "scrobble",
+			Usage:  "Submit plays from the history to ListenBrainz or Last.fm, with `OPTIONS` such as \"listenbrainz,token=TOKEN,queue=/var/lib/bmwctrl/scrobbles.json\"",
+			EnvVar: "BMWCTRL_SCROBBLE",
+		},
+		cli.StringFlag{
+			Name:   "idle",
+			Usage:  "Go idle when the car sleeps, with `OPTIONS` such as \"timeout=5m,gpio=/sys/class/gpio/gpio17/value,hook=/usr/local/bin/parked\"",
+			EnvVar: "BMWCTRL_IDLE",
+		},
+		cli.StringFlag{
+			Name:   "http",
+			Usage:  "Serve the status and control API on `ADDR`, e.g. \":8080\"",
+			EnvVar: "BMWCTRL_HTTP",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		decodeCommand,
+		playersCommand,
 	}
 
 	app.Action = func(c *cli.Context) error {
 
-		// Add timestamp prefixes if requested.  This could be useful during
-		// testing (i.e. when not running as a service.)
-		if c.Bool("log-timestamps") {
-			log.SetFlags(log.Lmicroseconds)
-		} else {
-			log.SetFlags(0)
+		// Add timestamps if requested.  This could be useful during
+		// testing (i.e. when not running as a service, where the journal
+		// adds its own.)
+		logging.SetTimestamps(c.Bool("log-timestamps"))
+		format, err := logging.ParseFormat(c.String("log-format"))
+		if err != nil {
+			mainLog.Fatal("Error setting log format", "err", err)
+		}
+		logging.SetFormat(format)
+		if c.Bool("log-frames") {
+			logging.SetLevel("transport/frames", logging.LevelDebug)
+		}
+		if c.Bool("log-commands") {
+			logging.SetLevel("general", logging.LevelDebug)
+			logging.SetLevel("extremote", logging.LevelDebug)
+		}
+		if err := logging.SetLevels(c.String("log-level")); err != nil {
+			mainLog.Fatal("Error setting log levels", "err", err)
 		}
 
-		// Setup the logger to output to a logfile instead of
-		// stdout, if requested.
+		// Setup the logger to output to a logfile instead of stderr, if
+		// requested.  The logfile is appended to, and rotated to keep it
+		// from filling the SD card.
 		logfile := c.String("logfile")
 		if logfile != "" {
-			f, err := os.Create(logfile)
+			opts, err := options.Parse(c.String("log-rotate"), "")
+			if err != nil {
+				mainLog.Fatal("Error parsing log rotation options", "err", err)
+			}
+			rotateOpts, err := logging.ParseRotateOptions(opts)
+			if err != nil {
+				mainLog.Fatal("Error parsing log rotation options", "err", err)
+			}
+			f, err := logging.OpenRotatingFile(logfile, rotateOpts)
 			if err != nil {
-				log.Fatalf("Error creating logfile '%s': %s", logfile, err)
-				return err
+				mainLog.Fatal("Error opening logfile", "path", logfile, "err", err)
 			}
-			log.SetOutput(f)
+			defer f.Close()
+			logging.SetOutput(f)
 		}
 
+		// Anything logged through the standard logger (e.g. by libraries)
+		// goes to the same place.
+		log.SetFlags(0)
+		log.SetOutput(mainLog.Writer(logging.LevelInfo))
+
 		// Open the device that connects to the bmw.
-		log.Println("BMWCTRL startup")
-		var transport ipod.FrameReadWriter
+		mainLog.Info("BMWCTRL startup")
+		var frameTransport ipod.FrameReadWriter
 		switch c.String("transport") {
 		case "serial":
-			transport = createSerialTransport(c)
+			frameTransport = createSerialTransport(c)
+		case "tcp", "unix":
+			frameTransport = createNetTransport(c, c.String("transport"))
+		case "pty":
+			frameTransport = createPtyTransport(c)
 		default:
-			transport = createConsoleTransport(c)
+			frameTransport = createConsoleTransport(c)
 		}
 
 		// Create a command writer for sending responses and notifications
-		// back to the car.
-		logCmds := c.Bool("log-commands")
+		// back to the car.  The session isn't known until the player is
+		// created, as the player needs the command writer.
 		cmdWriter := &CommandFrameWriter{
-			frameWriter: transport,
-			logCmds:     logCmds,
+			frameWriter: frameTransport,
 			mutex:       &sync.Mutex{},
 		}
 		notifications := device.NewPlayerNotifications(cmdWriter)
 
 		// Create a new player to handle the device behaviour.
-		var player device.Player
-		switch c.String("player") {
-		case "mpd":
-			player = mpd.NewPlayer(notifications)
-		case "spotify":
-			player = spotify.NewPlayer(notifications)
-		default:
-			player = mock.NewPlayer(notifications)
+		player, err := device.NewPlayer(c.String("player"), c.String("player-opts"), notifications)
+		if err != nil {
+			mainLog.Fatal("Error creating player", "player", c.String("player"), "err", err)
+		}
+		sess := session.New(player)
+		cmdWriter.session = sess
+		if t, ok := frameTransport.(*transport.Transport); ok {
+			sess.SetTransportStats(t.Stats)
+			registerTransportMetrics(t)
+		}
+
+		// Record what's listened to, if requested.  Players that use the
+		// history (e.g. for smart playlists) are given it first.
+		var tracker *history.Tracker
+		if c.String("history") != "" {
+			opts, err := options.Parse(c.String("history"), "file")
+			if err != nil {
+				mainLog.Fatal("Error parsing history options", "err", err)
+			}
+			historyOpts, err := history.ParseOptions(opts)
+			if err != nil {
+				mainLog.Fatal("Error parsing history options", "err", err)
+			}
+			store, err := history.Open(historyOpts.Path)
+			if err != nil {
+				mainLog.Fatal("Error reading the history", "path", historyOpts.Path, "err", err)
+			}
+			if user, ok := player.(device.HistoryUser); ok {
+				user.UseHistory(store.Get)
+			}
+			tracker = history.NewTracker(sess, store, historyOpts)
+		}
+
+		// Queue plays to be scrobbled, and submit them whenever the service
+		// can be reached, if requested.
+		var scrobbler *scrobble.Scrobbler
+		if c.String("scrobble") != "" {
+			if tracker == nil {
+				mainLog.Fatal("Scrobbling needs the play history (--history)")
+			}
+			opts, err := options.Parse(c.String("scrobble"), "service")
+			if err != nil {
+				mainLog.Fatal("Error parsing scrobble options", "err", err)
+			}
+			scrobbleOpts, err := scrobble.ParseOptions(opts)
+			if err != nil {
+				mainLog.Fatal("Error parsing scrobble options", "err", err)
+			}
+			scrobbler, err = scrobble.New(scrobbleOpts)
+			if err != nil {
+				mainLog.Fatal("Error reading the scrobble queue", "path", scrobbleOpts.Queue, "err", err)
+			}
+			tracker.OnPlay(func(play history.Play) {
+				scrobbler.Add(scrobble.Listen{
+					Artist:     play.Artist,
+					Title:      play.Title,
+					Album:      play.Album,
+					Length:     play.Length,
+					ListenedAt: play.Started,
+				})
+			})
+			scrobbler.Start()
+		}
+		if tracker != nil {
+			tracker.Start()
+		}
+
+		// Resume playback where it left off, and keep saving the state so
+		// it can be resumed next time, if requested.
+		var saver *stateSaver
+		if c.String("state") != "" {
+			opts, err := options.Parse(c.String("state"), "file")
+			if err != nil {
+				mainLog.Fatal("Error parsing state options", "err", err)
+			}
+			saver, err = newStateSaver(opts, c.String("player"), sess)
+			if err != nil {
+				mainLog.Fatal("Error parsing state options", "err", err)
+			}
+			saver.restore()
+			go saver.run()
+		}
+
+		// Publish to an MQTT broker, and take commands from it, if
+		// requested.
+		var bridge *mqttbridge.Bridge
+		if c.String("mqtt") != "" {
+			opts, err := options.Parse(c.String("mqtt"), "broker")
+			if err != nil {
+				mainLog.Fatal("Error parsing MQTT options", "err", err)
+			}
+			mqttOpts, err := mqttbridge.ParseOptions(opts)
+			if err != nil {
+				mainLog.Fatal("Error parsing MQTT options", "err", err)
+			}
+			bridge = mqttbridge.Start(sess, mqttOpts)
+		}
+
+		// Serve the status and control API, if requested.
+		var server *api.Server
+		if addr := c.String("http"); addr != "" {
+			server = api.NewServer(sess)
+			server.Handle("/metrics", metrics.Handler())
+			if err := server.Start(addr); err != nil {
+				mainLog.Fatal("Error starting HTTP server", "addr", addr, "err", err)
+			}
+		}
+
+		// Watch for the car going to sleep, if requested.  Playback is
+		// paused and the state saved, so that the car waking up (or the Pi
+		// losing power) finds it where it was left.
+		var monitor *idle.Monitor
+		if c.String("idle") != "" {
+			opts, err := options.Parse(c.String("idle"), "timeout")
+			if err != nil {
+				mainLog.Fatal("Error parsing idle options", "err", err)
+			}
+			idleOpts, err := idle.ParseOptions(opts)
+			if err != nil {
+				mainLog.Fatal("Error parsing idle options", "err", err)
+			}
+			monitor = idle.NewMonitor(idleOpts, sess.LastCommand, func() {
+				sess.Control("pause", "")
+				if saver != nil {
+					saver.save()
+				}
+				systemd.Status("Idle, the car is asleep")
+			}, func() {
+				systemd.Status("Active")
+			})
+			monitor.Start()
 		}
 
 		// Start off by requesting the bmw identify itself.
-		log.Printf("Connected, sending initial 'RequestIdentify'")
-		transport.WriteFrame([]byte{0xff, 0x55, 0x02, 0x00, 0x00, 0xfe})
+		mainLog.Info("Connected, sending initial 'RequestIdentify'")
+		frameTransport.WriteFrame([]byte{0x55, 0x02, 0x00, 0x00, 0xfe})
 
-		// Go into frame processing loop.
-		runFrameProcessingLoop(transport, cmdWriter, player, logCmds)
-		log.Println("BMWCTRL shutdown")
+		// Go into frame processing loop, and let systemd know we're up.
+		loop := newFrameLoop(frameTransport, cmdWriter, notifications, sess)
+		go loop.run()
+		systemd.Ready()
+		stopWatchdog := make(chan struct{})
+		if interval := systemd.WatchdogInterval(); interval > 0 {
+			go runWatchdog(interval, sess, stopWatchdog)
+		}
+
+		// Run until asked to stop (e.g. by systemd, when the Pi is shutting
+		// down), then stop everything in order: no more commands from the
+		// car, then no more remote control, then the last save of the state,
+		// and finally the player.
+		sig := waitForSignal()
+		mainLog.Info("Shutting down", "signal", sig)
+		systemd.Stopping()
+		close(stopWatchdog)
+		loop.stop()
+		if monitor != nil {
+			monitor.Close()
+		}
+		if server != nil {
+			server.Close()
+		}
+		if bridge != nil {
+			bridge.Close()
+		}
+		if saver != nil {
+			saver.close()
+		}
+		if tracker != nil {
+			tracker.Close()
+		}
+		if scrobbler != nil {
+			scrobbler.Close()
+		}
+		if player != nil {
+			if err := player.Close(); err != nil {
+				mainLog.Warn("Error closing player", "err", err)
+			}
+		}
+		mainLog.Info("BMWCTRL shutdown")
 		return nil
 	}
 
@@ -151,8 +440,8 @@ func main() {
 // without requiring additional output command buffers.
 type CommandFrameWriter struct {
 	frameWriter ipod.FrameWriter
-	logCmds     bool
 	mutex       *sync.Mutex
+	session     *session.Session
 }
 
 // WriteCommand writes out the specified command to the frame transport.
@@ -174,82 +463,196 @@ func (t *CommandFrameWriter) WriteCommand(cmd *ipod.Command) error {
 		return err
 	}
 	err = t.frameWriter.WriteFrame(buffer.Bytes())
-	if err == nil && t.logCmds {
-		log.Printf("< %x %T %+v", cmd.ID.CmdID(), cmd.Payload, cmd.Payload)
+	if err == nil {
+		logCommand("<", cmd)
+		countCommand("<", cmd)
+		if t.session != nil {
+			t.session.CommandSent(cmd)
+		}
 	}
 	return err
 }
 
-func runFrameProcessingLoop(frameTransport ipod.FrameReadWriter, cmdWriter ipod.CommandWriter, player device.Player, logCmds bool) {
-	identified := false
+// frameLoop reads frames from the car, and handles the commands in them,
+// until it is stopped.
+type frameLoop struct {
+	transport     ipod.FrameReadWriter
+	cmdWriter     ipod.CommandWriter
+	notifications *device.PlayerNotifications
+	session       *session.Session
+	handling      sync.Mutex // Held while a command is handled.
+	stopping      chan struct{}
+	done          chan struct{}
+}
+
+func newFrameLoop(frameTransport ipod.FrameReadWriter, cmdWriter ipod.CommandWriter, notifications *device.PlayerNotifications, sess *session.Session) *frameLoop {
+	return &frameLoop{
+		transport:     frameTransport,
+		cmdWriter:     cmdWriter,
+		notifications: notifications,
+		session:       sess,
+		stopping:      make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+func (l *frameLoop) run() {
+	defer close(l.done)
 	for {
-		frame, err := frameTransport.ReadFrame()
-		if err != nil {
-			continue
+		frame, err := l.transport.ReadFrame()
+		select {
+		case <-l.stopping:
+			return
+		default:
 		}
-
-		reader := ipod.NewPacketReader(bytes.NewReader(frame))
-		packet, err := reader.ReadPacket()
 		if err != nil {
-			log.Println(err)
 			continue
 		}
 
-		var cmd ipod.Command
-		err = cmd.UnmarshalBinary(packet)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		if logCmds {
-			log.Printf("> %x %T %+v", cmd.ID.CmdID(), cmd.Payload, cmd.Payload)
+		l.handling.Lock()
+		select {
+		case <-l.stopping:
+			l.handling.Unlock()
+			return
+		default:
 		}
+		l.handleFrame(frame)
+		l.handling.Unlock()
+	}
+}
 
-		// Throw out any frames that occur before the initial identification
-		// has occured.  Not doing so caused bugs over the comm channel that
-		// we can't recover from (car aborts commands mid-frame, which is
-		// very difficult for us to detect.) Ignoring the commands eventually
-		// causes the car to go aback into an identify loop.
-		lingo := cmd.ID.LingoID()
-		if !identified {
-			if lingo == general.LingoGeneralID && cmd.ID.CmdID() == 0x01 {
-				identified = true
-			} else {
-				log.Println("[WARN] Not yet identified, ignoring command.")
-				continue
-			}
+// stop stops the loop, once the command being handled (if any) has been
+// answered.  The transport is closed, as that is the only way to interrupt
+// a read that is waiting for the car.
+func (l *frameLoop) stop() {
+	close(l.stopping)
+	acquired := make(chan struct{})
+	go func() {
+		l.handling.Lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(drainTimeout):
+		mainLog.Warn("Gave up waiting for the command being handled")
+	}
+
+	if closer, ok := l.transport.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			mainLog.Warn("Error closing transport", "err", err)
 		}
+	}
+
+	// Let the loop see that it is stopping, if it was about to handle a
+	// command.
+	go func() {
+		<-acquired
+		l.handling.Unlock()
+	}()
+	select {
+	case <-l.done:
+	case <-time.After(drainTimeout):
+		mainLog.Warn("Gave up waiting for the frame processing loop")
+	}
+}
+
+// handleFrame decodes a frame from the car, and handles the command in it.
+func (l *frameLoop) handleFrame(frame []byte) {
+	reader := ipod.NewPacketReader(bytes.NewReader(frame))
+	packet, err := reader.ReadPacket()
+	if err != nil {
+		l.session.PacketMalformed()
+		mainLog.Warn("Dropping malformed packet", "frame", hex.EncodeToString(frame), "err", err)
+		return
+	}
+
+	var cmd ipod.Command
+	err = cmd.UnmarshalBinary(packet)
+	if err != nil {
+		l.session.PacketMalformed()
+		mainLog.Warn("Dropping undecodable command", "packet", hex.EncodeToString(packet), "err", err)
+		return
+	}
+	start := time.Now()
+	logCommand(">", &cmd)
+	countCommand(">", &cmd)
+	l.session.CommandReceived(&cmd)
 
-		// Handle the 2 different lingos that are in play with this controller.
-		switch lingo {
-		case general.LingoGeneralID:
-			handleGeneralLingo(&cmd, cmdWriter)
-		case extremote.LingoExtRemotelID:
-			handleExtendedLingo(&cmd, cmdWriter, player)
+	// Commands used to be thrown out until the car identified itself,
+	// because frames the car aborted mid-way would get mangled into
+	// garbage commands.  The transport now validates and resynchronises
+	// frames, so anything that makes it this far is well-formed, and is
+	// safe to act on.  This matters when bmwctrl restarts while the car
+	// is awake, as the car carries on without identifying again.
+	//
+	// An identify after the first means the car restarted the
+	// identification sequence, usually because it didn't like (or
+	// didn't get) an answer.
+	lingo := cmd.ID.LingoID()
+	if lingo == general.LingoGeneralID && cmd.ID.CmdID() == 0x01 {
+		identifyMetric.Inc()
+		if l.session.IsIdentified() {
+			identifyRestartsMetric.Inc()
 		}
+		l.session.Identified()
+	} else if !l.session.IsIdentified() {
+		mainLog.Info("Not yet identified, accepting command anyway", "id", fmt.Sprintf("%x", cmd.ID.CmdID()))
 	}
+
+	// Handle the 2 different lingos that are in play with this controller.
+	switch lingo {
+	case general.LingoGeneralID:
+		handleGeneralLingo(&cmd, l.cmdWriter)
+	case extremote.LingoExtRemotelID:
+		l.session.WithPlayer(func(player device.Player) {
+			handleExtendedLingo(&cmd, l.cmdWriter, player, l.notifications, l.session)
+		})
+	}
+	observeLatency(&cmd, start)
 }
 
 func createSerialTransport(c *cli.Context) ipod.FrameReadWriter {
-	device := c.String("transport-opts")
-	log.Println("Opening serial device:", device)
-	options := serial.Options{
-		PortName: device,
-		BaudRate: 9600,
-		DataBits: 8,
-		StopBits: 1,
+	opts, err := options.Parse(c.String("transport-opts"), "device")
+	if err != nil {
+		mainLog.Fatal("Error parsing serial options", "err", err)
 	}
-	if c.Bool("log-frames") {
-		options.Tx = &txLogger{}
-		options.Rx = &rxLogger{}
-		log.Println("Enabling frame logging")
+	serialOpts, err := transport.ParseSerialOptions(opts)
+	if err != nil {
+		mainLog.Fatal("Error parsing serial options", "err", err)
 	}
-	transport, err := serial.NewTransport(options)
+	mainLog.Info("Opening serial device", "settings", serialOpts)
+	tx, rx := frameLoggers()
+	t, err := transport.OpenSerial(serialOpts, tx, rx)
 	if err != nil {
-		log.Fatalln("Error opening serial device:", err)
-		return nil
+		mainLog.Fatal("Error opening serial device", "err", err)
+	}
+	return t
+}
+
+func createNetTransport(c *cli.Context, network string) ipod.FrameReadWriter {
+	opts, err := options.Parse(c.String("transport-opts"), "connect")
+	if err != nil {
+		mainLog.Fatal("Error parsing transport options", "network", network, "err", err)
+	}
+	tx, rx := frameLoggers()
+	t, err := transport.OpenNet(network, opts, tx, rx)
+	if err != nil {
+		mainLog.Fatal("Error opening transport", "network", network, "err", err)
+	}
+	return t
+}
+
+func createPtyTransport(c *cli.Context) ipod.FrameReadWriter {
+	opts, err := options.Parse(c.String("transport-opts"), "link")
+	if err != nil {
+		mainLog.Fatal("Error parsing pty options", "err", err)
+	}
+	tx, rx := frameLoggers()
+	t, err := transport.OpenPty(opts, tx, rx)
+	if err != nil {
+		mainLog.Fatal("Error creating pseudo-terminal", "err", err)
 	}
-	return transport
+	return t
 }
 
 func createConsoleTransport(c *cli.Context) ipod.FrameReadWriter {
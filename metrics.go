@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"bmwctrl/metrics"
+	"bmwctrl/protocol"
+	"bmwctrl/transport"
+
+	"github.com/oandrew/ipod"
+)
+
+var (
+	commandsMetric = metrics.NewCounterVec("bmwctrl_commands_total",
+		"Commands to (dir=tx) and from (dir=rx) the car.", "dir", "lingo", "id", "command")
+	unhandledMetric = metrics.NewCounterVec("bmwctrl_commands_unhandled_total",
+		"Commands from the car that weren't handled.", "lingo", "id", "command")
+	latencyMetric = metrics.NewHistogramVec("bmwctrl_response_latency_seconds",
+		"Time taken to handle a command from the car, including sending the response.",
+		metrics.DefaultBuckets, "lingo", "command")
+	identifyMetric = metrics.NewCounter("bmwctrl_identify_total",
+		"Identify commands from the car.")
+	identifyRestartsMetric = metrics.NewCounter("bmwctrl_identify_restarts_total",
+		"Identify commands after the first, where the car restarted the identification sequence.")
+)
+
+// countCommand counts a command going to (dir "<") or from (dir ">") the
+// car.
+func countCommand(dir string, cmd *ipod.Command) {
+	direction := "rx"
+	if dir == "<" {
+		direction = "tx"
+	}
+	commandsMetric.With(direction, protocol.LingoName(cmd.ID.LingoID()),
+		fmt.Sprintf("%x", cmd.ID.CmdID()), protocol.CommandName(cmd)).Inc()
+}
+
+// countUnhandled counts a command from the car that wasn't handled.
+func countUnhandled(cmd *ipod.Command) {
+	unhandledMetric.With(protocol.LingoName(cmd.ID.LingoID()),
+		fmt.Sprintf("%x", cmd.ID.CmdID()), protocol.CommandName(cmd)).Inc()
+}
+
+// observeLatency records how long a command from the car took to handle.
+func observeLatency(cmd *ipod.Command, start time.Time) {
+	latencyMetric.With(protocol.LingoName(cmd.ID.LingoID()), protocol.CommandName(cmd)).
+		Observe(time.Since(start).Seconds())
+}
+
+// registerTransportMetrics exposes the transport's frame counters.
+func registerTransportMetrics(t *transport.Transport) {
+	metrics.NewCounterFunc("bmwctrl_frames_received_total", "Valid frames received from the car.",
+		func() uint64 { return t.Stats().Frames })
+	metrics.NewCounterFunc("bmwctrl_frames_sent_total", "Frames sent to the car.",
+		func() uint64 { return t.Stats().Sent })
+	metrics.NewCounterFunc("bmwctrl_frames_bad_total", "Frames dropped for a bad length or checksum, or cut short.",
+		func() uint64 { return t.Stats().BadFrames })
+	metrics.NewCounterFunc("bmwctrl_skipped_bytes_total", "Noise bytes skipped between frames.",
+		func() uint64 { return t.Stats().Skipped })
+}
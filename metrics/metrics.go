@@ -0,0 +1,313 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric is a metric that can be written in the Prometheus text format.
+type Metric interface {
+	Name() string
+	writeText(w io.Writer)
+}
+
+// Registry holds a set of metrics, and writes them out when scraped.
+type Registry struct {
+	mutex   sync.Mutex
+	metrics map[string]Metric
+}
+
+// Default is the registry used by the New functions, and served by Handler.
+var Default = NewRegistry()
+
+// NewRegistry returns an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]Metric{}}
+}
+
+// Register adds a metric to the registry.  Registering two metrics with
+// the same name is a programming error, so panics.
+func (r *Registry) Register(m Metric) {
+	defer r.mutex.Unlock()
+	r.mutex.Lock()
+	if _, ok := r.metrics[m.Name()]; ok {
+		panic("metrics: " + m.Name() + " registered twice")
+	}
+	r.metrics[m.Name()] = m
+}
+
+// WriteText writes all the metrics in the Prometheus text format, sorted by
+// name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.metrics))
+	for name := range r.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]Metric, len(names))
+	for i, name := range names {
+		metrics[i] = r.metrics[name]
+	}
+	r.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.writeText(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.WriteText(w)
+	})
+}
+
+// Counter is a count that only goes up.
+type Counter struct {
+	value uint64 // First, so it is aligned for atomic use on 32 bit ARM.
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.value, 1)
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+// Value returns the count.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+// CounterVec is a set of counters, one for each combination of label
+// values.
+type CounterVec struct {
+	name, help string
+	labels     []string
+	mutex      sync.Mutex
+	counters   map[string]*Counter
+	values     map[string][]string
+}
+
+// NewCounter registers a counter with no labels.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// NewCounterVec registers a set of counters with the given labels.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	v := &CounterVec{
+		name:     name,
+		help:     help,
+		labels:   labels,
+		counters: map[string]*Counter{},
+		values:   map[string][]string{},
+	}
+	Default.Register(v)
+	return v
+}
+
+// Name returns the name of the counters.
+func (v *CounterVec) Name() string {
+	return v.name
+}
+
+// With returns the counter for the label values, which are given in the
+// same order as the labels.
+func (v *CounterVec) With(values ...string) *Counter {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	defer v.mutex.Unlock()
+	v.mutex.Lock()
+	c, ok := v.counters[key]
+	if !ok {
+		c = &Counter{}
+		v.counters[key] = c
+		v.values[key] = append([]string(nil), values...)
+	}
+	return c
+}
+
+func (v *CounterVec) writeText(w io.Writer) {
+	writeHeader(w, v.name, v.help, "counter")
+	v.mutex.Lock()
+	keys := sortedKeys(v.values)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %d\n", v.name, labelString(v.labels, v.values[key], "", ""), v.counters[key].Value())
+	}
+	v.mutex.Unlock()
+}
+
+// counterFunc is a counter whose value is read from elsewhere when scraped.
+type counterFunc struct {
+	name, help string
+	fn         func() uint64
+}
+
+// NewCounterFunc registers a counter whose value is kept elsewhere (e.g. by
+// the transport), and read by fn when scraped.
+func NewCounterFunc(name, help string, fn func() uint64) {
+	Default.Register(&counterFunc{name, help, fn})
+}
+
+func (c *counterFunc) Name() string {
+	return c.name
+}
+
+func (c *counterFunc) writeText(w io.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	fmt.Fprintf(w, "%s %d\n", c.name, c.fn())
+}
+
+// DefaultBuckets are histogram buckets, in seconds, suited to the time
+// taken to answer the car.
+var DefaultBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// Histogram counts observations (e.g. latencies) in buckets.
+type Histogram struct {
+	mutex   sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+// Observe adds an observation to the histogram.
+func (h *Histogram) Observe(value float64) {
+	defer h.mutex.Unlock()
+	h.mutex.Lock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// HistogramVec is a set of histograms, one for each combination of label
+// values.
+type HistogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	mutex      sync.Mutex
+	histograms map[string]*Histogram
+	values     map[string][]string
+}
+
+// NewHistogramVec registers a set of histograms with the given bucket upper
+// bounds, and labels.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	v := &HistogramVec{
+		name:       name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		histograms: map[string]*Histogram{},
+		values:     map[string][]string{},
+	}
+	Default.Register(v)
+	return v
+}
+
+// Name returns the name of the histograms.
+func (v *HistogramVec) Name() string {
+	return v.name
+}
+
+// With returns the histogram for the label values, which are given in the
+// same order as the labels.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	defer v.mutex.Unlock()
+	v.mutex.Lock()
+	h, ok := v.histograms[key]
+	if !ok {
+		h = &Histogram{buckets: v.buckets, counts: make([]uint64, len(v.buckets))}
+		v.histograms[key] = h
+		v.values[key] = append([]string(nil), values...)
+	}
+	return h
+}
+
+func (v *HistogramVec) writeText(w io.Writer) {
+	writeHeader(w, v.name, v.help, "histogram")
+	v.mutex.Lock()
+	keys := sortedKeys(v.values)
+	for _, key := range keys {
+		h := v.histograms[key]
+		values := v.values[key]
+		h.mutex.Lock()
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelString(v.labels, values, "le", formatFloat(bound)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, labelString(v.labels, values, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, labelString(v.labels, values, "", ""), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, labelString(v.labels, values, "", ""), h.count)
+		h.mutex.Unlock()
+	}
+	v.mutex.Unlock()
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labelString formats labels as {a="1",b="2"}, with an extra label (e.g.
+// le for histogram buckets) at the end, if given.
+func labelString(labels, values []string, extraLabel, extraValue string) string {
+	if extraLabel != "" {
+		labels = append(append([]string(nil), labels...), extraLabel)
+		values = append(append([]string(nil), values...), extraValue)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, label := range labels {
+		parts[i] = label + `="` + escapeLabel(values[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
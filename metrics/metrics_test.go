@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	commands := NewCounterVec("test_commands_total", "Commands.", "dir", "command")
+	commands.With("rx", "GetPlayStatus").Inc()
+	commands.With("rx", "GetPlayStatus").Inc()
+	commands.With("tx", `Say "hi"`).Add(3)
+	NewCounterFunc("test_frames_total", "Frames.", func() uint64 { return 7 })
+	latency := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.01, 0.1}, "command")
+	latency.With("Identify").Observe(0.005)
+	latency.With("Identify").Observe(0.05)
+
+	var buf bytes.Buffer
+	if err := Default.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_commands_total Commands.
+# TYPE test_commands_total counter
+test_commands_total{dir="rx",command="GetPlayStatus"} 2
+test_commands_total{dir="tx",command="Say \"hi\""} 3
+# HELP test_frames_total Frames.
+# TYPE test_frames_total counter
+test_frames_total 7
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{command="Identify",le="0.01"} 1
+test_latency_seconds_bucket{command="Identify",le="0.1"} 2
+test_latency_seconds_bucket{command="Identify",le="+Inf"} 2
+test_latency_seconds_sum{command="Identify"} 0.055
+test_latency_seconds_count{command="Identify"} 2
+`
+	if got := buf.String(); !strings.Contains(got, want) {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
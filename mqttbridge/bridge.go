@@ -0,0 +1,323 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/logging"
+	"bmwctrl/options"
+	"bmwctrl/session"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+var logger = logging.New("mqtt")
+
+// How often the session is checked for changes to publish.
+const pollInterval = time.Second
+
+// How long a repeated error is held back for, so a failing backend doesn't
+// flood the broker.
+const errorHoldOff = time.Minute
+
+// Options controls the connection to the broker, and what is published.
+type Options struct {
+	Broker   string        // e.g. tcp://homeassistant:1883
+	ClientID string        // MQTT client ID
+	Username string        // Username, if the broker needs one.
+	Password string        // Password, if the broker needs one.
+	Prefix   string        // Prefix of all the topics.
+	Interval time.Duration // How often the position and counters are published.
+	QoS      byte          // QoS of everything published, and the command subscription.
+}
+
+// ParseOptions reads the MQTT settings from key=value options.
+//
+//	broker=URL         broker to connect to, e.g. tcp://homeassistant:1883
+//	client=ID          client ID (default bmwctrl)
+//	user=NAME          username
+//	password=SECRET    password
+//	prefix=TOPIC       prefix of all topics (default bmwctrl)
+//	interval=DURATION  how often the position is published while playing (default 10s)
+//	qos=0|1|2          (default 0)
+func ParseOptions(opts options.Options) (Options, error) {
+	o := Options{}
+	err := opts.Check("broker", "client", "user", "password", "prefix", "interval", "qos")
+	if err != nil {
+		return o, err
+	}
+	o.Broker = opts.String("broker", "")
+	if o.Broker == "" {
+		return o, fmt.Errorf("option 'broker' is required")
+	}
+	if !strings.Contains(o.Broker, "://") {
+		o.Broker = "tcp://" + o.Broker
+	}
+	o.ClientID = opts.String("client", "bmwctrl")
+	o.Username = opts.String("user", "")
+	o.Password = opts.String("password", "")
+	o.Prefix = strings.TrimSuffix(opts.String("prefix", "bmwctrl"), "/")
+	if o.Interval, err = opts.Duration("interval", 10*time.Second); err != nil {
+		return o, err
+	}
+	qos, err := opts.Int("qos", 0)
+	if err != nil {
+		return o, err
+	}
+	if qos < 0 || qos > 2 {
+		return o, fmt.Errorf("option 'qos' must be 0, 1 or 2, got '%d'", qos)
+	}
+	o.QoS = byte(qos)
+	return o, nil
+}
+
+// Bridge publishes the session to an MQTT broker, and takes remote control
+// commands from it.  All topics are under the prefix:
+//
+//	status        "online" or "offline" (retained, and the last will)
+//	state         "playing", "paused" or "stopped" (retained)
+//	now_playing   the current track and position, as JSON (retained)
+//	session       identify status, shuffle, repeat and counters, as JSON (retained)
+//	error         warnings and errors, as JSON
+//	command       commands to run, e.g. "next" or "seek 1m30s"
+type Bridge struct {
+	opts    Options
+	session *session.Session
+	client  mqtt.Client
+	publish func(topic string, retained bool, payload []byte)
+
+	mutex        sync.Mutex
+	lastState    string
+	lastTrack    string
+	lastSession  string
+	lastPosition time.Time
+	lastCounters time.Time
+	lastErrors   map[string]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start connects to the broker in the background, and starts publishing.
+// The broker is often out of reach in the car, so connecting is retried
+// until it succeeds, and again whenever the connection drops.
+func Start(s *session.Session, opts Options) *Bridge {
+	b := newBridge(s, opts, nil)
+	clientOpts := mqtt.NewClientOptions().
+		AddBroker(opts.Broker).
+		SetClientID(opts.ClientID).
+		SetUsername(opts.Username).
+		SetPassword(opts.Password).
+		SetWill(b.topic("status"), "offline", opts.QoS, true).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetMaxReconnectInterval(time.Minute).
+		SetOnConnectHandler(b.connected).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			logger.Warn("Connection lost", "broker", opts.Broker, "err", err)
+		})
+	b.client = mqtt.NewClient(clientOpts)
+	b.publish = b.publishToBroker
+	logger.Info("Connecting", "broker", opts.Broker, "prefix", opts.Prefix)
+	b.client.Connect()
+
+	logging.AddHook(logging.LevelWarn, b.logged)
+	go b.run()
+	return b
+}
+
+func newBridge(s *session.Session, opts Options, publish func(topic string, retained bool, payload []byte)) *Bridge {
+	return &Bridge{
+		opts:       opts,
+		session:    s,
+		publish:    publish,
+		lastErrors: map[string]time.Time{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Close marks bmwctrl offline, and disconnects from the broker.
+func (b *Bridge) Close() {
+	close(b.stop)
+	<-b.done
+	if b.client.IsConnected() {
+		b.client.Publish(b.topic("status"), b.opts.QoS, true, "offline").WaitTimeout(time.Second)
+	}
+	b.client.Disconnect(250)
+}
+
+func (b *Bridge) topic(name string) string {
+	return b.opts.Prefix + "/" + name
+}
+
+func (b *Bridge) publishToBroker(topic string, retained bool, payload []byte) {
+	if !b.client.IsConnected() {
+		return
+	}
+	b.client.Publish(topic, b.opts.QoS, retained, payload)
+}
+
+// connected announces that bmwctrl is online, subscribes to commands, and
+// republishes everything, as the broker may have restarted without keeping
+// the retained messages.
+func (b *Bridge) connected(client mqtt.Client) {
+	logger.Info("Connected", "broker", b.opts.Broker)
+	client.Publish(b.topic("status"), b.opts.QoS, true, "online")
+	client.Subscribe(b.topic("command"), b.opts.QoS, func(client mqtt.Client, msg mqtt.Message) {
+		b.command(string(msg.Payload()))
+	})
+	b.mutex.Lock()
+	b.lastState = ""
+	b.lastTrack = ""
+	b.lastSession = ""
+	b.mutex.Unlock()
+}
+
+func (b *Bridge) run() {
+	defer close(b.done)
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			b.update(b.session.Status(), time.Now())
+		case <-b.stop:
+			return
+		}
+	}
+}
+
+type nowPlaying struct {
+	State    string `json:"state"`
+	Index    int    `json:"index"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Length   int    `json:"length"`
+	Position int    `json:"position"`
+}
+
+type sessionState struct {
+	Identified  bool             `json:"identified"`
+	Shuffle     string           `json:"shuffle"`
+	Repeat      string           `json:"repeat"`
+	QueueLength int              `json:"queue_length"`
+	LastCommand *time.Time       `json:"last_command,omitempty"`
+	Counters    session.Counters `json:"counters"`
+}
+
+// update publishes whatever has changed.  The position is published every
+// Interval while playing, and the counters every Interval.
+func (b *Bridge) update(status session.Status, now time.Time) {
+	defer b.mutex.Unlock()
+	b.mutex.Lock()
+
+	if status.State != b.lastState {
+		b.publish(b.topic("state"), true, []byte(status.State))
+	}
+
+	playing := nowPlaying{State: status.State}
+	if status.Track != nil {
+		playing.Index = status.Track.Index
+		playing.Title = status.Track.Title
+		playing.Artist = status.Track.Artist
+		playing.Album = status.Track.Album
+		playing.Length = status.Track.Length
+	}
+	track, _ := json.Marshal(playing)
+	positionDue := status.State == "playing" && now.Sub(b.lastPosition) >= b.opts.Interval
+	if string(track) != b.lastTrack || status.State != b.lastState || positionDue {
+		if status.Track != nil {
+			playing.Position = status.Track.Position
+		}
+		payload, _ := json.Marshal(playing)
+		b.publish(b.topic("now_playing"), true, payload)
+		b.lastTrack = string(track)
+		b.lastPosition = now
+	}
+	b.lastState = status.State
+
+	state := sessionState{
+		Identified:  status.Identified,
+		Shuffle:     status.Shuffle,
+		Repeat:      status.Repeat,
+		QueueLength: status.QueueLength,
+	}
+	key, _ := json.Marshal(state)
+	if string(key) != b.lastSession || now.Sub(b.lastCounters) >= b.opts.Interval {
+		state.LastCommand = status.LastCommand
+		state.Counters = status.Counters
+		payload, _ := json.Marshal(state)
+		b.publish(b.topic("session"), true, payload)
+		b.lastSession = string(key)
+		b.lastCounters = now
+	}
+}
+
+// command runs a command received from the broker, e.g. "seek 1m30s".
+func (b *Bridge) command(payload string) {
+	fields := strings.Fields(payload)
+	if len(fields) == 0 {
+		return
+	}
+	arg := strings.Join(fields[1:], " ")
+	logger.Info("Remote control", "command", fields[0], "arg", arg)
+	if err := b.session.Control(fields[0], arg); err != nil {
+		b.publishError(logging.Entry{
+			Time:      time.Now(),
+			Level:     logging.LevelWarn,
+			Subsystem: "mqtt",
+			Msg:       "Bad command",
+			KeyVals:   []interface{}{"command", payload, "err", err},
+		})
+		return
+	}
+	b.update(b.session.Status(), time.Now())
+}
+
+type errorMessage struct {
+	Time      time.Time         `json:"time"`
+	Level     string            `json:"level"`
+	Subsystem string            `json:"subsystem"`
+	Msg       string            `json:"msg"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+// logged publishes warnings and errors logged by other subsystems.  The
+// bridge's own are skipped, as they are often about the broker being out of
+// reach.
+func (b *Bridge) logged(e logging.Entry) {
+	if e.Subsystem == "mqtt" {
+		return
+	}
+	b.publishError(e)
+}
+
+func (b *Bridge) publishError(e logging.Entry) {
+	key := e.Subsystem + "\xff" + e.Msg
+	b.mutex.Lock()
+	if last, ok := b.lastErrors[key]; ok && e.Time.Sub(last) < errorHoldOff {
+		b.mutex.Unlock()
+		return
+	}
+	b.lastErrors[key] = e.Time
+	b.mutex.Unlock()
+
+	msg := errorMessage{Time: e.Time, Level: e.Level.String(), Subsystem: e.Subsystem, Msg: e.Msg}
+	for i := 0; i+1 < len(e.KeyVals); i += 2 {
+		if msg.Fields == nil {
+			msg.Fields = map[string]string{}
+		}
+		msg.Fields[fmt.Sprint(e.KeyVals[i])] = fmt.Sprint(e.KeyVals[i+1])
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	b.publish(b.topic("error"), false, payload)
+}
@@ -0,0 +1,104 @@
+package mqttbridge
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"bmwctrl/device/mock"
+	"bmwctrl/logging"
+	"bmwctrl/options"
+	"bmwctrl/session"
+)
+
+type message struct {
+	topic    string
+	retained bool
+	payload  string
+}
+
+func testBridge() (*Bridge, *[]message, func()) {
+	var published []message
+	player := mock.NewPlayer(nil)
+	opts := Options{Prefix: "car", Interval: 10 * time.Second}
+	b := newBridge(session.New(player), opts, func(topic string, retained bool, payload []byte) {
+		published = append(published, message{topic, retained, string(payload)})
+	})
+	return b, &published, func() { player.Close() }
+}
+
+func TestUpdate(t *testing.T) {
+	b, published, cleanup := testBridge()
+	defer cleanup()
+	start := time.Now()
+	playing := session.Status{
+		State:   "playing",
+		Track:   &session.Track{Title: "Song", Length: 10000, Position: 1000},
+		Shuffle: "off",
+		Repeat:  "off",
+	}
+	b.update(playing, start)
+	if len(*published) != 3 {
+		t.Fatalf("first update published %+v", *published)
+	}
+	if m := (*published)[0]; m.topic != "car/state" || m.payload != "playing" || !m.retained {
+		t.Errorf("state = %+v", m)
+	}
+	var track nowPlaying
+	json.Unmarshal([]byte((*published)[1].payload), &track)
+	if (*published)[1].topic != "car/now_playing" || track.Title != "Song" || track.Position != 1000 {
+		t.Errorf("now playing = %+v", (*published)[1])
+	}
+
+	// Nothing has changed but the position, which isn't due yet.
+	*published = nil
+	playing.Track.Position = 2000
+	b.update(playing, start.Add(time.Second))
+	if len(*published) != 0 {
+		t.Errorf("unchanged update published %+v", *published)
+	}
+	b.update(playing, start.Add(10*time.Second))
+	if len(*published) != 2 || (*published)[0].topic != "car/now_playing" || (*published)[1].topic != "car/session" {
+		t.Errorf("update after the interval published %+v", *published)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	b, published, cleanup := testBridge()
+	defer cleanup()
+	b.command("shuffle albums")
+	if b.session.Shuffle() != 2 {
+		t.Errorf("shuffle = %d", b.session.Shuffle())
+	}
+	*published = nil
+	b.command("shuffle sideways")
+	if len(*published) != 1 || (*published)[0].topic != "car/error" || !strings.Contains((*published)[0].payload, "sideways") {
+		t.Errorf("bad command published %+v", *published)
+	}
+}
+
+func TestLogged(t *testing.T) {
+	b, published, cleanup := testBridge()
+	defer cleanup()
+	now := time.Now()
+	entry := logging.Entry{Time: now, Level: logging.LevelWarn, Subsystem: "player/mpd", Msg: "MPD request failed"}
+	b.logged(entry)
+	entry.Time = now.Add(time.Second)
+	b.logged(entry)
+	b.logged(logging.Entry{Time: now, Level: logging.LevelWarn, Subsystem: "mqtt", Msg: "Connection lost"})
+	if len(*published) != 1 {
+		t.Errorf("published %+v", *published)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, _ := options.Parse("homeassistant:1883,prefix=car/", "broker")
+	o, err := ParseOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Broker != "tcp://homeassistant:1883" || o.Prefix != "car" || o.ClientID != "bmwctrl" {
+		t.Errorf("options = %+v", o)
+	}
+}
@@ -0,0 +1,103 @@
+package options
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options holds the key=value pairs given to a transport or player on the
+// command line, for example "device=/dev/ttyUSB0,baud=19200,parity=even".
+type Options map[string]string
+
+// Parse splits a comma separated list of key=value pairs into Options.  A
+// single value without a key is stored under the positional key, which lets
+// the common case stay short (e.g. "/dev/ttyUSB0" instead of
+// "device=/dev/ttyUSB0".)
+func Parse(s string, positional string) (Options, error) {
+	opts := Options{}
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		key, value := positional, field
+		if i := strings.Index(field, "="); i >= 0 {
+			key, value = strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:])
+		} else if positional == "" {
+			return nil, fmt.Errorf("option '%s' is missing a value", field)
+		}
+		if _, ok := opts[key]; ok {
+			return nil, fmt.Errorf("option '%s' is set more than once", key)
+		}
+		opts[key] = value
+	}
+	return opts, nil
+}
+
+// Check returns an error if any of the options is not one of the known keys.
+// This catches typos that would otherwise silently fall back to defaults.
+func (o Options) Check(known ...string) error {
+	for key := range o {
+		found := false
+		for _, k := range known {
+			if k == key {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("unknown option '%s'", key)
+		}
+	}
+	return nil
+}
+
+// String returns the value of key, or def if it isn't set.
+func (o Options) String(key string, def string) string {
+	if value, ok := o[key]; ok {
+		return value
+	}
+	return def
+}
+
+// Int returns the value of key as an integer, or def if it isn't set.
+func (o Options) Int(key string, def int) (int, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return def, fmt.Errorf("option '%s' must be an integer, got '%s'", key, value)
+	}
+	return i, nil
+}
+
+// Bool returns the value of key as a boolean, or def if it isn't set.
+func (o Options) Bool(key string, def bool) (bool, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def, fmt.Errorf("option '%s' must be true or false, got '%s'", key, value)
+	}
+	return b, nil
+}
+
+// Duration returns the value of key as a duration (e.g. "100ms"), or def if
+// it isn't set.
+func (o Options) Duration(key string, def time.Duration) (time.Duration, error) {
+	value, ok := o[key]
+	if !ok {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return def, fmt.Errorf("option '%s' must be a duration, got '%s'", key, value)
+	}
+	return d, nil
+}
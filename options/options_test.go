@@ -0,0 +1,34 @@
+package options
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	opts, err := Parse("/dev/ttyUSB0, baud=19200,timeout=100ms", "device")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device := opts.String("device", ""); device != "/dev/ttyUSB0" {
+		t.Errorf("got device '%s'", device)
+	}
+	if baud, err := opts.Int("baud", 9600); err != nil || baud != 19200 {
+		t.Errorf("got baud %d, %v", baud, err)
+	}
+	if timeout, err := opts.Duration("timeout", 0); err != nil || timeout != 100*time.Millisecond {
+		t.Errorf("got timeout %s, %v", timeout, err)
+	}
+	if err := opts.Check("device", "baud"); err == nil {
+		t.Errorf("expected an error for the unknown 'timeout' option")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	if _, err := Parse("a=1,a=2", ""); err == nil {
+		t.Errorf("expected an error for a repeated option")
+	}
+	if _, err := Parse("novalue", ""); err == nil {
+		t.Errorf("expected an error for a missing value")
+	}
+}
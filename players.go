@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"bmwctrl/device"
+
+	"github.com/urfave/cli"
+)
+
+var playersCommand = cli.Command{
+	Name:  "players",
+	Usage: "List the players, and their options",
+	Action: func(c *cli.Context) error {
+		printBackends(os.Stdout, device.Backends())
+		return nil
+	},
+}
+
+// printBackends prints each backend with its options, as they're given to
+// --player-opts.
+func printBackends(w io.Writer, backends []device.Backend) {
+	for i, backend := range backends {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s\n    %s\n", backend.Name, backend.Description)
+		for _, option := range backend.Options {
+			usage := option.Usage
+			if option.Default != "" {
+				usage += fmt.Sprintf(" (default %s)", option.Default)
+			}
+			fmt.Fprintf(w, "    %-12s %s\n", option.Name, usage)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// A line of a .script file: "100 : 55 02 00 0d f1", where the first
+	// number is the delay in milliseconds since the previous line.
+	scriptLine = regexp.MustCompile(`^\s*(\d+)\s*:\s*((?:[0-9a-fA-F]{2}\s*)+)$`)
+
+	// The bits of a text or logfmt log line that matter.
+	logFrame     = regexp.MustCompile(`\bframe=([0-9a-fA-F]+)`)
+	logDirection = regexp.MustCompile(`(?:\bmsg=|: )([<>]) `)
+	logDropped   = regexp.MustCompile(`Dropped frame`)
+	logReason    = regexp.MustCompile(`\breason="?([^"=]+?)"?(?: \w+=|$)`)
+	logTS        = regexp.MustCompile(`\bts=(\S+)`)
+	logClock     = regexp.MustCompile(`^(\d\d:\d\d:\d\d\.\d+) `)
+
+	// Frame logs from before the logs were structured: "< 5503000104f8".
+	legacyLine = regexp.MustCompile(`^(?:(\d\d:\d\d:\d\d\.\d+) )?([<>]) ([0-9a-fA-F]+)$`)
+
+	// Anything else is read as a hex dump, where the bytes may or may not
+	// be separated by spaces, colons or commas, and lines may have an
+	// address in front (e.g. "00000010: ff 55 02 00 0d f1").  Addresses
+	// are 8 digits, which tells them apart from script delays.
+	dumpAddress = regexp.MustCompile(`^[0-9a-fA-F]{8}:\s+`)
+	dumpBytes   = regexp.MustCompile(`[0-9a-fA-F]{2}`)
+)
+
+// ReadCapture reads packets from a capture.  The format is worked out line
+// by line, so any of these can be read, or even mixed:
+//
+//   - bmwctrl logs with frame logging on, in any of the log formats
+//   - .script files used to simulate the car
+//   - hex dumps of the serial line
+//
+// Lines starting with ';' or '#' are comments.  Packets from logs and
+// scripts have their direction and time set, as far as they are known.
+func ReadCapture(r io.Reader) ([]Packet, error) {
+	var packets []Packet
+	var dump []byte
+	var scriptTime time.Time
+
+	add := func(frame []byte, when time.Time, dir Direction, note string) {
+		p := Decode(frame)
+		p.Index = len(packets) + 1
+		p.Time = when
+		p.Dir = dir
+		p.Note = note
+		packets = append(packets, p)
+	}
+	addAll := func(data []byte, when time.Time, dir Direction, note string) []byte {
+		frames, rest := SplitFrames(data)
+		for _, frame := range frames {
+			add(frame, when, dir, note)
+		}
+		return rest
+	}
+	flushDump := func() {
+		if len(dump) > 0 {
+			if dump = addAll(dump, time.Time{}, DirUnknown, ""); len(dump) > 0 {
+				add(dump, time.Time{}, DirUnknown, "incomplete")
+			}
+			dump = nil
+		}
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if m := scriptLine.FindStringSubmatch(line); m != nil && !dumpAddress.MatchString(line) {
+			flushDump()
+			delay, _ := strconv.Atoi(m[1])
+			scriptTime = scriptTime.Add(time.Duration(delay) * time.Millisecond)
+			data, _ := hex.DecodeString(strings.Join(strings.Fields(m[2]), ""))
+			if rest := addAll(data, scriptTime, DirFromCar, ""); len(rest) > 0 {
+				add(rest, scriptTime, DirFromCar, "incomplete")
+			}
+			continue
+		}
+
+		if frame, when, dir, note, ok := parseLogLine(line); ok {
+			flushDump()
+			if rest := addAll(frame, when, dir, note); len(rest) > 0 {
+				add(rest, when, dir, strings.TrimSpace(note+" incomplete"))
+			}
+			continue
+		}
+
+		// Only log lines with frames are of interest, so skip the others
+		// rather than reading the hex that may be in them as a dump.
+		if looksLikeLog(line) {
+			continue
+		}
+		line = dumpAddress.ReplaceAllString(line, "")
+		data, _ := hex.DecodeString(strings.Join(dumpBytes.FindAllString(line, -1), ""))
+		dump = append(dump, data...)
+	}
+	flushDump()
+	return packets, scanner.Err()
+}
+
+// parseLogLine reads the frame from a frame log line, or a dropped frame
+// warning.
+func parseLogLine(line string) (frame []byte, when time.Time, dir Direction, note string, ok bool) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSONLogLine(line)
+	}
+	if m := legacyLine.FindStringSubmatch(line); m != nil {
+		frame, err := hex.DecodeString(evenHex(m[3]))
+		if err != nil {
+			return nil, when, dir, "", false
+		}
+		return frame, parseClock(m[1]), parseDirection(m[2]), "", true
+	}
+
+	m := logFrame.FindStringSubmatch(line)
+	if m == nil {
+		return nil, when, dir, "", false
+	}
+	frame, err := hex.DecodeString(evenHex(m[1]))
+	if err != nil {
+		return nil, when, dir, "", false
+	}
+	if ts := logTS.FindStringSubmatch(line); ts != nil {
+		when, _ = time.Parse(time.RFC3339Nano, ts[1])
+	} else if clock := logClock.FindStringSubmatch(line); clock != nil {
+		when = parseClock(clock[1])
+	}
+	if d := logDirection.FindStringSubmatch(line); d != nil {
+		dir = parseDirection(d[1])
+	} else if logDropped.MatchString(line) {
+		dir = DirFromCar
+		note = "dropped"
+		if reason := logReason.FindStringSubmatch(line); reason != nil {
+			note = "dropped: " + reason[1]
+		}
+	} else {
+		return nil, when, dir, "", false
+	}
+	return frame, when, dir, note, true
+}
+
+func parseJSONLogLine(line string) (frame []byte, when time.Time, dir Direction, note string, ok bool) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &fields); err != nil {
+		return nil, when, dir, "", false
+	}
+	s, _ := fields["frame"].(string)
+	frame, err := hex.DecodeString(evenHex(strings.TrimSuffix(s, "...")))
+	if err != nil || len(frame) == 0 {
+		return nil, when, dir, "", false
+	}
+	if ts, _ := fields["ts"].(string); ts != "" {
+		when, _ = time.Parse(time.RFC3339Nano, ts)
+	}
+	msg, _ := fields["msg"].(string)
+	switch {
+	case msg == "<" || msg == ">":
+		dir = parseDirection(msg)
+	case strings.HasPrefix(msg, "Dropped frame"):
+		dir = DirFromCar
+		note = "dropped"
+		if reason, _ := fields["reason"].(string); reason != "" {
+			note = "dropped: " + reason
+		}
+	default:
+		return nil, when, dir, "", false
+	}
+	return frame, when, dir, note, true
+}
+
+// looksLikeLog reports whether a line is a log line, in any format.
+func looksLikeLog(line string) bool {
+	return strings.HasPrefix(line, "{") ||
+		strings.Contains(line, "level=") ||
+		strings.Contains(line, "] ")
+}
+
+func parseDirection(s string) Direction {
+	if s == ">" {
+		return DirFromCar
+	}
+	return DirToCar
+}
+
+// parseClock reads the time of day that the text logs use for timestamps.
+func parseClock(s string) time.Time {
+	t, _ := time.Parse("15:04:05.999999999", s)
+	return t
+}
+
+// evenHex drops the last digit of a hex string of odd length, which happens
+// when a logged frame was cut short.
+func evenHex(s string) string {
+	return s[:len(s)&^1]
+}
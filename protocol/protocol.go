@@ -0,0 +1,284 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/oandrew/ipod"
+	extremote "github.com/oandrew/ipod/lingo-extremote"
+	general "github.com/oandrew/ipod/lingo-general"
+)
+
+// Direction says which way a packet went.
+type Direction int
+
+const (
+	DirUnknown Direction = iota
+	DirFromCar
+	DirToCar
+)
+
+// String returns the arrows used in the frame logs: ">" for packets from
+// the car, and "<" for packets to it.
+func (d Direction) String() string {
+	switch d {
+	case DirFromCar:
+		return ">"
+	case DirToCar:
+		return "<"
+	}
+	return "?"
+}
+
+var lingoNames = map[uint8]string{
+	general.LingoGeneralID:      "general",
+	extremote.LingoExtRemotelID: "extremote",
+}
+
+// LingoName returns the name of a lingo, as used for the logging
+// subsystems.
+func LingoName(lingo uint8) string {
+	if name, ok := lingoNames[lingo]; ok {
+		return name
+	}
+	return fmt.Sprintf("lingo(%02x)", lingo)
+}
+
+// CommandName returns the name of a decoded command, which is the name of
+// its payload type (e.g. "GetPlayStatus".)
+func CommandName(cmd *ipod.Command) string {
+	t := reflect.TypeOf(cmd.Payload)
+	if t == nil {
+		return fmt.Sprintf("unknown(%02x)", cmd.ID.CmdID())
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// Packet is a frame, decoded as far as possible.
+type Packet struct {
+	Index      int           // Position in the capture, from 1.
+	Time       time.Time     // When the frame was seen, or zero if unknown.
+	Dir        Direction     // Which way the frame went.
+	Frame      []byte        // The raw frame, starting with the 0x55 start byte.
+	ChecksumOK bool          // Whether the checksum matched.
+	Lingo      uint8         // Lingo ID, if the frame was long enough.
+	CmdID      uint16        // Command ID, if the frame was long enough.
+	Name       string        // Command name, if it could be decoded.
+	Fields     string        // Decoded fields of the command.
+	Err        error         // Why the frame couldn't be decoded.
+	Note       string        // Anything else known about the frame (e.g. why it was dropped.)
+	Request    *Packet       // For responses, the request being answered.
+	Latency    time.Duration // For responses, the time since the request.
+}
+
+// LingoName returns the name of the packet's lingo.
+func (p *Packet) LingoName() string {
+	return LingoName(p.Lingo)
+}
+
+// IsNotification reports whether the packet is an unsolicited notification
+// sent to the car, rather than a response to a request.
+func (p *Packet) IsNotification() bool {
+	return strings.HasSuffix(p.Name, "Notification") && !strings.HasPrefix(p.Name, "Set")
+}
+
+// Decode decodes a frame, which starts with the 0x55 start byte.  Frames
+// with a bad checksum are still decoded, as that often shows what the car
+// was trying to do.
+func Decode(frame []byte) Packet {
+	p := Packet{Frame: frame}
+	payload, ok := framePayload(frame)
+	if payload == nil {
+		p.Err = fmt.Errorf("frame too short")
+		return p
+	}
+	p.ChecksumOK = ok
+	if len(payload) >= 1 {
+		p.Lingo = payload[0]
+	}
+	if p.Lingo == extremote.LingoExtRemotelID && len(payload) >= 3 {
+		p.CmdID = uint16(payload[1])<<8 | uint16(payload[2])
+	} else if len(payload) >= 2 {
+		p.CmdID = uint16(payload[1])
+	}
+
+	var cmd ipod.Command
+	if err := cmd.UnmarshalBinary(payload); err != nil {
+		p.Err = err
+		return p
+	}
+	p.Lingo = cmd.ID.LingoID()
+	p.CmdID = cmd.ID.CmdID()
+	p.Name = CommandName(&cmd)
+	p.Fields = fmt.Sprintf("%+v", cmd.Payload)
+	if strings.HasPrefix(p.Fields, "&") {
+		p.Fields = p.Fields[1:]
+	}
+	return p
+}
+
+// framePayload returns the lingo, command and data bytes of a frame, and
+// whether the checksum is correct.  It returns nil if the frame is shorter
+// than its length says.
+func framePayload(frame []byte) ([]byte, bool) {
+	if len(frame) < 3 || frame[0] != 0x55 {
+		return nil, false
+	}
+	length := int(frame[1])
+	start := 2
+	if length == 0 {
+		if len(frame) < 5 {
+			return nil, false
+		}
+		length = int(frame[2])<<8 | int(frame[3])
+		start = 4
+	}
+	if len(frame) < start+length+1 {
+		return nil, false
+	}
+	var sum byte
+	for _, b := range frame[1 : start+length+1] {
+		sum += b
+	}
+	return frame[start : start+length], sum == 0
+}
+
+// frameLength returns the length of the frame at the start of data,
+// including its start byte and checksum, or 0 if there isn't enough data to
+// tell.
+func frameLength(data []byte) int {
+	if len(data) < 2 {
+		return 0
+	}
+	if data[1] != 0 {
+		return 2 + int(data[1]) + 1
+	}
+	if len(data) < 4 {
+		return 0
+	}
+	return 4 + (int(data[2])<<8 | int(data[3])) + 1
+}
+
+// SplitFrames splits a stream of bytes into frames.  Noise between frames is
+// skipped.  When a frame's checksum is bad, or its length runs past the end
+// of the data, and another frame starts inside it (the car aborted it, and
+// moved on), the bad frame is cut short there.  Whatever is left at the end,
+// which isn't a complete frame, is returned in rest.
+func SplitFrames(data []byte) (frames [][]byte, rest []byte) {
+	for {
+		start := indexStart(data)
+		if start < 0 {
+			return frames, nil
+		}
+		data = data[start:]
+		length := frameLength(data)
+		if length == 0 || length > len(data) {
+			// A frame that runs past the end may have been aborted, with
+			// another starting after it.
+			next := indexSync(data[1:])
+			if next < 0 {
+				return frames, data
+			}
+			frames = append(frames, data[:next+1])
+			data = data[next+1:]
+			continue
+		}
+		frame := data[:length]
+		if _, ok := framePayload(frame); !ok {
+			if next := indexSync(frame[1:]); next >= 0 {
+				frame = frame[:next+1]
+				length = len(frame)
+			}
+		}
+		frames = append(frames, frame)
+		data = data[length:]
+	}
+}
+
+// indexStart returns the position of the first start byte in data.
+func indexStart(data []byte) int {
+	for i, b := range data {
+		if b == 0x55 {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexSync returns the position of the first 0xFF 0x55 sync sequence in
+// data.
+func indexSync(data []byte) int {
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == 0xff && data[i+1] == 0x55 {
+			return i
+		}
+	}
+	return -1
+}
+
+// inferDirection guesses which way a packet went from its command name,
+// for captures that don't say.
+func inferDirection(p *Packet) Direction {
+	switch {
+	case p.Name == "":
+		return DirUnknown
+	case strings.HasPrefix(p.Name, "Return"), p.Name == "ACK", p.IsNotification():
+		return DirToCar
+	}
+	return DirFromCar
+}
+
+// Pairer matches responses to the requests they answer.  The protocol has no
+// transaction IDs on the serial link, so every packet sent to the car is
+// taken to answer the last request from the car in the same lingo, until
+// the next request arrives.  Notifications answer nothing.
+type Pairer struct {
+	requests map[uint8]*Packet
+	answered map[*Packet]bool
+}
+
+// NewPairer returns a Pairer with no pending requests.
+func NewPairer() *Pairer {
+	return &Pairer{
+		requests: map[uint8]*Packet{},
+		answered: map[*Packet]bool{},
+	}
+}
+
+// Add records a packet, setting its request and latency if it is a
+// response.  Packets must be added in the order they were seen.
+func (pr *Pairer) Add(p *Packet) {
+	if p.Dir == DirUnknown {
+		p.Dir = inferDirection(p)
+	}
+	if p.Name == "" {
+		return
+	}
+	switch p.Dir {
+	case DirFromCar:
+		pr.requests[p.Lingo] = p
+	case DirToCar:
+		if p.IsNotification() {
+			return
+		}
+		request := pr.requests[p.Lingo]
+		if request == nil {
+			return
+		}
+		p.Request = request
+		if !request.Time.IsZero() && !p.Time.IsZero() {
+			p.Latency = p.Time.Sub(request.Time)
+		}
+		pr.answered[request] = true
+	}
+}
+
+// Answered reports whether a request got a response.
+func (pr *Pairer) Answered(request *Packet) bool {
+	return pr.answered[request]
+}
@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestSplitFrames(t *testing.T) {
+	data := []byte{
+		0x00, 0xff, // noise
+		0x55, 0x02, 0x00, 0x00, 0xfe, // RequestIdentify
+		0xff, 0x55, 0x04, 0x00, 0x01, // cut short by the car
+		0xff, 0x55, 0x02, 0x00, 0x00, 0xfe,
+		0xff, 0x55, 0x40, 0x04, 0x00, // cut short, with a length past the end
+		0xff, 0x55, 0x02, 0x00, 0x00, 0xfe,
+		0xff, 0x55, 0x03, // incomplete
+	}
+	frames, rest := SplitFrames(data)
+	if len(frames) != 5 {
+		t.Fatalf("got %d frames, want 5: %x", len(frames), frames)
+	}
+	if !bytes.Equal(frames[1], []byte{0x55, 0x04, 0x00, 0x01}) {
+		t.Errorf("aborted frame = %x", frames[1])
+	}
+	if !bytes.Equal(frames[3], []byte{0x55, 0x40, 0x04, 0x00}) || !bytes.Equal(frames[4], frames[0]) {
+		t.Errorf("frames after the long aborted frame = %x, %x", frames[3], frames[4])
+	}
+	if !bytes.Equal(rest, []byte{0x55, 0x03}) {
+		t.Errorf("rest = %x", rest)
+	}
+}
+
+func TestReadCapture(t *testing.T) {
+	capture := strings.Join([]string{
+		"; a script",
+		"100 : 55 02 00 00 fe",
+		`[DEBUG] transport/frames: > frame=55020000fe`,
+		`level=debug subsystem=transport/frames msg=< frame=55020000fe`,
+		`[WARN] transport: Dropped frame, resynchronising reason="bad checksum" frame=5502000001`,
+		`[INFO] main: Starting`,
+		"00000000: ff 55 02 00 00 fe",
+	}, "\n")
+	packets, err := ReadCapture(strings.NewReader(capture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 5 {
+		t.Fatalf("got %d packets, want 5: %+v", len(packets), packets)
+	}
+	if packets[0].Dir != DirFromCar || !packets[0].ChecksumOK {
+		t.Errorf("script packet = %+v", packets[0])
+	}
+	if packets[1].Dir != DirFromCar || packets[2].Dir != DirToCar {
+		t.Errorf("log packets = %+v, %+v", packets[1], packets[2])
+	}
+	if packets[3].Dir != DirFromCar || packets[3].Note != "dropped: bad checksum" || packets[3].ChecksumOK {
+		t.Errorf("dropped packet = %+v", packets[3])
+	}
+	if packets[4].Dir != DirUnknown || packets[4].Index != 5 {
+		t.Errorf("dump packet = %+v", packets[4])
+	}
+}
+
+func TestPairer(t *testing.T) {
+	request := Packet{Dir: DirFromCar, Name: "RequestRemoteUIMode", Lingo: 0}
+	response := Packet{Dir: DirToCar, Name: "ReturnRemoteUIMode", Lingo: 0}
+	notification := Packet{Dir: DirToCar, Name: "PlayStatusChangeNotification", Lingo: 4}
+	pairer := NewPairer()
+	pairer.Add(&request)
+	pairer.Add(&notification)
+	pairer.Add(&response)
+	if response.Request != &request || !pairer.Answered(&request) {
+		t.Errorf("response not paired with request")
+	}
+	if notification.Request != nil {
+		t.Errorf("notification paired with %+v", notification.Request)
+	}
+}
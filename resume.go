@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"bmwctrl/options"
+	"bmwctrl/session"
+	"bmwctrl/statefile"
+)
+
+// stateSaver keeps the session's state in a file, so that playback resumes
+// where it left off after the Pi loses power with the car.  There's no
+// warning before the power goes, so the state is saved every interval
+// (when it has changed), as well as when bmwctrl shuts down.  Each save
+// replaces the file atomically, so a save cut short leaves the last one.
+type stateSaver struct {
+	path     string
+	player   string
+	interval time.Duration
+	session  *session.Session
+	last     []byte
+	mutex    sync.Mutex
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newStateSaver parses the --state options.  The keys are:
+//
+//	file      The state file (required; the positional option)
+//	interval  How often to save the state (default 15s)
+func newStateSaver(opts options.Options, player string, sess *session.Session) (*stateSaver, error) {
+	if err := opts.Check("file", "interval"); err != nil {
+		return nil, err
+	}
+	s := &stateSaver{
+		path:    opts.String("file", ""),
+		player:  player,
+		session: sess,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if s.path == "" {
+		return nil, fmt.Errorf("option 'file' is required")
+	}
+	var err error
+	if s.interval, err = opts.Duration("interval", 15*time.Second); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore puts back the saved state, if there is any, and it was saved by
+// the same player.
+func (s *stateSaver) restore() {
+	var snap session.Snapshot
+	if err := statefile.ReadJSON(s.path, &snap); err != nil {
+		if !os.IsNotExist(err) {
+			mainLog.Warn("Error reading state, starting afresh", "path", s.path, "err", err)
+		}
+		return
+	}
+	if snap.Player != s.player {
+		mainLog.Info("State was saved by another player, not restoring it", "player", snap.Player)
+		return
+	}
+	mainLog.Info("Restoring state", "path", s.path, "saved", snap.Saved)
+	s.session.Restore(snap)
+}
+
+// run saves the state every interval until close is called.
+func (s *stateSaver) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.save()
+		case <-s.stop:
+			s.save()
+			return
+		}
+	}
+}
+
+// save writes the state, if it has changed since it was last written.
+func (s *stateSaver) save() {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	snap := s.session.Snapshot()
+	snap.Player = s.player
+	data, err := json.Marshal(snap)
+	if err != nil || string(data) == string(s.last) {
+		return
+	}
+	snap.Saved = time.Now()
+	if err := statefile.WriteJSON(s.path, snap); err != nil {
+		mainLog.Warn("Error saving state", "path", s.path, "err", err)
+		return
+	}
+	s.last = data
+}
+
+// close saves the state one last time, and stops saving it.
+func (s *stateSaver) close() {
+	close(s.stop)
+	<-s.done
+}
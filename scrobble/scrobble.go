@@ -0,0 +1,284 @@
+// Package scrobble submits what's been listened to in the car to
+// ListenBrainz or Last.fm.  There's no network while driving, so listens
+// are kept in a queue on disk, and submitted in batches whenever the
+// service can be reached, e.g. when the Pi joins the home wifi.
+package scrobble
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bmwctrl/logging"
+	"bmwctrl/options"
+	"bmwctrl/statefile"
+)
+
+var logger = logging.New("scrobble")
+
+// The longest time between attempts to submit, however many have failed.
+const maxBackoff = 30 * time.Minute
+
+// How many submitted listens are remembered, so they aren't queued again.
+const sentMemory = 500
+
+// The most scrobbles Last.fm takes at once.
+const lastFMBatch = 50
+
+// Options configures the service, and the queue.
+type Options struct {
+	Service  string        // listenbrainz or lastfm.
+	URL      string        // The root of the service's API.
+	Token    string        // ListenBrainz user token.
+	Key      string        // Last.fm API key.
+	Secret   string        // Last.fm API secret.
+	Session  string        // Last.fm session key.
+	Queue    string        // The queue file.
+	Interval time.Duration // How often to try submitting.
+	Batch    int           // The most listens submitted at once.
+}
+
+// ParseOptions reads scrobble options.  The keys are:
+//
+//	service   listenbrainz or lastfm (default listenbrainz; the positional
+//	          option)
+//	url       the root of the service's API (default the service's own, for
+//	          compatible servers such as a self hosted ListenBrainz)
+//	token     ListenBrainz user token
+//	key       Last.fm API key
+//	secret    Last.fm API secret
+//	session   Last.fm session key
+//	queue     the queue file (required)
+//	interval  how often to try submitting (default 1m)
+//	batch     the most listens submitted at once (default 50, which is the
+//	          most Last.fm takes)
+func ParseOptions(opts options.Options) (Options, error) {
+	o := Options{}
+	err := opts.Check("service", "url", "token", "key", "secret", "session", "queue", "interval", "batch")
+	if err != nil {
+		return o, err
+	}
+	o.Service = opts.String("service", "listenbrainz")
+	o.Token = opts.String("token", "")
+	o.Key = opts.String("key", "")
+	o.Secret = opts.String("secret", "")
+	o.Session = opts.String("session", "")
+	switch o.Service {
+	case "listenbrainz":
+		o.URL = opts.String("url", "https://api.listenbrainz.org")
+		if o.Token == "" {
+			return o, fmt.Errorf("option 'token' is required for listenbrainz")
+		}
+	case "lastfm":
+		o.URL = opts.String("url", "https://ws.audioscrobbler.com/2.0/")
+		if o.Key == "" || o.Secret == "" || o.Session == "" {
+			return o, fmt.Errorf("options 'key', 'secret' and 'session' are required for lastfm")
+		}
+	default:
+		return o, fmt.Errorf("option 'service' must be listenbrainz or lastfm, got '%s'", o.Service)
+	}
+	o.Queue = opts.String("queue", "")
+	if o.Queue == "" {
+		return o, fmt.Errorf("option 'queue' is required")
+	}
+	if o.Interval, err = opts.Duration("interval", time.Minute); err != nil {
+		return o, err
+	}
+	if o.Batch, err = opts.Int("batch", 50); err != nil {
+		return o, err
+	}
+	if o.Batch <= 0 {
+		return o, fmt.Errorf("option 'batch' must be more than 0, got '%d'", o.Batch)
+	}
+	if o.Service == "lastfm" && o.Batch > lastFMBatch {
+		o.Batch = lastFMBatch
+	}
+	return o, nil
+}
+
+// Listen is a track that was listened to.
+type Listen struct {
+	Artist     string        `json:"artist"`
+	Title      string        `json:"title"`
+	Album      string        `json:"album,omitempty"`
+	Length     time.Duration `json:"length,omitempty"`
+	ListenedAt time.Time     `json:"listened_at"` // When it started playing.
+}
+
+// key identifies a listen, to spot duplicates.
+func (l Listen) key() string {
+	return fmt.Sprintf("%d/%s/%s", l.ListenedAt.Unix(), strings.ToLower(l.Artist), strings.ToLower(l.Title))
+}
+
+// service submits listens.
+type service interface {
+	submit(listens []Listen) error
+}
+
+// rejectedError is returned by a service when it won't take the listens
+// (as opposed to not being reachable), so there's no point retrying them.
+type rejectedError struct {
+	reason string
+}
+
+func (e rejectedError) Error() string {
+	return "listens rejected: " + e.reason
+}
+
+// queue is what's kept in the queue file.
+type queue struct {
+	Pending []Listen `json:"pending"`
+	Sent    []string `json:"sent"` // Keys of the last listens submitted.
+}
+
+// Scrobbler queues listens, and submits them in the background.
+type Scrobbler struct {
+	opts     Options
+	service  service
+	mutex    sync.Mutex
+	queue    queue
+	failures int
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// New creates a scrobbler, reading the listens left in the queue.
+func New(opts Options) (*Scrobbler, error) {
+	s := &Scrobbler{
+		opts: opts,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	switch opts.Service {
+	case "lastfm":
+		s.service = newLastFM(opts)
+	default:
+		s.service = newListenBrainz(opts)
+	}
+	if err := statefile.ReadJSON(opts.Queue, &s.queue); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Add queues a listen, unless it's already been queued, or has no artist
+// or title, which the services won't take.
+func (s *Scrobbler) Add(l Listen) {
+	if strings.TrimSpace(l.Artist) == "" || strings.TrimSpace(l.Title) == "" {
+		logger.Debug("Not queueing a listen without an artist and title", "artist", l.Artist, "title", l.Title)
+		return
+	}
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	key := l.key()
+	for _, pending := range s.queue.Pending {
+		if pending.key() == key {
+			return
+		}
+	}
+	for _, sent := range s.queue.Sent {
+		if sent == key {
+			return
+		}
+	}
+	s.queue.Pending = append(s.queue.Pending, l)
+	s.save()
+	logger.Debug("Listen queued", "artist", l.Artist, "title", l.Title, "pending", len(s.queue.Pending))
+}
+
+// Pending returns how many listens are waiting to be submitted.
+func (s *Scrobbler) Pending() int {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return len(s.queue.Pending)
+}
+
+// Start starts submitting in the background.
+func (s *Scrobbler) Start() {
+	go s.run()
+}
+
+// Close stops submitting.  The listens not yet submitted stay in the queue
+// for next time.
+func (s *Scrobbler) Close() {
+	close(s.stop)
+	<-s.done
+}
+
+// run tries to submit every interval, backing off while the service can't
+// be reached.
+func (s *Scrobbler) run() {
+	defer close(s.done)
+	wait := time.Duration(0)
+	for {
+		select {
+		case <-time.After(wait):
+		case <-s.stop:
+			return
+		}
+		if err := s.submit(); err != nil {
+			s.failures++
+			logger.Debug("Can't submit listens yet", "pending", s.Pending(), "failures", s.failures, "err", err)
+		} else {
+			s.failures = 0
+		}
+		wait = s.opts.Interval << uint(s.failures)
+		if s.failures > 10 || wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+}
+
+// submit submits the queue in batches, until it's empty or a batch fails.
+// A batch the service rejects is split in half and submitted again, down to
+// single listens, and only those still rejected are dropped, so one bad
+// listen doesn't hold up the rest.
+func (s *Scrobbler) submit() error {
+	limit := s.opts.Batch
+	for {
+		s.mutex.Lock()
+		n := len(s.queue.Pending)
+		if n > limit {
+			n = limit
+		}
+		batch := append([]Listen(nil), s.queue.Pending[:n]...)
+		s.mutex.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		err := s.service.submit(batch)
+		if _, rejected := err.(rejectedError); err != nil && !rejected {
+			return err
+		}
+		if err != nil && n > 1 {
+			limit = (n + 1) / 2
+			continue
+		}
+		if err != nil {
+			logger.Warn("Dropping a listen", "artist", batch[0].Artist, "title", batch[0].Title, "err", err)
+			limit = s.opts.Batch
+		} else {
+			logger.Info("Listens submitted", "count", n, "service", s.opts.Service)
+		}
+		s.mutex.Lock()
+		s.queue.Pending = s.queue.Pending[n:]
+		for _, l := range batch {
+			s.queue.Sent = append(s.queue.Sent, l.key())
+		}
+		if len(s.queue.Sent) > sentMemory {
+			s.queue.Sent = s.queue.Sent[len(s.queue.Sent)-sentMemory:]
+		}
+		s.save()
+		s.mutex.Unlock()
+	}
+}
+
+// save writes the queue file.  The mutex must be held.
+func (s *Scrobbler) save() {
+	if err := statefile.WriteJSON(s.opts.Queue, s.queue); err != nil {
+		logger.Warn("Can't save the scrobble queue", "path", s.opts.Queue, "err", err)
+	}
+}
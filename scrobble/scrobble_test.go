@@ -0,0 +1,195 @@
+package scrobble
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bmwctrl/options"
+)
+
+func testScrobbler(t *testing.T, opts options.Options) (*Scrobbler, func()) {
+	dir, err := ioutil.TempDir("", "scrobble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts["queue"] = filepath.Join(dir, "queue.json")
+	o, err := ParseOptions(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Batch = 2
+	s, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, func() { os.RemoveAll(dir) }
+}
+
+func listen(title string, minute int) Listen {
+	return Listen{
+		Artist:     "Artist",
+		Title:      title,
+		Album:      "Album",
+		Length:     3 * time.Minute,
+		ListenedAt: time.Date(2020, 6, 1, 12, minute, 0, 0, time.UTC),
+	}
+}
+
+func TestListenBrainz(t *testing.T) {
+	var received []lbListen
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/1/submit-listens" || r.Header.Get("Authorization") != "Token secret" {
+			t.Errorf("request to %s with %q", r.URL.Path, r.Header.Get("Authorization"))
+		}
+		var submission lbSubmission
+		json.NewDecoder(r.Body).Decode(&submission)
+		if status == http.StatusOK {
+			received = append(received, submission.Payload...)
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	s, cleanup := testScrobbler(t, options.Options{"service": "listenbrainz", "url": server.URL, "token": "secret"})
+	defer cleanup()
+	s.Add(listen("One", 0))
+	s.Add(listen("Two", 3))
+	s.Add(listen("one", 0)) // A duplicate.
+	s.Add(listen("Three", 6))
+
+	// Unreachable: everything stays queued, including after a restart.
+	if err := s.submit(); err == nil || s.Pending() != 3 {
+		t.Fatalf("submit while unavailable: %v, %d pending", err, s.Pending())
+	}
+	s, err := New(s.opts)
+	if err != nil || s.Pending() != 3 {
+		t.Fatalf("reopened: %v, %d pending", err, s.Pending())
+	}
+
+	status = http.StatusOK
+	if err := s.submit(); err != nil || s.Pending() != 0 {
+		t.Fatalf("submit: %v, %d pending", err, s.Pending())
+	}
+	if len(received) != 3 || received[0].Track.TrackName != "One" || received[2].ListenedAt != listen("", 6).ListenedAt.Unix() ||
+		received[1].Track.AdditionalInfo["duration_ms"] != float64(180000) {
+		t.Errorf("received %+v", received)
+	}
+
+	// Listens already submitted aren't queued again.
+	s.Add(listen("Two", 3))
+	if s.Pending() != 0 {
+		t.Errorf("%d pending after adding a submitted listen", s.Pending())
+	}
+
+	// Listens the service rejects are dropped.
+	status = http.StatusBadRequest
+	s.Add(listen("Bad", 9))
+	if err := s.submit(); err != nil || s.Pending() != 0 {
+		t.Errorf("submit rejected: %v, %d pending", err, s.Pending())
+	}
+}
+
+func TestRejectedListen(t *testing.T) {
+	var received []string
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		var submission lbSubmission
+		json.NewDecoder(r.Body).Decode(&submission)
+		for _, l := range submission.Payload {
+			if l.Track.TrackName == "Bad" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+		for _, l := range submission.Payload {
+			received = append(received, l.Track.TrackName)
+		}
+	}))
+	defer server.Close()
+
+	s, cleanup := testScrobbler(t, options.Options{"service": "listenbrainz", "url": server.URL, "token": "secret"})
+	defer cleanup()
+	s.opts.Batch = 4
+	s.Add(Listen{Title: "No Artist", ListenedAt: time.Now()})
+	if s.Pending() != 0 {
+		t.Errorf("%d pending after adding a listen without an artist", s.Pending())
+	}
+	for i, title := range []string{"One", "Two", "Bad", "Three", "Four"} {
+		s.Add(listen(title, 3*i))
+	}
+
+	// Only the bad listen is dropped: [One Two Bad Three] is rejected, then
+	// [One Two] is taken, [Bad Three] is rejected, [Bad] is rejected and
+	// dropped, and [Three Four] is taken.
+	if err := s.submit(); err != nil || s.Pending() != 0 {
+		t.Fatalf("submit: %v, %d pending", err, s.Pending())
+	}
+	if len(received) != 4 || received[0] != "One" || received[1] != "Two" || received[2] != "Three" || received[3] != "Four" {
+		t.Errorf("received %q", received)
+	}
+	if requests != 5 {
+		t.Errorf("%d requests", requests)
+	}
+}
+
+func TestLastFM(t *testing.T) {
+	var scrobbled []string
+	s, cleanup := testScrobbler(t, options.Options{"service": "lastfm", "key": "k", "secret": "s", "session": "sk"})
+	defer cleanup()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		params := r.PostForm
+		sig := params.Get("api_sig")
+		params.Del("api_sig")
+		params.Del("format")
+		if params.Get("method") != "track.scrobble" || params.Get("sk") != "sk" || sig != s.service.(*lastFM).signature(params) {
+			w.Write([]byte(`{"error": 13, "message": "Invalid method signature supplied"}`))
+			return
+		}
+		for _, n := range []string{"0", "1"} {
+			if title := params.Get("track[" + n + "]"); title != "" {
+				scrobbled = append(scrobbled, title+"@"+params.Get("timestamp["+n+"]"))
+			}
+		}
+		w.Write([]byte(`{"scrobbles": {"@attr": {"accepted": 1, "ignored": 0}}}`))
+	}))
+	defer server.Close()
+	s.service.(*lastFM).url = server.URL
+
+	s.Add(listen("One", 0))
+	s.Add(listen("Two", 3))
+	s.Add(listen("Three", 6))
+	if err := s.submit(); err != nil || s.Pending() != 0 {
+		t.Fatalf("submit: %v, %d pending", err, s.Pending())
+	}
+	if len(scrobbled) != 3 || scrobbled[0] != "One@1591012800" || scrobbled[2] != "Three@1591013160" {
+		t.Errorf("scrobbled %q", scrobbled)
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	for _, opts := range []options.Options{
+		{"queue": "q"},
+		{"service": "lastfm", "key": "k", "queue": "q"},
+		{"service": "spotify", "queue": "q"},
+		{"token": "t"},
+		{"token": "t", "queue": "q", "batch": "0"},
+	} {
+		if _, err := ParseOptions(opts); err == nil {
+			t.Errorf("%v: no error", opts)
+		}
+	}
+
+	o, err := ParseOptions(options.Options{"service": "lastfm", "key": "k", "secret": "s", "session": "sk", "queue": "q", "batch": "100"})
+	if err != nil || o.Batch != lastFMBatch {
+		t.Errorf("lastfm batch %d: %v", o.Batch, err)
+	}
+}
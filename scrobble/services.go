@@ -0,0 +1,176 @@
+package scrobble
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a submission can take.
+const requestTimeout = 30 * time.Second
+
+// listenBrainz submits to the ListenBrainz API, or a server compatible with
+// it.
+type listenBrainz struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func newListenBrainz(opts Options) *listenBrainz {
+	return &listenBrainz{
+		url:    strings.TrimSuffix(opts.URL, "/") + "/1/submit-listens",
+		token:  opts.Token,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+type lbTrack struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info"`
+}
+
+type lbListen struct {
+	ListenedAt int64   `json:"listened_at"`
+	Track      lbTrack `json:"track_metadata"`
+}
+
+type lbSubmission struct {
+	ListenType string     `json:"listen_type"`
+	Payload    []lbListen `json:"payload"`
+}
+
+func (lb *listenBrainz) submit(listens []Listen) error {
+	submission := lbSubmission{ListenType: "import"}
+	for _, l := range listens {
+		info := map[string]interface{}{"submission_client": "bmwctrl"}
+		if l.Length > 0 {
+			info["duration_ms"] = int64(l.Length / time.Millisecond)
+		}
+		submission.Payload = append(submission.Payload, lbListen{
+			ListenedAt: l.ListenedAt.Unix(),
+			Track:      lbTrack{l.Artist, l.Title, l.Album, info},
+		})
+	}
+	body, err := json.Marshal(submission)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", lb.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+lb.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := lb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	reply, _ := ioutil.ReadAll(resp.Body)
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		// The listens are invalid; the token being wrong is a 401.
+		return rejectedError{strings.TrimSpace(string(reply))}
+	default:
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(reply)))
+	}
+}
+
+// lastFM submits to the Last.fm API (track.scrobble), or a server
+// compatible with it (e.g. Libre.fm.)
+type lastFM struct {
+	url     string
+	key     string
+	secret  string
+	session string
+	client  *http.Client
+}
+
+func newLastFM(opts Options) *lastFM {
+	return &lastFM{
+		url:     opts.URL,
+		key:     opts.Key,
+		secret:  opts.Secret,
+		session: opts.Session,
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Last.fm's error code for invalid parameters.  Other errors (e.g. the
+// service being offline, or the session key being wrong) are retried.
+const lastFMInvalidParameters = 6
+
+func (fm *lastFM) submit(listens []Listen) error {
+	params := url.Values{
+		"method":  {"track.scrobble"},
+		"api_key": {fm.key},
+		"sk":      {fm.session},
+	}
+	for i, l := range listens {
+		n := "[" + strconv.Itoa(i) + "]"
+		params.Set("artist"+n, l.Artist)
+		params.Set("track"+n, l.Title)
+		params.Set("timestamp"+n, strconv.FormatInt(l.ListenedAt.Unix(), 10))
+		if l.Album != "" {
+			params.Set("album"+n, l.Album)
+		}
+		if l.Length > 0 {
+			params.Set("duration"+n, strconv.Itoa(int(l.Length/time.Second)))
+		}
+	}
+	params.Set("api_sig", fm.signature(params))
+	params.Set("format", "json")
+	resp, err := fm.client.PostForm(fm.url, params)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var reply struct {
+		Error   int    `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, err)
+	}
+	switch {
+	case reply.Error == lastFMInvalidParameters:
+		return rejectedError{reply.Message}
+	case reply.Error != 0:
+		return fmt.Errorf("error %d: %s", reply.Error, reply.Message)
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
+
+// signature signs the parameters: the MD5 of each name and value, sorted
+// by name, and then the secret.
+func (fm *lastFM) signature(params url.Values) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(params.Get(name))
+	}
+	b.WriteString(fm.secret)
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"bmwctrl/device"
+	"bmwctrl/session"
+	"bmwctrl/systemd"
+)
+
+// How long shutdown waits for each step (the command being handled, and
+// the frame processing loop) before carrying on without it.
+const drainTimeout = 2 * time.Second
+
+// waitForSignal blocks until bmwctrl is asked to stop, and returns the
+// signal that asked.
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return <-signals
+}
+
+// runWatchdog tells systemd that bmwctrl is alive, as long as the player
+// can be used.  The frame processing loop can't be checked directly, as it
+// blocks waiting for frames whenever the car is asleep, but a command
+// stuck in the player holds the player, which is caught here.  systemd
+// restarts bmwctrl if the notifications stop.
+func runWatchdog(interval time.Duration, sess *session.Session, stop <-chan struct{}) {
+	mainLog.Info("Watchdog enabled", "interval", interval)
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		alive := make(chan struct{})
+		go func() {
+			sess.WithPlayer(func(player device.Player) {})
+			close(alive)
+		}()
+		select {
+		case <-alive:
+			systemd.Watchdog()
+		case <-time.After(interval / 2):
+			mainLog.Error("Player is stuck, not notifying the watchdog")
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package session
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"bmwctrl/device"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+var playControls = map[string]extremote.PlayControlCmd{
+	"play":   extremote.PlayControlPlay,
+	"pause":  extremote.PlayControlPause,
+	"toggle": extremote.PlayControlToggle,
+	"stop":   extremote.PlayControlStop,
+	"next":   extremote.PlayControlNextTrack,
+	"prev":   extremote.PlayControlPrevTrack,
+}
+
+// Commands lists the remote control commands understood by Control.
+var Commands = []string{"play", "pause", "toggle", "stop", "next", "prev", "seek", "track", "shuffle", "repeat"}
+
+// Control runs a remote control command, from the HTTP API or MQTT.
+//
+//	play, pause, toggle, stop, next, prev
+//	seek POS               POS in ms, or a duration (e.g. 1m30s)
+//	track N                jump to a track in the play queue
+//	shuffle off|tracks|albums
+//	repeat off|one|all
+func (s *Session) Control(command, arg string) error {
+	if cmd, ok := playControls[command]; ok {
+		s.PlayControlled(cmd)
+		s.WithPlayer(func(player device.Player) {
+			player.PlayControl(cmd)
+		})
+		return nil
+	}
+
+	switch command {
+	case "seek":
+		position, err := ParsePosition(arg)
+		if err != nil {
+			return err
+		}
+		s.WithPlayer(func(player device.Player) {
+			player.Seek(position)
+		})
+
+	case "track":
+		index, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("track must be a number, got '%s'", arg)
+		}
+		s.WithPlayer(func(player device.Player) {
+			if index < 0 || index >= player.GetNumPlayingTracks() {
+				err = fmt.Errorf("no track %d in the play queue", index)
+				return
+			}
+			player.SetCurrentPlayingTrack(index)
+		})
+		return err
+
+	case "shuffle":
+		mode, err := ParseShuffle(arg)
+		if err != nil {
+			return err
+		}
+		s.SetShuffle(mode)
+
+	case "repeat":
+		mode, err := ParseRepeat(arg)
+		if err != nil {
+			return err
+		}
+		s.SetRepeat(mode)
+
+	default:
+		return fmt.Errorf("unknown command '%s' (%s)", command, strings.Join(Commands, ", "))
+	}
+	return nil
+}
+
+// ParsePosition reads a track position, in milliseconds, or as a duration.
+func ParsePosition(value string) (int, error) {
+	if value == "" {
+		return 0, fmt.Errorf("position is required")
+	}
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+		return n, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("position must be in ms, or a duration (e.g. 1m30s), got '%s'", value)
+	}
+	return int(d / time.Millisecond), nil
+}
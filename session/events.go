@@ -0,0 +1,90 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"bmwctrl/protocol"
+
+	"github.com/oandrew/ipod"
+)
+
+// The number of events kept for subscribers that join late.
+const eventBacklog = 200
+
+// The number of events a subscriber can fall behind by before events are
+// dropped for it.
+const subscriberBuffer = 64
+
+// Event is something that happened in the session, as streamed to the
+// dashboard.
+type Event struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind"`              // "command", or "unhandled" for a command that wasn't understood
+	Dir     string    `json:"dir,omitempty"`     // ">" from the car, "<" to the car
+	Lingo   string    `json:"lingo,omitempty"`   // e.g. "extremote"
+	ID      string    `json:"id,omitempty"`      // command ID, in hex
+	Command string    `json:"command,omitempty"` // e.g. "GetPlayStatus"
+	Fields  string    `json:"fields,omitempty"`
+	Ref     uint64    `json:"ref,omitempty"` // for "unhandled", the seq of the command
+}
+
+// CommandEvent publishes a command going to (dir "<") or from (dir ">") the
+// car.
+func (s *Session) CommandEvent(dir string, cmd *ipod.Command) {
+	fields := fmt.Sprintf("%+v", cmd.Payload)
+	s.publish(Event{
+		Kind:    "command",
+		Dir:     dir,
+		Lingo:   protocol.LingoName(cmd.ID.LingoID()),
+		ID:      fmt.Sprintf("%x", cmd.ID.CmdID()),
+		Command: protocol.CommandName(cmd),
+		Fields:  strings.TrimPrefix(fields, "&"),
+	})
+}
+
+// Subscribe returns the recent events, and a channel that receives events
+// from now on.  If the subscriber falls too far behind, events are dropped
+// rather than holding up the session.  Call cancel when done.
+func (s *Session) Subscribe() (backlog []Event, events <-chan Event, cancel func()) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	ch := make(chan Event, subscriberBuffer)
+	if s.subscribers == nil {
+		s.subscribers = map[chan Event]bool{}
+	}
+	s.subscribers[ch] = true
+	backlog = append([]Event(nil), s.events...)
+	cancel = func() {
+		defer s.mutex.Unlock()
+		s.mutex.Lock()
+		delete(s.subscribers, ch)
+	}
+	return backlog, ch, cancel
+}
+
+func (s *Session) publish(e Event) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.seq++
+	e.Seq = s.seq
+	e.Time = time.Now()
+	if e.Kind == "command" && e.Dir == ">" {
+		s.lastReceived = e.Seq
+	}
+	if e.Kind == "unhandled" {
+		e.Ref = s.lastReceived
+	}
+	if len(s.events) >= eventBacklog {
+		s.events = s.events[1:]
+	}
+	s.events = append(s.events, e)
+	for ch := range s.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
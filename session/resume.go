@@ -0,0 +1,62 @@
+package session
+
+import (
+	"time"
+
+	"bmwctrl/device"
+)
+
+// Snapshot is the state kept across restarts, so that playback resumes
+// where it left off when the Pi loses power with the car.
+type Snapshot struct {
+	Saved     time.Time          `json:"saved"`
+	Player    string             `json:"player"` // Set by the caller; the queue only makes sense to the same player.
+	Queue     *device.QueueState `json:"queue,omitempty"`
+	Shuffle   string             `json:"shuffle"`
+	Repeat    string             `json:"repeat"`
+	Selection []Selection        `json:"selection"`
+}
+
+// Snapshot returns the state to save.  The play queue is only included if
+// the player is a device.Resumer.
+func (s *Session) Snapshot() Snapshot {
+	snap := Snapshot{
+		Shuffle:   ShuffleName(s.Shuffle()),
+		Repeat:    RepeatName(s.Repeat()),
+		Selection: s.Selection(),
+	}
+	s.WithPlayer(func(player device.Player) {
+		if resumer, ok := player.(device.Resumer); ok {
+			queue := resumer.SaveQueue()
+			snap.Queue = &queue
+		}
+	})
+	return snap
+}
+
+// Restore puts back saved state: the shuffle and repeat modes, the database
+// records the car had selected (so the last browsed CD is still selected),
+// and the play queue.  Selections that no longer exist in the player's
+// database are dropped.
+func (s *Session) Restore(snap Snapshot) {
+	if mode, err := ParseShuffle(snap.Shuffle); err == nil {
+		s.SetShuffle(mode)
+	}
+	if mode, err := ParseRepeat(snap.Repeat); err == nil {
+		s.SetRepeat(mode)
+	}
+	s.WithPlayer(func(player device.Player) {
+		s.ResetSelection()
+		player.ResetDBSelection()
+		for _, selected := range snap.Selection {
+			if selected.Index >= player.GetNumberCategorizedDBRecords(selected.Category) {
+				break
+			}
+			player.SelectDBRecord(selected.Category, selected.Index)
+			s.Select(selected.Category, selected.Index)
+		}
+		if resumer, ok := player.(device.Resumer); ok && snap.Queue != nil {
+			resumer.RestoreQueue(*snap.Queue)
+		}
+	})
+}
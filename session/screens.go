@@ -0,0 +1,90 @@
+package session
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+// Screen is a list the head unit has shown, made up of the records it
+// counted and retrieved.  The head unit only retrieves the records it needs
+// to draw, so Records may have gaps, which are empty.
+type Screen struct {
+	Path      string           `json:"path"` // e.g. "artist" or "artist/3/track"
+	Category  string           `json:"category"`
+	Selection []SelectionEntry `json:"selection"`
+	Count     int              `json:"count"`
+	Records   []string         `json:"records"`
+	Current   bool             `json:"current"` // whether this is the list shown last
+}
+
+// screen returns the screen for a category at the current selection.  The
+// mutex must be held.
+func (s *Session) screen(category extremote.DBCategoryType) *Screen {
+	var path []string
+	selection := []SelectionEntry{}
+	for _, selected := range s.selection {
+		path = append(path, CategoryName(selected.Category), strconv.Itoa(selected.Index))
+		selection = append(selection, SelectionEntry{CategoryName(selected.Category), selected.Index})
+	}
+	path = append(path, CategoryName(category))
+	key := strings.Join(path, "/")
+	if s.screens == nil {
+		s.screens = map[string]*Screen{}
+	}
+	screen, ok := s.screens[key]
+	if !ok {
+		screen = &Screen{
+			Path:      key,
+			Category:  CategoryName(category),
+			Selection: selection,
+			Records:   []string{},
+		}
+		s.screens[key] = screen
+	}
+	s.currentScreen = key
+	return screen
+}
+
+// RecordsCounted records the number of records the player reported for a
+// category, at the current selection.
+func (s *Session) RecordsCounted(category extremote.DBCategoryType, count int) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.screen(category).Count = count
+}
+
+// RecordsRetrieved records the records the player returned for a category,
+// at the current selection.
+func (s *Session) RecordsRetrieved(category extremote.DBCategoryType, offset int, records []string) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	screen := s.screen(category)
+	if offset < 0 {
+		return
+	}
+	for len(screen.Records) < offset+len(records) {
+		screen.Records = append(screen.Records, "")
+	}
+	copy(screen.Records[offset:], records)
+}
+
+// Screens returns copies of the lists the head unit has shown, sorted by
+// path.
+func (s *Session) Screens() []Screen {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	screens := []Screen{}
+	for key, screen := range s.screens {
+		copied := *screen
+		copied.Records = append([]string{}, screen.Records...)
+		copied.Current = key == s.currentScreen
+		screens = append(screens, copied)
+	}
+	sort.Slice(screens, func(i, j int) bool {
+		return screens[i].Path < screens[j].Path
+	})
+	return screens
+}
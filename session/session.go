@@ -0,0 +1,207 @@
+package session
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"bmwctrl/device"
+	"bmwctrl/protocol"
+	"bmwctrl/transport"
+
+	"github.com/oandrew/ipod"
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+// Session holds the state of the conversation with the car that isn't kept
+// by the player: whether the car has identified itself, the shuffle and
+// repeat modes, the database records the car has selected, and counters of
+// the commands seen.  It also serialises access to the player, which is
+// used by the frame processing loop and by remote controls (e.g. the HTTP
+// API) at the same time.
+type Session struct {
+	// Updated atomically, and first so they are aligned on 32 bit ARM.
+	received  uint64
+	sent      uint64
+	unhandled uint64
+	malformed uint64
+
+	player      device.Player
+	playerMutex sync.Mutex
+
+	mutex          sync.Mutex
+	started        time.Time
+	identified     time.Time
+	lastCommand    time.Time
+	lastControl    extremote.PlayControlCmd
+	lastControlled time.Time
+	shuffle        extremote.ShuffleMode
+	repeat         extremote.RepeatMode
+	selection      []Selection
+	transportStats func() transport.Stats
+	screens        map[string]*Screen
+	currentScreen  string
+
+	seq          uint64
+	lastReceived uint64
+	events       []Event
+	subscribers  map[chan Event]bool
+}
+
+// Selection is a database record selected by the car.
+type Selection struct {
+	Category extremote.DBCategoryType `json:"category"`
+	Index    int                      `json:"index"`
+}
+
+// New creates a session for a player.
+func New(player device.Player) *Session {
+	return &Session{
+		player:  player,
+		started: time.Now(),
+	}
+}
+
+// WithPlayer calls fn with the player, making sure nothing else uses the
+// player at the same time.
+func (s *Session) WithPlayer(fn func(player device.Player)) {
+	defer s.playerMutex.Unlock()
+	s.playerMutex.Lock()
+	fn(s.player)
+}
+
+// SetTransportStats sets the function used to read the transport's
+// counters, for transports that keep them.
+func (s *Session) SetTransportStats(stats func() transport.Stats) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.transportStats = stats
+}
+
+// Identified records that the car has identified itself.
+func (s *Session) Identified() {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.identified = time.Now()
+}
+
+// IsIdentified reports whether the car has identified itself.
+func (s *Session) IsIdentified() bool {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return !s.identified.IsZero()
+}
+
+// CommandReceived counts a command from the car.
+func (s *Session) CommandReceived(cmd *ipod.Command) {
+	atomic.AddUint64(&s.received, 1)
+	s.mutex.Lock()
+	s.lastCommand = time.Now()
+	s.mutex.Unlock()
+	s.CommandEvent(">", cmd)
+}
+
+// LastCommand returns when the last command was received from the car, or
+// the zero time if none has been.
+func (s *Session) LastCommand() time.Time {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.lastCommand
+}
+
+// PlayControlled records a play control (e.g. next track) given to the
+// player, by the car or a remote control.
+func (s *Session) PlayControlled(cmd extremote.PlayControlCmd) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.lastControl = cmd
+	s.lastControlled = time.Now()
+}
+
+// LastPlayControl returns the last play control given to the player, and
+// when, or the zero time if there hasn't been one.
+func (s *Session) LastPlayControl() (extremote.PlayControlCmd, time.Time) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.lastControl, s.lastControlled
+}
+
+// CommandSent counts a command sent to the car.
+func (s *Session) CommandSent(cmd *ipod.Command) {
+	atomic.AddUint64(&s.sent, 1)
+	s.CommandEvent("<", cmd)
+}
+
+// CommandUnhandled counts a command from the car that wasn't understood,
+// and flags it to the dashboard.
+func (s *Session) CommandUnhandled(cmd *ipod.Command) {
+	atomic.AddUint64(&s.unhandled, 1)
+	s.publish(Event{
+		Kind:    "unhandled",
+		Lingo:   protocol.LingoName(cmd.ID.LingoID()),
+		ID:      fmt.Sprintf("%x", cmd.ID.CmdID()),
+		Command: protocol.CommandName(cmd),
+	})
+}
+
+// PacketMalformed counts a frame from the car that couldn't be decoded.
+func (s *Session) PacketMalformed() {
+	atomic.AddUint64(&s.malformed, 1)
+}
+
+// Shuffle returns the shuffle mode.
+func (s *Session) Shuffle() extremote.ShuffleMode {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.shuffle
+}
+
+// SetShuffle sets the shuffle mode.
+func (s *Session) SetShuffle(mode extremote.ShuffleMode) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.shuffle = mode
+}
+
+// Repeat returns the repeat mode.
+func (s *Session) Repeat() extremote.RepeatMode {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return s.repeat
+}
+
+// SetRepeat sets the repeat mode.
+func (s *Session) SetRepeat(mode extremote.RepeatMode) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.repeat = mode
+}
+
+// ResetSelection clears the database selection.
+func (s *Session) ResetSelection() {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.selection = nil
+}
+
+// Select records a database selection.  A negative index goes back up a
+// level, as it does for the player.
+func (s *Session) Select(category extremote.DBCategoryType, index int) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	if index < 0 {
+		if len(s.selection) > 0 {
+			s.selection = s.selection[:len(s.selection)-1]
+		}
+		return
+	}
+	s.selection = append(s.selection, Selection{category, index})
+}
+
+// Selection returns the database records selected, from the top level down.
+func (s *Session) Selection() []Selection {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	return append([]Selection(nil), s.selection...)
+}
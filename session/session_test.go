@@ -0,0 +1,86 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+
+	"bmwctrl/device/mock"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+func TestScreens(t *testing.T) {
+	s := New(nil)
+	s.RecordsCounted(extremote.DbCategoryArtist, 3)
+	s.RecordsRetrieved(extremote.DbCategoryArtist, 1, []string{"B", "C"})
+	s.Select(extremote.DbCategoryArtist, 2)
+	s.RecordsCounted(extremote.DbCategoryTrack, 1)
+	s.RecordsRetrieved(extremote.DbCategoryTrack, 0, []string{"Song"})
+	s.Select(extremote.DbCategoryArtist, -1)
+
+	screens := s.Screens()
+	if len(screens) != 2 {
+		t.Fatalf("got %d screens, want 2: %+v", len(screens), screens)
+	}
+	if screens[0].Path != "artist" || !reflect.DeepEqual(screens[0].Records, []string{"", "B", "C"}) || screens[0].Current {
+		t.Errorf("artist screen = %+v", screens[0])
+	}
+	if screens[1].Path != "artist/2/track" || screens[1].Count != 1 || !screens[1].Current {
+		t.Errorf("track screen = %+v", screens[1])
+	}
+	if len(s.Selection()) != 0 {
+		t.Errorf("selection = %+v", s.Selection())
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	s := New(nil)
+	s.publish(Event{Kind: "command", Dir: ">", Command: "GetPlayStatus"})
+	backlog, events, cancel := s.Subscribe()
+	defer cancel()
+	if len(backlog) != 1 || backlog[0].Seq != 1 {
+		t.Fatalf("backlog = %+v", backlog)
+	}
+	s.publish(Event{Kind: "unhandled"})
+	e := <-events
+	if e.Seq != 2 || e.Ref != 1 {
+		t.Errorf("unhandled event = %+v", e)
+	}
+}
+
+func TestParsePosition(t *testing.T) {
+	for value, want := range map[string]int{"90000": 90000, "1m30s": 90000, "1.5s": 1500} {
+		if got, err := ParsePosition(value); err != nil || got != want {
+			t.Errorf("ParsePosition(%q) = %d, %v", value, got, err)
+		}
+	}
+	if _, err := ParsePosition("soon"); err == nil {
+		t.Errorf("ParsePosition(\"soon\") didn't fail")
+	}
+}
+
+func TestRestore(t *testing.T) {
+	player := mock.NewPlayer(nil)
+	defer player.Close()
+	s := New(player)
+	s.Control("repeat", "all")
+	player.SelectDBRecord(extremote.DbCategoryPlaylist, 2)
+	s.Select(extremote.DbCategoryPlaylist, 2)
+	player.PlayCurrentSelection(1)
+	player.PlayControl(extremote.PlayControlPause)
+	player.Seek(5000)
+	snap := s.Snapshot()
+
+	restored := mock.NewPlayer(nil)
+	defer restored.Close()
+	r := New(restored)
+	r.Restore(snap)
+	if status := r.Status(); status.Track == nil || status.Track.Title != "Song Three" ||
+		status.Track.Position != 5000 || status.State != "paused" || status.QueueLength != 2 ||
+		status.Repeat != "all" {
+		t.Errorf("restored status = %+v, track %+v", status, status.Track)
+	}
+	if !reflect.DeepEqual(r.Selection(), snap.Selection) {
+		t.Errorf("restored selection = %+v", r.Selection())
+	}
+}
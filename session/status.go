@@ -0,0 +1,203 @@
+package session
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"bmwctrl/device"
+
+	"github.com/oandrew/ipod/lingo-extremote"
+)
+
+// Status is a snapshot of the session and the player, as reported by the
+// HTTP API.  Times and lengths are in milliseconds, as in the protocol.
+type Status struct {
+	Started     time.Time        `json:"started"`
+	Identified  bool             `json:"identified"`
+	LastCommand *time.Time       `json:"last_command,omitempty"`
+	State       string           `json:"state"`
+	Track       *Track           `json:"track,omitempty"`
+	QueueLength int              `json:"queue_length"`
+	Shuffle     string           `json:"shuffle"`
+	Repeat      string           `json:"repeat"`
+	Selection   []SelectionEntry `json:"selection"`
+	Counters    Counters         `json:"counters"`
+}
+
+// Track is a track in the play queue.
+type Track struct {
+	Index    int    `json:"index"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Length   int    `json:"length,omitempty"`
+	Position int    `json:"position,omitempty"`
+}
+
+// SelectionEntry is a database selection, with the category named.
+type SelectionEntry struct {
+	Category string `json:"category"`
+	Index    int    `json:"index"`
+}
+
+// Counters counts the frames and commands that have gone to and from the
+// car.
+type Counters struct {
+	Frames            uint64 `json:"frames"`
+	BadFrames         uint64 `json:"bad_frames"`
+	SkippedBytes      uint64 `json:"skipped_bytes"`
+	FramesSent        uint64 `json:"frames_sent"`
+	CommandsReceived  uint64 `json:"commands_received"`
+	CommandsSent      uint64 `json:"commands_sent"`
+	CommandsUnhandled uint64 `json:"commands_unhandled"`
+	PacketsMalformed  uint64 `json:"packets_malformed"`
+}
+
+// Status returns a snapshot of the session and the player.
+func (s *Session) Status() Status {
+	s.mutex.Lock()
+	status := Status{
+		Started:    s.started,
+		Identified: !s.identified.IsZero(),
+		Shuffle:    ShuffleName(s.shuffle),
+		Repeat:     RepeatName(s.repeat),
+		Selection:  []SelectionEntry{},
+	}
+	if !s.lastCommand.IsZero() {
+		lastCommand := s.lastCommand
+		status.LastCommand = &lastCommand
+	}
+	for _, selected := range s.selection {
+		status.Selection = append(status.Selection, SelectionEntry{CategoryName(selected.Category), selected.Index})
+	}
+	transportStats := s.transportStats
+	s.mutex.Unlock()
+
+	status.Counters = s.Counters()
+	if transportStats != nil {
+		stats := transportStats()
+		status.Counters.Frames = stats.Frames
+		status.Counters.BadFrames = stats.BadFrames
+		status.Counters.SkippedBytes = stats.Skipped
+		status.Counters.FramesSent = stats.Sent
+	}
+
+	s.WithPlayer(func(player device.Player) {
+		length, position, state := player.GetPlayStatus()
+		status.State = StateName(state)
+		status.QueueLength = player.GetNumPlayingTracks()
+		if status.QueueLength > 0 && state != extremote.PlayerStateStopped {
+			track := queueTrack(player, player.GetCurrentPlayingTrackIndex())
+			track.Length = length
+			track.Position = position
+			status.Track = &track
+		}
+	})
+	return status
+}
+
+// Counters returns the command counters.  The frame counters are left at
+// zero, as only the transport knows them.
+func (s *Session) Counters() Counters {
+	return Counters{
+		CommandsReceived:  atomic.LoadUint64(&s.received),
+		CommandsSent:      atomic.LoadUint64(&s.sent),
+		CommandsUnhandled: atomic.LoadUint64(&s.unhandled),
+		PacketsMalformed:  atomic.LoadUint64(&s.malformed),
+	}
+}
+
+// Queue returns up to count tracks of the play queue, starting at offset.
+// A negative count returns the rest of the queue.
+func (s *Session) Queue(offset, count int) []Track {
+	tracks := []Track{}
+	s.WithPlayer(func(player device.Player) {
+		length := player.GetNumPlayingTracks()
+		if offset < 0 {
+			offset = 0
+		}
+		if count < 0 || offset+count > length {
+			count = length - offset
+		}
+		for i := offset; i < offset+count; i++ {
+			tracks = append(tracks, queueTrack(player, i))
+		}
+	})
+	return tracks
+}
+
+func queueTrack(player device.Player, index int) Track {
+	return Track{
+		Index:  index,
+		Title:  player.GetIndexedPlayingTrackTitle(index),
+		Artist: player.GetIndexedPlayingTrackArtistName(index),
+		Album:  player.GetIndexedPlayingTrackAlbumName(index),
+	}
+}
+
+var (
+	stateNames = map[extremote.PlayerState]string{
+		extremote.PlayerStateStopped: "stopped",
+		extremote.PlayerStatePlaying: "playing",
+		extremote.PlayerStatePaused:  "paused",
+		extremote.PlayerStateError:   "error",
+	}
+	shuffleNames = map[extremote.ShuffleMode]string{
+		extremote.ShuffleOff:    "off",
+		extremote.ShuffleTracks: "tracks",
+		extremote.ShuffleAlbums: "albums",
+	}
+	repeatNames = map[extremote.RepeatMode]string{
+		extremote.RepeatOff: "off",
+		extremote.RepeatOne: "one",
+		extremote.RepeatAll: "all",
+	}
+)
+
+// StateName returns the name of a player state (e.g. "playing".)
+func StateName(state extremote.PlayerState) string {
+	return nameOf(stateNames[state], uint8(state))
+}
+
+// ShuffleName returns the name of a shuffle mode (e.g. "albums".)
+func ShuffleName(mode extremote.ShuffleMode) string {
+	return nameOf(shuffleNames[mode], uint8(mode))
+}
+
+// RepeatName returns the name of a repeat mode (e.g. "all".)
+func RepeatName(mode extremote.RepeatMode) string {
+	return nameOf(repeatNames[mode], uint8(mode))
+}
+
+// CategoryName returns the name of a database category (e.g. "artist".)
+func CategoryName(category extremote.DBCategoryType) string {
+	return nameOf(device.CategoryNames[category], uint8(category))
+}
+
+// ParseShuffle reads a shuffle mode by name.
+func ParseShuffle(name string) (extremote.ShuffleMode, error) {
+	for mode, n := range shuffleNames {
+		if n == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown shuffle mode '%s' (off, tracks or albums)", name)
+}
+
+// ParseRepeat reads a repeat mode by name.
+func ParseRepeat(name string) (extremote.RepeatMode, error) {
+	for mode, n := range repeatNames {
+		if n == name {
+			return mode, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown repeat mode '%s' (off, one or all)", name)
+}
+
+func nameOf(name string, value uint8) string {
+	if name == "" {
+		return fmt.Sprintf("unknown(%d)", value)
+	}
+	return name
+}
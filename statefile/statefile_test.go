@@ -0,0 +1,34 @@
+package statefile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "statefile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	type state struct{ Index int }
+	for i := 1; i <= 2; i++ {
+		if err := WriteJSON(path, state{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got state
+	if err := ReadJSON(path, &got); err != nil || got.Index != 2 {
+		t.Errorf("got %+v, %v", got, err)
+	}
+
+	// Only the state file is left behind.
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("%d files left in the directory", len(files))
+	}
+}
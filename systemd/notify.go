@@ -0,0 +1,62 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends a state change (e.g. "READY=1") to systemd, over the socket
+// systemd passes in NOTIFY_SOCKET.  It does nothing if bmwctrl isn't run by
+// systemd, or the unit isn't Type=notify.
+func Notify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	// A leading @ means the socket is in the abstract namespace.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// Ready tells systemd that startup is done.
+func Ready() error {
+	return Notify("READY=1")
+}
+
+// Stopping tells systemd that bmwctrl is shutting down.
+func Stopping() error {
+	return Notify("STOPPING=1")
+}
+
+// Status sets the status shown by systemctl status.
+func Status(status string) error {
+	return Notify("STATUS=" + status)
+}
+
+// Watchdog tells systemd that bmwctrl is still alive.
+func Watchdog() error {
+	return Notify("WATCHDOG=1")
+}
+
+// WatchdogInterval returns the interval systemd expects to be told that
+// bmwctrl is alive within, or 0 if the watchdog isn't enabled for it.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
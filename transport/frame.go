@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"sync/atomic"
+)
+
+// maxFrameLength caps the payload length accepted from a frame header.  The
+// largest frames the car sends are the display image chunks, which are well
+// under this.  Without a cap, a corrupted large frame header could make us
+// wait for tens of kilobytes that are never coming.
+const maxFrameLength = 2048
+
+// How much of a dropped frame to include in the log.
+const maxLoggedBytes = 32
+
+// Stats counts the frames seen by a transport.
+type Stats struct {
+	Frames    uint64 // Valid frames received.
+	BadFrames uint64 // Frames dropped for a bad length or checksum, or cut short.
+	Skipped   uint64 // Noise bytes skipped while looking for a frame.
+	Sent      uint64 // Frames written.
+}
+
+// frameReader splits a byte stream into frames.  Frames are validated by
+// their length and checksum before being accepted.  When a frame is bad
+// (which happens when the car aborts a frame mid-way and starts the next
+// one), only its start byte is consumed, and the search for the next start
+// byte resumes just after it.  This means the frame that interrupted the bad
+// one is still found, instead of being swallowed with it.
+type frameReader struct {
+	stats Stats // First, so the counters are aligned for atomic use on 32 bit ARM.
+	r     *bufio.Reader
+}
+
+func newFrameReader(r io.Reader) *frameReader {
+	return &frameReader{r: bufio.NewReaderSize(r, maxFrameLength+8)}
+}
+
+// readFrame returns the next valid frame.  Bad frames are logged and
+// counted, but not returned as errors.  If a read times out in the middle of
+// a frame, the partial frame is dropped, and unless another frame starts in
+// what was received, ErrTimeout is returned.
+func (f *frameReader) readFrame() ([]byte, error) {
+	var skipped []byte
+	var count int
+	for {
+		b, err := f.r.ReadByte()
+		if err != nil {
+			f.skipped(count, skipped)
+			return nil, err
+		}
+		if b != startByte {
+			if b != syncByte {
+				if len(skipped) < maxLoggedBytes {
+					skipped = append(skipped, b)
+				}
+				count++
+			}
+			continue
+		}
+
+		frame, err := f.peekFrame()
+		if err != nil {
+			if f.truncated() {
+				continue
+			}
+			f.skipped(count, skipped)
+			return nil, err
+		}
+		if frame == nil {
+			continue
+		}
+		f.skipped(count, skipped)
+		atomic.AddUint64(&f.stats.Frames, 1)
+		return frame, nil
+	}
+}
+
+// peekFrame validates the frame following a start byte, without consuming
+// it.  If it is valid, it is consumed and returned with its start byte.
+// If it isn't, or it's cut short by a read error, nil is returned and the
+// reader is left just after the start byte.
+func (f *frameReader) peekFrame() ([]byte, error) {
+	header, err := f.r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	length := int(header[0])
+	headerLength := 1
+	if length == 0 {
+		header, err = f.r.Peek(3)
+		if err != nil {
+			return nil, err
+		}
+		length = int(header[1])<<8 | int(header[2])
+		headerLength = 3
+	}
+	if length > maxFrameLength {
+		f.dropped("bad length", header)
+		return nil, nil
+	}
+
+	data, err := f.r.Peek(headerLength + length + 1)
+	if err != nil {
+		return nil, err
+	}
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	if sum != 0 {
+		f.dropped("bad checksum", data)
+		return nil, nil
+	}
+
+	frame := make([]byte, len(data)+1)
+	frame[0] = startByte
+	copy(frame[1:], data)
+	f.r.Discard(len(data))
+	return frame, nil
+}
+
+// truncated handles a read error in the middle of a frame, such as a
+// timeout or a dropped network connection.  The rest of the frame isn't
+// coming, but an aborted frame's length can cover the next frame, so the
+// bytes received are searched for the start of another.  If there is one,
+// the bytes before it are dropped, and truncated reports that the search
+// carries on from it; otherwise everything received is thrown away.
+func (f *frameReader) truncated() bool {
+	partial, _ := f.r.Peek(f.r.Buffered())
+	next := bytes.Index(partial, []byte{syncByte, startByte})
+	if next < 0 {
+		next = len(partial)
+	}
+	f.dropped("cut short", partial[:next])
+	f.r.Discard(next)
+	return f.r.Buffered() > 0
+}
+
+func (f *frameReader) dropped(reason string, data []byte) {
+	atomic.AddUint64(&f.stats.BadFrames, 1)
+	frame := "55" + hex.EncodeToString(data)
+	if len(data) > maxLoggedBytes {
+		frame = "55" + hex.EncodeToString(data[:maxLoggedBytes]) + "..."
+	}
+	logger.Warn("Dropped frame, resynchronising", "reason", reason, "frame", frame)
+}
+
+// skipped handles the noise bytes found while looking for a frame.  Only the
+// first few are kept for the log.
+func (f *frameReader) skipped(count int, data []byte) {
+	if count == 0 {
+		return
+	}
+	atomic.AddUint64(&f.stats.Skipped, uint64(count))
+	noise := hex.EncodeToString(data)
+	if count > len(data) {
+		noise += "..."
+	}
+	logger.Warn("Skipped noise between frames", "count", count, "noise", noise)
+}
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"bmwctrl/options"
+)
+
+// How long to wait between attempts to connect out.
+const defaultRetryInterval = 5 * time.Second
+
+var errNotConnected = errors.New("transport: not connected")
+
+// OpenNet opens a network transport.  This lets the car's serial line be
+// forwarded over the network (e.g. by ser2net on the Pi), or a head unit
+// simulator be attached from a laptop.  The network is "tcp" or "unix".
+//
+//	connect=ADDR       connect out to ADDR (can also be given without a key)
+//	listen=ADDR        listen on ADDR, accepting one connection at a time
+//	retry=DURATION     time between attempts to connect out (default 5s)
+//
+// Either way, the connection is re-established whenever it is dropped.  No
+// frames are read while disconnected, and frames written are discarded.
+func OpenNet(network string, opts options.Options, tx io.Writer, rx io.Writer) (*Transport, error) {
+	err := opts.Check("connect", "listen", "retry")
+	if err != nil {
+		return nil, err
+	}
+	s := &netStream{
+		network: network,
+		addr:    opts.String("connect", ""),
+	}
+	if s.retry, err = opts.Duration("retry", defaultRetryInterval); err != nil {
+		return nil, err
+	}
+
+	listen := opts.String("listen", "")
+	switch {
+	case listen != "" && s.addr != "":
+		return nil, fmt.Errorf("options 'connect' and 'listen' can't both be given")
+	case listen != "":
+		if network == "unix" {
+			removeStaleSocket(listen)
+		}
+		s.addr = listen
+		s.listener, err = net.Listen(network, listen)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Listening for connections", "network", network, "addr", listen)
+	case s.addr == "":
+		return nil, fmt.Errorf("one of the 'connect' or 'listen' options is needed")
+	}
+	return New(s, tx, rx), nil
+}
+
+// netStream is a byte stream over a network connection that reconnects
+// whenever the connection drops.  Reads block until a connection is made.
+type netStream struct {
+	network  string
+	addr     string
+	retry    time.Duration
+	listener net.Listener
+	mutex    sync.Mutex
+	conn     net.Conn
+	closed   bool
+}
+
+func (s *netStream) Read(b []byte) (int, error) {
+	conn, err := s.connection()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(b)
+	if err != nil {
+		s.disconnect(conn, err)
+	}
+	return n, err
+}
+
+func (s *netStream) Write(b []byte) (int, error) {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+	if conn == nil {
+		return 0, errNotConnected
+	}
+	n, err := conn.Write(b)
+	if err != nil {
+		s.disconnect(conn, err)
+	}
+	return n, err
+}
+
+func (s *netStream) Close() error {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// connection returns the current connection, waiting for a new one if
+// there is none.
+func (s *netStream) connection() (net.Conn, error) {
+	s.mutex.Lock()
+	conn, closed := s.conn, s.closed
+	s.mutex.Unlock()
+	if closed {
+		return nil, io.EOF
+	}
+	if conn != nil {
+		return conn, nil
+	}
+
+	var err error
+	if s.listener != nil {
+		conn, err = s.accept()
+	} else {
+		conn, err = s.dial()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	if s.closed {
+		conn.Close()
+		return nil, io.EOF
+	}
+	s.conn = conn
+	return conn, nil
+}
+
+func (s *netStream) accept() (net.Conn, error) {
+	conn, err := s.listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Accepted connection", "remote", conn.RemoteAddr())
+	return conn, nil
+}
+
+func (s *netStream) dial() (net.Conn, error) {
+	for {
+		conn, err := net.Dial(s.network, s.addr)
+		if err == nil {
+			logger.Info("Connected", "network", s.network, "addr", s.addr)
+			return conn, nil
+		}
+		logger.Warn("Can't connect, retrying", "network", s.network, "addr", s.addr, "retry", s.retry, "err", err)
+		time.Sleep(s.retry)
+
+		s.mutex.Lock()
+		closed := s.closed
+		s.mutex.Unlock()
+		if closed {
+			return nil, io.EOF
+		}
+	}
+}
+
+// disconnect drops conn after an error, so that the next read reconnects.
+func (s *netStream) disconnect(conn net.Conn, err error) {
+	defer s.mutex.Unlock()
+	s.mutex.Lock()
+	if s.conn != conn {
+		return
+	}
+	if !s.closed {
+		logger.Info("Connection dropped", "network", s.network, "addr", s.addr, "err", err)
+	}
+	conn.Close()
+	s.conn = nil
+}
+
+// removeStaleSocket removes a socket file left behind by a previous run,
+// which would otherwise prevent listening on it again.
+func removeStaleSocket(path string) {
+	info, err := os.Stat(path)
+	if err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"io"
+	"os"
+
+	"bmwctrl/options"
+)
+
+// OpenPty creates a pseudo-terminal pair, and returns a transport on the
+// master side.  Anything that can talk to a serial port (minicom, socat, the
+// script replayer, python iPod emulators) can then be pointed at the slave
+// side, and talks to bmwctrl exactly as the car would.
+//
+//	link=PATH          also create a symlink to the slave at PATH
+func OpenPty(opts options.Options, tx io.Writer, rx io.Writer) (*Transport, error) {
+	if err := opts.Check("link"); err != nil {
+		return nil, err
+	}
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	p := &ptyStream{File: master, slave: slave}
+	logger.Info("Pseudo-terminal ready", "path", slave.Name())
+
+	if link := opts.String("link", ""); link != "" {
+		os.Remove(link)
+		if err := os.Symlink(slave.Name(), link); err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.link = link
+		logger.Info("Pseudo-terminal linked", "link", link)
+	}
+	return New(p, tx, rx), nil
+}
+
+// ptyStream is the master side of a pseudo-terminal.  The slave side is
+// kept open too, otherwise reads on the master fail whenever no one else
+// has the slave open (e.g. between two runs of the script replayer.)
+type ptyStream struct {
+	*os.File
+	slave *os.File
+	link  string
+}
+
+func (p *ptyStream) Close() error {
+	if p.link != "" {
+		os.Remove(p.link)
+	}
+	p.slave.Close()
+	return p.File.Close()
+}
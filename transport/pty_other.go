@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package transport
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (master *os.File, slave *os.File, err error) {
+	return nil, nil, errors.New("pseudo-terminals are only supported on linux")
+}
@@ -0,0 +1,232 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"bmwctrl/options"
+
+	"github.com/jacobsa/go-serial/serial"
+)
+
+// The baud rates tried, in order, when the baud rate is set to "auto".  The
+// BMW interface runs at 9600, while other iPod dock interfaces (MINI,
+// Alpine, Dension) use the faster rates.
+var autoBaudRates = []int{9600, 19200, 38400, 57600, 115200}
+
+// How long to listen for a valid frame at each rate when probing.
+const defaultProbeTime = 3 * time.Second
+
+// How long to keep probing before giving up, by default.  It's within
+// systemd's default start timeout, so that a notify service fails and is
+// restarted rather than timing out before it's ready.
+const defaultProbeLimit = time.Minute
+
+// Read timeout used while probing if none was configured, so that reads
+// return in time to switch to the next rate.  The port keeps it once the
+// rate is found.
+const probeReadTimeout = 100 * time.Millisecond
+
+// SerialOptions configures the serial line used to talk to the car.
+type SerialOptions struct {
+	Device      string
+	BaudRate    int // 0 means probe for the baud rate.
+	DataBits    int
+	StopBits    int
+	Parity      serial.ParityMode
+	FlowControl bool
+	ReadTimeout time.Duration // 0 means block until data is available.
+	ProbeTime   time.Duration
+	ProbeLimit  time.Duration // 0 means probe until a frame is received.
+}
+
+// ParseSerialOptions reads the serial line settings from the transport
+// options.  The defaults are the 9600 8N1 settings used by the BMW interface.
+//
+//	device=PATH            serial device (can also be given without a key)
+//	baud=RATE|auto         line speed, or auto to probe for it
+//	databits=5|6|7|8
+//	parity=none|odd|even
+//	stopbits=1|2
+//	flow=none|rtscts
+//	timeout=DURATION       read timeout, e.g. 100ms (0 blocks)
+//	probe=DURATION         time spent listening at each rate when probing
+//	probe-limit=DURATION   time spent probing before giving up (0 never does)
+func ParseSerialOptions(opts options.Options) (SerialOptions, error) {
+	o := SerialOptions{
+		Device:     opts.String("device", ""),
+		ProbeTime:  defaultProbeTime,
+		ProbeLimit: defaultProbeLimit,
+	}
+	err := opts.Check("device", "baud", "databits", "parity", "stopbits", "flow", "timeout", "probe", "probe-limit")
+	if err != nil {
+		return o, err
+	}
+	if o.Device == "" {
+		return o, fmt.Errorf("no serial device given")
+	}
+
+	baud := opts.String("baud", "9600")
+	if baud != "auto" {
+		o.BaudRate, err = strconv.Atoi(baud)
+		if err != nil || o.BaudRate <= 0 {
+			return o, fmt.Errorf("option 'baud' must be a rate or 'auto', got '%s'", baud)
+		}
+	}
+	if o.DataBits, err = opts.Int("databits", 8); err != nil {
+		return o, err
+	}
+	if o.DataBits < 5 || o.DataBits > 8 {
+		return o, fmt.Errorf("option 'databits' must be between 5 and 8, got %d", o.DataBits)
+	}
+	if o.StopBits, err = opts.Int("stopbits", 1); err != nil {
+		return o, err
+	}
+	if o.StopBits != 1 && o.StopBits != 2 {
+		return o, fmt.Errorf("option 'stopbits' must be 1 or 2, got %d", o.StopBits)
+	}
+	switch parity := opts.String("parity", "none"); parity {
+	case "none":
+		o.Parity = serial.PARITY_NONE
+	case "odd":
+		o.Parity = serial.PARITY_ODD
+	case "even":
+		o.Parity = serial.PARITY_EVEN
+	default:
+		return o, fmt.Errorf("option 'parity' must be none, odd or even, got '%s'", parity)
+	}
+	switch flow := opts.String("flow", "none"); flow {
+	case "none":
+	case "rtscts":
+		o.FlowControl = true
+	default:
+		return o, fmt.Errorf("option 'flow' must be none or rtscts, got '%s'", flow)
+	}
+	if o.ReadTimeout, err = opts.Duration("timeout", 0); err != nil {
+		return o, err
+	}
+	if o.ProbeTime, err = opts.Duration("probe", defaultProbeTime); err != nil {
+		return o, err
+	}
+	if o.ProbeLimit, err = opts.Duration("probe-limit", defaultProbeLimit); err != nil {
+		return o, err
+	}
+	return o, nil
+}
+
+// String describes the line settings, e.g. "/dev/ttyUSB0 9600 8N1".
+func (o SerialOptions) String() string {
+	baud := "auto"
+	if o.BaudRate != 0 {
+		baud = strconv.Itoa(o.BaudRate)
+	}
+	parity := "N"
+	switch o.Parity {
+	case serial.PARITY_ODD:
+		parity = "O"
+	case serial.PARITY_EVEN:
+		parity = "E"
+	}
+	s := fmt.Sprintf("%s %s %d%s%d", o.Device, baud, o.DataBits, parity, o.StopBits)
+	if o.FlowControl {
+		s += " rtscts"
+	}
+	return s
+}
+
+// OpenSerial opens the serial device and returns a frame transport over it.
+// If no baud rate is set, the rates in autoBaudRates are tried until a valid
+// frame is received, and without a read timeout, the transport has
+// probeReadTimeout.
+func OpenSerial(o SerialOptions, tx io.Writer, rx io.Writer) (*Transport, error) {
+	if o.BaudRate != 0 {
+		port, err := openSerialPort(o)
+		if err != nil {
+			return nil, err
+		}
+		return New(port, tx, rx), nil
+	}
+	return probeSerial(o, tx, rx)
+}
+
+// probeSerial cycles through the auto baud rates until a valid frame is
+// seen.  The car only talks when it is awake, so this keeps trying until it
+// succeeds, or the probe limit is reached.  To prompt the other end, a
+// RequestIdentify is sent after switching to each rate.
+func probeSerial(o SerialOptions, tx io.Writer, rx io.Writer) (*Transport, error) {
+	if o.ReadTimeout == 0 {
+		o.ReadTimeout = probeReadTimeout
+	}
+	start := time.Now()
+	for {
+		for _, rate := range autoBaudRates {
+			if o.ProbeLimit > 0 && time.Since(start) >= o.ProbeLimit {
+				return nil, fmt.Errorf("no valid frame received at any baud rate within %v", o.ProbeLimit)
+			}
+			o.BaudRate = rate
+			logger.Info("Probing serial device", "baud", rate)
+			port, err := openSerialPort(o)
+			if err != nil {
+				return nil, err
+			}
+			t := New(port, tx, rx)
+			t.WriteFrame([]byte{0x55, 0x02, 0x00, 0x00, 0xfe})
+			deadline := time.Now().Add(o.ProbeTime)
+			for time.Now().Before(deadline) {
+				frame, err := t.frames.readFrame()
+				if err == ErrTimeout {
+					continue
+				}
+				if err != nil {
+					port.Close()
+					return nil, err
+				}
+				logger.Info("Received a valid frame", "baud", rate)
+				t.pending = frame
+				return t, nil
+			}
+			port.Close()
+		}
+	}
+}
+
+// openSerialPort opens the serial device with the given line settings.
+func openSerialPort(o SerialOptions) (io.ReadWriteCloser, error) {
+	open := serial.OpenOptions{
+		PortName:          o.Device,
+		BaudRate:          uint(o.BaudRate),
+		DataBits:          uint(o.DataBits),
+		StopBits:          uint(o.StopBits),
+		ParityMode:        o.Parity,
+		RTSCTSFlowControl: o.FlowControl,
+	}
+
+	// The serial driver works in tenths of a second, and needs either a
+	// timeout or a minimum read size.
+	if o.ReadTimeout > 0 {
+		open.InterCharacterTimeout = uint((o.ReadTimeout + 99*time.Millisecond) / (100 * time.Millisecond) * 100)
+	} else {
+		open.MinimumReadSize = 1
+	}
+	port, err := serial.Open(open)
+	if err != nil {
+		return nil, err
+	}
+	return &serialPort{port}, nil
+}
+
+// serialPort maps the end-of-file returned by the serial driver when a read
+// times out to ErrTimeout, so that it isn't confused with a closed port.
+type serialPort struct {
+	io.ReadWriteCloser
+}
+
+func (p *serialPort) Read(b []byte) (int, error) {
+	n, err := p.ReadWriteCloser.Read(b)
+	if n == 0 && err == io.EOF {
+		return 0, ErrTimeout
+	}
+	return n, err
+}
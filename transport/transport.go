@@ -0,0 +1,102 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"bmwctrl/logging"
+)
+
+var logger = logging.New("transport")
+
+const (
+	// syncByte is sent ahead of every frame on the serial link, and lets
+	// the receiver synchronise on the start of a frame.
+	syncByte = 0xff
+
+	// startByte is the first byte of every iPod packet.
+	startByte = 0x55
+)
+
+// ErrTimeout is returned by ReadFrame when no complete frame was received
+// within the transport's read timeout.  Any partially received frame is
+// dropped.
+var ErrTimeout = errors.New("transport: read timeout")
+
+// Transport reads and writes iPod frames over a byte stream.  Frames start
+// with the 0x55 start byte and end with the checksum, which is what
+// ipod.PacketReader and ipod.PacketWriter work with.  The 0xFF sync byte is
+// stripped on input, and added on output.
+type Transport struct {
+	rw      io.ReadWriteCloser
+	frames  *frameReader
+	pending []byte
+	tx      io.Writer
+	rx      io.Writer
+	wmutex  sync.Mutex
+}
+
+// New creates a frame transport over rw.  If tx or rx are not nil, every
+// frame written or read is also copied to them (this is used for logging.)
+func New(rw io.ReadWriteCloser, tx io.Writer, rx io.Writer) *Transport {
+	return &Transport{
+		rw:     rw,
+		frames: newFrameReader(rw),
+		tx:     tx,
+		rx:     rx,
+	}
+}
+
+// ReadFrame reads the next valid frame, skipping any noise and bad frames
+// that come before it.
+func (t *Transport) ReadFrame() ([]byte, error) {
+	frame := t.pending
+	t.pending = nil
+	if frame == nil {
+		var err error
+		frame, err = t.frames.readFrame()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.rx != nil {
+		t.rx.Write(frame)
+	}
+	return frame, nil
+}
+
+// WriteFrame writes out frame, preceded by the sync byte.
+func (t *Transport) WriteFrame(frame []byte) error {
+	defer t.wmutex.Unlock()
+	t.wmutex.Lock()
+
+	buffer := make([]byte, 0, len(frame)+1)
+	buffer = append(buffer, syncByte)
+	buffer = append(buffer, frame...)
+	_, err := t.rw.Write(buffer)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&t.frames.stats.Sent, 1)
+	if t.tx != nil {
+		t.tx.Write(frame)
+	}
+	return nil
+}
+
+// Stats returns the frame counters for this transport.
+func (t *Transport) Stats() Stats {
+	return Stats{
+		Frames:    atomic.LoadUint64(&t.frames.stats.Frames),
+		BadFrames: atomic.LoadUint64(&t.frames.stats.BadFrames),
+		Skipped:   atomic.LoadUint64(&t.frames.stats.Skipped),
+		Sent:      atomic.LoadUint64(&t.frames.stats.Sent),
+	}
+}
+
+// Close closes the underlying byte stream.
+func (t *Transport) Close() error {
+	return t.rw.Close()
+}
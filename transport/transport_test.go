@@ -0,0 +1,223 @@
+package transport
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+
+	"bmwctrl/options"
+)
+
+func TestReadFrame(t *testing.T) {
+	input := []byte{
+		0x00, 0xff, 0x55, 0x03, 0x00, 0x01, 0x04, 0xf8, // Identify
+		0xff, 0x55, 0x02, 0x00, 0x0d, 0xf1, // RequestiPodModelNum
+	}
+	f := newFrameReader(bytes.NewReader(input))
+
+	frame, err := f.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, input[2:8]) {
+		t.Errorf("got frame %x, want %x", frame, input[2:8])
+	}
+	frame, err = f.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, input[9:]) {
+		t.Errorf("got frame %x, want %x", frame, input[9:])
+	}
+	if f.stats.Frames != 2 || f.stats.Skipped != 1 {
+		t.Errorf("got stats %+v", f.stats)
+	}
+}
+
+func TestReadFrameChecksum(t *testing.T) {
+	input := []byte{
+		0xff, 0x55, 0x02, 0x00, 0x0d, 0xf2, // Bad checksum
+		0xff, 0x55, 0x02, 0x00, 0x0d, 0xf1,
+	}
+	f := newFrameReader(bytes.NewReader(input))
+	frame, err := f.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, input[7:]) {
+		t.Errorf("got frame %x, want %x", frame, input[7:])
+	}
+	if f.stats.BadFrames != 1 {
+		t.Errorf("got %d bad frames, want 1", f.stats.BadFrames)
+	}
+}
+
+func TestReadFrameResync(t *testing.T) {
+	// The car gives up on a frame part way through, and sends the next one.
+	// The aborted frame claims to be longer than it is, so its length covers
+	// the start of the next frame, which must still be found.
+	input := []byte{
+		0xff, 0x55, 0x04, 0x04, 0x00, // Aborted
+		0xff, 0x55, 0x03, 0x04, 0x00, 0x16, 0xe3, // ResetDBSelection
+	}
+	f := newFrameReader(bytes.NewReader(input))
+	frame, err := f.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, input[6:]) {
+		t.Errorf("got frame %x, want %x", frame, input[6:])
+	}
+}
+
+func TestReadLargeFrame(t *testing.T) {
+	payload := make([]byte, 300)
+	payload[0] = 0x04
+	frame := []byte{0x55, 0x00, 0x01, 0x2c}
+	frame = append(frame, payload...)
+	sum := byte(0x00 + 0x01 + 0x2c + 0x04)
+	frame = append(frame, -sum)
+
+	got, err := newFrameReader(bytes.NewReader(frame)).readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Errorf("large frame was not read intact")
+	}
+}
+
+func TestReadFrameTimeout(t *testing.T) {
+	f := newFrameReader(&timeoutReader{data: []byte{0xff, 0x55, 0x04, 0x04, 0x00}})
+	if _, err := f.readFrame(); err != ErrTimeout {
+		t.Fatalf("got error %v, want %v", err, ErrTimeout)
+	}
+	if f.stats.BadFrames != 1 || f.r.Buffered() != 0 {
+		t.Errorf("partial frame was not dropped")
+	}
+}
+
+func TestReadFrameResyncTimeout(t *testing.T) {
+	// As TestReadFrameResync, but the line goes quiet after the next frame,
+	// so the aborted frame is cut short by the timeout.
+	input := []byte{
+		0xff, 0x55, 0x0a, 0x04, 0x00, // Aborted
+		0xff, 0x55, 0x03, 0x04, 0x00, 0x16, 0xe3, // ResetDBSelection
+	}
+	f := newFrameReader(&timeoutReader{data: input})
+	frame, err := f.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(frame, input[6:]) {
+		t.Errorf("got frame %x, want %x", frame, input[6:])
+	}
+	if f.stats.BadFrames != 1 || f.stats.Skipped != 0 {
+		t.Errorf("got stats %+v", f.stats)
+	}
+	if _, err := f.readFrame(); err != ErrTimeout {
+		t.Errorf("got error %v, want %v", err, ErrTimeout)
+	}
+}
+
+// timeoutReader returns its data, then times out.
+type timeoutReader struct {
+	data []byte
+}
+
+func (r *timeoutReader) Read(b []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, ErrTimeout
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestNetTransport(t *testing.T) {
+	server, err := OpenNet("tcp", options.Options{"listen": "127.0.0.1:0"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	addr := server.rw.(*netStream).listener.Addr().String()
+
+	client, err := OpenNet("tcp", options.Options{"connect": addr}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Both ends only connect once they start reading.
+	requests := make(chan []byte)
+	go func() {
+		frame, _ := server.ReadFrame()
+		requests <- frame
+	}()
+	replies := make(chan []byte)
+	go func() {
+		frame, _ := client.ReadFrame()
+		replies <- frame
+	}()
+
+	identify := []byte{0x55, 0x03, 0x00, 0x01, 0x04, 0xf8}
+	for client.WriteFrame(identify) == errNotConnected {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if frame := <-requests; !bytes.Equal(frame, identify) {
+		t.Errorf("server got frame %x, want %x", frame, identify)
+	}
+
+	modelNum := []byte{0x55, 0x02, 0x00, 0x0d, 0xf1}
+	if err := server.WriteFrame(modelNum); err != nil {
+		t.Fatal(err)
+	}
+	if frame := <-replies; !bytes.Equal(frame, modelNum) {
+		t.Errorf("client got frame %x, want %x", frame, modelNum)
+	}
+}
+
+func TestPtyTransport(t *testing.T) {
+	master, err := OpenPty(options.Options{}, nil, nil)
+	if err != nil {
+		t.Skip("no pseudo-terminals:", err)
+	}
+	defer master.Close()
+
+	slave, err := os.OpenFile(master.rw.(*ptyStream).slave.Name(), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slave.Close()
+
+	// Bytes that a cooked terminal would mangle (CR, ^C, ^D) must survive.
+	frame := []byte{0x55, 0x04, 0x04, 0x0d, 0x03, 0x04, 0xe4}
+	if _, err := slave.Write(append([]byte{0xff}, frame...)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := master.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Errorf("got frame %x, want %x", got, frame)
+	}
+
+	// Closing interrupts a read that's waiting for the next frame.
+	read := make(chan error)
+	go func() {
+		_, err := master.ReadFrame()
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	master.Close()
+	select {
+	case err := <-read:
+		if err == nil {
+			t.Error("read a frame after closing")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("closing didn't interrupt the read")
+	}
+}